@@ -1,72 +1,187 @@
 package main
 
 import (
+	"bytes"
 	"context"
+	"crypto/hmac"
 	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/binary"
 	"encoding/hex"
+	"encoding/json"
 	"errors"
+	"flag"
 	"fmt"
+	"hash/crc32"
+	"io"
 	"log"
+	"math"
 	"os"
 	"os/signal"
+	"path/filepath"
 	"reflect"
+	"regexp"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"syscall"
 	"time"
+	"unicode/utf8"
+	"unsafe"
 
+	"github.com/BurntSushi/toml"
 	"github.com/joho/godotenv"
 
 	"github.com/go-mysql-org/go-mysql/canal"
+	"github.com/go-mysql-org/go-mysql/client"
 	"github.com/go-mysql-org/go-mysql/mysql"
 	"github.com/go-mysql-org/go-mysql/replication"
+	"github.com/go-mysql-org/go-mysql/schema"
 	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/gridfs"
 	"go.mongodb.org/mongo-driver/mongo/options"
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/charmap"
+	"golang.org/x/text/encoding/japanese"
+	"golang.org/x/text/encoding/korean"
+	"golang.org/x/text/encoding/simplifiedchinese"
+	"golang.org/x/text/encoding/traditionalchinese"
+	"golang.org/x/text/encoding/unicode"
 )
 
 type Delta struct {
-	F any `bson:"f,omitempty"`
-	T any `bson:"t,omitempty"`
+	F    any         `bson:"f,omitempty"`
+	T    any         `bson:"t,omitempty"`
+	FRef *ValueRef   `bson:"f_ref,omitempty"` // stands in for a large F (see LargeValuePolicy)
+	TRef *ValueRef   `bson:"t_ref,omitempty"`
+	P    []PathDelta `bson:"p,omitempty"` // JSON columns: changed paths instead of F/T
+	M    string      `bson:"m,omitempty"` // mask applied to F/T (see TableRule.Mask)
+}
+
+// ValueRef stands in for a column value too large to keep in the event
+type ValueRef struct {
+	Kind    string `bson:"kind"`              // "string", "binary" or "json" (relaxed extended JSON)
+	Len     int    `bson:"len"`               // bytes of the value
+	SHA256  string `bson:"sha256"`            // hex digest of those bytes
+	Preview string `bson:"preview,omitempty"` // leading text, cut at a rune boundary
+	File    string `bson:"file,omitempty"`    // GridFS file id in the <events>_values bucket
+}
+
+// PathDelta is one changed path of a JSON document
+type PathDelta struct {
+	Path string `bson:"path"` // MySQL JSON path, e.g. $.address.city
+	Op   string `bson:"op"`   // "a" added, "r" removed, "c" changed
+	F    any    `bson:"f,omitempty"`
+	T    any    `bson:"t,omitempty"`
 }
 type Meta struct {
 	DB, Tbl string
-	PK      any `bson:"pk"`
+	PK      any    `bson:"pk"`                // scalar, or column -> value document for composite keys
+	PKStr   string `bson:"pk_str,omitempty"`  // canonical string of a composite PK (see pkString)
+	PrevPK  any    `bson:"prev_pk,omitempty"` // key before an update that changed it
+	PrevStr string `bson:"prev_pk_str,omitempty"`
+	Key     string `bson:"key,omitempty"` // how PK identifies the row unless by primary key: "uk:<index>" or "hash"
 }
 type EventDoc struct {
-	ID    string           `bson:"_id"`
-	TS    time.Time        `bson:"ts"` // UTC
-	OP    string           `bson:"op"` // "i","u","d"
-	Meta  Meta             `bson:"meta"`
-	Seq   int64            `bson:"seq"` // optional if you have it
-	Chg   map[string]Delta `bson:"chg,omitempty"`
-	Src   map[string]any   `bson:"src,omitempty"`    // binlog coords/gtid
-	TSIST string           `bson:"ts_ist,omitempty"` // convenience string
+	ID        string           `bson:"_id"`
+	Source    string           `bson:"source"` // SourceConfig.ID of the MySQL primary
+	TS        time.Time        `bson:"ts"`     // UTC
+	OP        string           `bson:"op"`     // "i","u","d", "r" for snapshot reads, "t" for touches
+	Meta      Meta             `bson:"meta"`
+	Seq       int64            `bson:"seq"`                  // per-source capture order, breaks ties on ts
+	Img       string           `bson:"img,omitempty"`        // "minimal" or "noblob" for partial row images
+	TxID      string           `bson:"txid,omitempty"`       // transaction the row change belongs to
+	TxSeq     int              `bson:"txseq"`                // position of the row change within TxID
+	SchemaVer int              `bson:"schema_ver,omitempty"` // schema_history version the row was decoded with
+	Chg       map[string]Delta `bson:"chg,omitempty"`
+	Src       map[string]any   `bson:"src,omitempty"`    // binlog coords/gtid
+	TSIST     string           `bson:"ts_ist,omitempty"` // convenience string
+	Coll      string           `bson:"coll,omitempty"`   // collection table rules routed it to at commit ("": default); kept in staging and the spool only
+}
+
+// SchemaChangeDoc records one table affected by a DDL statement
+type SchemaChangeDoc struct {
+	ID     string    `bson:"_id"`
+	TS     time.Time `bson:"ts"` // UTC
+	Source string    `bson:"source"`
+	DB     string    `bson:"db"`
+	Tbl    string    `bson:"tbl"`
+	Stmt   string    `bson:"stmt"`
+	GTID   string    `bson:"gtid,omitempty"`
+	File   string    `bson:"file"`
+	Pos    uint32    `bson:"pos"`
+	Before []string  `bson:"before"` // columns before the statement (nil if unknown)
+	After  []string  `bson:"after"`  // columns after the statement (nil if dropped)
+	TSIST  string    `bson:"ts_ist,omitempty"`
+}
+
+// SchemaColumn is one column definition inside a schema_history version
+type SchemaColumn struct {
+	Name     string `bson:"name"`
+	Type     string `bson:"type"` // raw MySQL type, e.g. "varchar(64)"
+	Nullable bool   `bson:"nullable"`
+	PK       bool   `bson:"pk"`
+}
+
+// SchemaVersionDoc is one version of a table definition in schema_history
+type SchemaVersionDoc struct {
+	ID      string         `bson:"_id"` // source|db.tbl|version
+	Source  string         `bson:"source"`
+	DB      string         `bson:"db"`
+	Tbl     string         `bson:"tbl"`
+	Version int            `bson:"version"`
+	Hash    string         `bson:"hash"`
+	Columns []SchemaColumn `bson:"columns"`
+	TS      time.Time      `bson:"ts"` // when this version was first seen
 }
 
 type MongoSink struct {
-	client            *mongo.Client
-	events            *mongo.Collection
-	offsets           *mongo.Collection
-	staging           *mongo.Collection // Batch staging for crash recovery
-	loc               *time.Location
-	failCount         int // Consecutive failure count
-	lastErr           error
-	noTxWarningLogged bool // Log warning once only
+	client        *mongo.Client
+	events        *mongo.Collection
+	offsets       *mongo.Collection
+	staging       *mongo.Collection // Batch staging for crash recovery
+	schemaChanges *mongo.Collection // DDL audit trail
+	schemaHistory *mongo.Collection // Versioned table definitions
+	signals       *mongo.Collection // Incremental snapshot requests
+	deadLetters   *mongo.Collection // Events MongoDB refused for good
+	spool         *spool            // Local buffer while MongoDB is unreachable (nil: disabled)
+	loc           *time.Location
+	retry         RetryPolicy
+	failCount     int // Consecutive failure count
+	lastErr       error
+	noTxWarning   sync.Once // Log warning once only (sources write concurrently)
+
+	values       LargeValuePolicy
+	valueFiles   *gridfs.Bucket // "gridfs" mode only
+	valuesMu     sync.Mutex     // serialises uploads (the bucket's write deadline is shared)
+	stagingBytes int            // batches are split into staging documents of at most this size
+
+	// rulesMu guards rules, which SIGHUP replaces while sources write
+	rulesMu sync.RWMutex
+	rules   []TableRule
 }
 
-func newMongoSink(uri, db, coll, offsets string, loc *time.Location) (*MongoSink, error) {
-	c, err := mongo.Connect(context.Background(), options.Client().ApplyURI(uri))
+func newMongoSink(cfg MongoConfig, retry RetryPolicy, rules []TableRule, loc *time.Location) (*MongoSink, error) {
+	c, err := mongo.Connect(context.Background(), options.Client().ApplyURI(cfg.URI))
 	if err != nil {
 		return nil, err
 	}
+	db := c.Database(cfg.DB)
 	return &MongoSink{
-		client:            c,
-		events:            c.Database(db).Collection(coll),
-		offsets:           c.Database(db).Collection(offsets),
-		staging:           c.Database(db).Collection(coll + "_staging"),
-		loc:               loc,
-		noTxWarningLogged: false,
+		client:        c,
+		events:        db.Collection(cfg.Events),
+		offsets:       db.Collection(cfg.Offsets),
+		staging:       db.Collection(cfg.Events + "_staging"),
+		schemaChanges: db.Collection(cfg.SchemaChanges),
+		schemaHistory: db.Collection(cfg.SchemaHistory),
+		signals:       db.Collection(cfg.Signals),
+		deadLetters:   db.Collection(cfg.DeadLetters),
+		loc:           loc,
+		retry:         retry,
+		rules:         rules,
 	}, nil
 }
 
@@ -77,13 +192,17 @@ func toS(v any) string {
 // retryWithBackoff executes fn with exponential backoff retry on transient errors
 // maxRetries: maximum number of retry attempts (default 5)
 // initialDelay: initial delay between retries (default 100ms)
-func retryWithBackoff(ctx context.Context, fn func(context.Context) error, maxRetries int, initialDelay time.Duration) error {
+// maxDelay: cap of the doubling delay (default 10s)
+func retryWithBackoff(ctx context.Context, fn func(context.Context) error, maxRetries int, initialDelay, maxDelay time.Duration) error {
 	if maxRetries <= 0 {
 		maxRetries = 5
 	}
 	if initialDelay <= 0 {
 		initialDelay = 100 * time.Millisecond
 	}
+	if maxDelay <= 0 {
+		maxDelay = 10 * time.Second
+	}
 
 	var lastErr error
 	delay := initialDelay
@@ -135,49 +254,517 @@ func retryWithBackoff(ctx context.Context, fn func(context.Context) error, maxRe
 
 		// Exponential backoff: double the delay for next retry
 		delay *= 2
-		// Cap at 10 seconds per retry
-		if delay > 10*time.Second {
-			delay = 10 * time.Second
+		// Cap at maxDelay per retry
+		if delay > maxDelay {
+			delay = maxDelay
 		}
 	}
 
 	return lastErr
 }
 
-func (s *MongoSink) writeBatch(ctx context.Context, docs []EventDoc) error {
-	if len(docs) == 0 {
-		return nil
-	}
-	ws := make([]mongo.WriteModel, 0, len(docs))
-	for i := range docs {
-		ws = append(ws, mongo.NewInsertOneModel().SetDocument(docs[i]))
+// writeBatch inserts docs without touching the offset, skipping ones that
+// are already stored; returns how many were new
+func (s *MongoSink) writeBatch(ctx context.Context, docs []EventDoc) (int, error) {
+	return s.insertEvents(ctx, docs)
+}
+
+// insertEvents inserts docs into their collections (see collectionFor),
+// skipping events already stored; returns how many were new. Stored events
+// are looked up first, since inside a transaction (a session context) the
+// duplicate key error of inserting one would abort it; one stored after the
+// lookup fails the write there. Events refused with a permanent error are
+// returned as *rejectedEvents.
+func (s *MongoSink) insertEvents(ctx context.Context, docs []EventDoc) (int, error) {
+	collDocs := map[string][]EventDoc{}
+	for _, d := range docs {
+		name := s.collectionOf(d)
+		collDocs[name] = append(collDocs[name], d)
 	}
-	_, err := s.events.BulkWrite(ctx, ws, options.BulkWrite().SetOrdered(false))
-	if err != nil {
-		var bwe *mongo.BulkWriteException
-		if errors.As(err, &bwe) {
-			allDup := true
+
+	inserted := 0
+	rej := &rejectedEvents{}
+	for name, cds := range collDocs {
+		coll := s.events
+		if name != s.events.Name() {
+			coll = s.events.Database().Collection(name)
+		}
+		stored, err := storedIDs(ctx, coll, cds)
+		if err != nil {
+			return inserted, err
+		}
+		var ws []mongo.WriteModel
+		var wsDocs []EventDoc
+		for _, d := range cds {
+			if !stored[d.ID] {
+				doc := d
+				doc.Coll = "" // the collection says it
+				ws = append(ws, mongo.NewInsertOneModel().SetDocument(doc))
+				wsDocs = append(wsDocs, d)
+			}
+		}
+		if len(ws) == 0 {
+			continue
+		}
+		_, err = coll.BulkWrite(ctx, ws, options.BulkWrite().SetOrdered(false))
+		if err != nil {
+			var bwe mongo.BulkWriteException // returned by value
+			if !errors.As(err, &bwe) {
+				return inserted, err
+			}
+			// Inside a transaction any write error has aborted it, so a
+			// duplicate cannot be skipped: the lookup is redone on retry
+			inTx := mongo.SessionFromContext(ctx) != nil
 			for _, we := range bwe.WriteErrors {
-				if we.Code != 11000 {
-					allDup = false
-					break
+				switch {
+				case we.Code == 11000 && inTx:
+					return inserted, err
+				case we.Code == 11000: // stored since the lookup
+				case permanentWriteCodes[we.Code]:
+					rej.add(wsDocs[we.Index], fmt.Sprintf("%s (code %d)", we.Message, we.Code))
+				default:
+					return inserted, err
 				}
 			}
-			if allDup {
-				return nil
+			// Duplicates and rejected events
+			inserted += len(ws) - len(bwe.WriteErrors)
+			if len(rej.docs) > 0 {
+				// A write error aborts a transaction; report it before
+				// writing to other collections in the aborted one
+				return inserted, rej
 			}
+			continue
 		}
-		return err
+		inserted += len(ws)
 	}
-	return err
+	return inserted, nil
+}
+
+// storedIDs returns which of docs are already in coll
+func storedIDs(ctx context.Context, coll *mongo.Collection, docs []EventDoc) (map[string]bool, error) {
+	ids := make([]string, len(docs))
+	for i, d := range docs {
+		ids[i] = d.ID
+	}
+	cursor, err := coll.Find(ctx, bson.M{"_id": bson.M{"$in": ids}}, options.Find().SetProjection(bson.M{"_id": 1}))
+	if err != nil {
+		return nil, fmt.Errorf("look up stored events: %w", err)
+	}
+	var found []struct {
+		ID string `bson:"_id"`
+	}
+	if err := cursor.All(ctx, &found); err != nil {
+		return nil, fmt.Errorf("look up stored events: %w", err)
+	}
+	stored := make(map[string]bool, len(found))
+	for _, f := range found {
+		stored[f.ID] = true
+	}
+	return stored, nil
+}
+
+// permanentWriteCodes are MongoDB write errors that retrying the same event
+// cannot fix; such events go to the dead-letter collection
+var permanentWriteCodes = map[int]bool{
+	2:     true, // BadValue
+	14:    true, // TypeMismatch
+	22:    true, // InvalidBSON
+	52:    true, // DollarPrefixedFieldName
+	55:    true, // InvalidDBRef
+	56:    true, // EmptyFieldName
+	57:    true, // DottedFieldName
+	121:   true, // DocumentValidationFailure
+	10334: true, // BSONObjectTooLarge
+	17280: true, // KeyTooLong
+}
+
+// rejectedEvents reports events refused for good; the other events of the
+// write went through, or were rolled back with its transaction
+type rejectedEvents struct {
+	docs    []EventDoc
+	reasons []string
+}
+
+func (r *rejectedEvents) add(doc EventDoc, reason string) {
+	r.docs = append(r.docs, doc)
+	r.reasons = append(r.reasons, reason)
+}
+
+func (r *rejectedEvents) Error() string {
+	return fmt.Sprintf("%d events rejected (first: %s)", len(r.docs), r.reasons[0])
+}
+
+// without returns docs minus the rejected events
+func (r *rejectedEvents) without(docs []EventDoc) []EventDoc {
+	ids := make(map[string]bool, len(r.docs))
+	for _, d := range r.docs {
+		ids[d.ID] = true
+	}
+	kept := make([]EventDoc, 0, len(docs))
+	for _, d := range docs {
+		if !ids[d.ID] {
+			kept = append(kept, d)
+		}
+	}
+	return kept
+}
+
+// screenEvents rejects events that cannot be written at all, before they
+// reach a staging document they would break
+func screenEvents(docs []EventDoc) ([]EventDoc, *rejectedEvents) {
+	rej := &rejectedEvents{}
+	for _, d := range docs {
+		raw, err := bson.Marshal(d)
+		if err != nil {
+			rej.add(d, "encode: "+err.Error())
+		} else if len(raw) > maxEventBytes {
+			rej.add(d, fmt.Sprintf("document too large: %d bytes", len(raw)))
+		}
+	}
+	if len(rej.docs) == 0 {
+		return docs, nil
+	}
+	return rej.without(docs), rej
+}
+
+// DeadLetterDoc is an event MongoDB refused for good, kept with what is
+// needed to find its row change and to retry it (sdl -retry-dead-letters)
+type DeadLetterDoc struct {
+	ID       string               `bson:"_id"` // _id of the event
+	Source   string               `bson:"source"`
+	DB       string               `bson:"db"`
+	Tbl      string               `bson:"tbl"`
+	Coll     string               `bson:"coll"` // collection the event was routed to
+	Error    string               `bson:"error"`
+	Event    []byte               `bson:"event,omitempty"` // the event as BSON, if it encodes
+	Values   map[string]deadValue `bson:"values"`          // column values as Go literals, clipped
+	File     string               `bson:"file,omitempty"`
+	Pos      uint64               `bson:"pos,omitempty"`
+	GTID     string               `bson:"gtid,omitempty"`
+	TS       time.Time            `bson:"ts"`
+	FailedAt time.Time            `bson:"failedAt"`
+	Status   string               `bson:"status"` // "pending" or "retried"
+	Attempts int                  `bson:"attempts"`
+}
+
+type deadValue struct {
+	F string `bson:"f,omitempty"`
+	T string `bson:"t,omitempty"`
+}
+
+// deadValueText renders a value so that it always encodes: strings and
+// bytes quoted with invalid UTF-8 escaped, clipped to 1KB
+func deadValueText(v any) string {
+	if v == nil {
+		return ""
+	}
+	var s string
+	switch x := v.(type) {
+	case string:
+		s = strconv.Quote(x)
+	case []byte:
+		s = strconv.Quote(string(x))
+	default:
+		if s = fmt.Sprint(x); !utf8.ValidString(s) {
+			s = strconv.Quote(s)
+		}
+	}
+	if len(s) > 1024 {
+		s = strings.ToValidUTF8(s[:1021], "") + "..."
+	}
+	return s
+}
+
+// deadLetter stores rejected events in the dead-letter collection, keyed by
+// event _id so a replayed batch does not add them twice
+func (s *MongoSink) deadLetter(ctx context.Context, source string, rej *rejectedEvents) error {
+	for i, d := range rej.docs {
+		dl := DeadLetterDoc{
+			ID:       d.ID,
+			Source:   source,
+			DB:       d.Meta.DB,
+			Tbl:      d.Meta.Tbl,
+			Coll:     s.collectionOf(d),
+			Error:    rej.reasons[i],
+			Values:   make(map[string]deadValue, len(d.Chg)),
+			TS:       d.TS,
+			FailedAt: time.Now().UTC(),
+			Status:   "pending",
+		}
+		if raw, err := bson.Marshal(d); err == nil && len(raw) <= maxEventBytes {
+			dl.Event = raw
+		}
+		for col, v := range d.Chg {
+			dl.Values[strconv.QuoteToASCII(col)] = deadValue{F: deadValueText(v.F), T: deadValueText(v.T)}
+		}
+		var file, pos any
+		switch b := d.Src["binlog"].(type) {
+		case map[string]any:
+			file, pos = b["file"], b["pos"]
+		case bson.D: // decoded from staging or the spool
+			file, _ = docValue(b, "file")
+			pos, _ = docValue(b, "pos")
+		}
+		dl.File, _ = file.(string)
+		if n, ok := asInt(pos); ok {
+			dl.Pos = uint64(n)
+		}
+		dl.GTID, _ = d.Src["gtid"].(string)
+
+		err := retryWithBackoff(ctx, func(retryCtx context.Context) error {
+			_, err := s.deadLetters.ReplaceOne(retryCtx, bson.M{"_id": dl.ID}, dl, options.Replace().SetUpsert(true))
+			return err
+		}, s.retry.Attempts, s.retry.InitialDelay, s.retry.MaxDelay)
+		if err != nil {
+			return fmt.Errorf("dead-letter event %s: %w", dl.ID, err)
+		}
+		log.Printf("[%s] Dead-lettered event %s (%s.%s at %s:%d): %s", source, dl.ID, dl.DB, dl.Tbl, dl.File, dl.Pos, dl.Error)
+	}
+	return nil
+}
+
+// dropRejected runs write on docs, dead-lettering the events it reports as
+// rejected and running it again on the rest until it succeeds or fails for
+// another reason
+func (s *MongoSink) dropRejected(ctx context.Context, source string, docs []EventDoc, write func([]EventDoc) error) error {
+	for {
+		err := write(docs)
+		var rej *rejectedEvents
+		if !errors.As(err, &rej) {
+			return err
+		}
+		if err := s.deadLetter(ctx, source, rej); err != nil {
+			return err
+		}
+		docs = rej.without(docs)
+	}
+}
+
+// DeadLetterReport summarises a retryDeadLetters run
+type DeadLetterReport struct {
+	Retried  int // written to their collection (or found there already)
+	Failed   int // rejected again
+	Skipped  int // no encodable event to retry
+	Inserted int
+}
+
+// retryDeadLetters writes the pending dead letters again, oldest first.
+// Events that go through are marked "retried"; the others stay pending with
+// the new error and one more attempt.
+func (s *MongoSink) retryDeadLetters(ctx context.Context) (DeadLetterReport, error) {
+	var report DeadLetterReport
+	cursor, err := s.deadLetters.Find(ctx, bson.M{"status": "pending"},
+		options.Find().SetSort(bson.D{{Key: "failedAt", Value: 1}}))
+	if err != nil {
+		return report, fmt.Errorf("find dead letters: %w", err)
+	}
+	defer cursor.Close(ctx)
+
+	for cursor.Next(ctx) {
+		var dl DeadLetterDoc
+		if err := cursor.Decode(&dl); err != nil {
+			return report, fmt.Errorf("decode dead letter: %w", err)
+		}
+		var doc EventDoc
+		if len(dl.Event) == 0 || bson.Unmarshal(dl.Event, &doc) != nil {
+			report.Skipped++
+			log.Printf("Dead letter %s has no event to retry: %s", dl.ID, dl.Error)
+			continue
+		}
+
+		set := bson.M{}
+		docs := []EventDoc{doc}
+		if err := s.offloadValues(ctx, docs); err != nil {
+			return report, err
+		}
+		docs, rej := screenEvents(docs)
+		if rej == nil {
+			var n int
+			n, err = s.insertEvents(ctx, docs)
+			report.Inserted += n
+			if errors.As(err, &rej) {
+				err = nil
+			}
+		}
+		if err != nil {
+			return report, fmt.Errorf("retry dead letter %s: %w", dl.ID, err)
+		}
+		if rej != nil {
+			report.Failed++
+			set["error"] = rej.reasons[0]
+			log.Printf("Dead letter %s rejected again: %s", dl.ID, rej.reasons[0])
+		} else {
+			report.Retried++
+			set["status"] = "retried"
+			set["retriedAt"] = time.Now().UTC()
+		}
+		if _, err := s.deadLetters.UpdateByID(ctx, dl.ID, bson.M{"$set": set, "$inc": bson.M{"attempts": 1}}); err != nil {
+			return report, fmt.Errorf("update dead letter %s: %w", dl.ID, err)
+		}
+	}
+	return report, cursor.Err()
+}
+
+// setRules replaces the table rules; transactions committed afterwards use them
+func (s *MongoSink) setRules(rules []TableRule) {
+	s.rulesMu.Lock()
+	defer s.rulesMu.Unlock()
+	s.rules = rules
+}
+
+// tableRules returns the current table rules; callers must not modify them
+func (s *MongoSink) tableRules() []TableRule {
+	s.rulesMu.RLock()
+	defer s.rulesMu.RUnlock()
+	return s.rules
+}
+
+// ruleCollection returns the collection the first of rules with one that
+// matches db.tbl routes its events to, "" for the default
+func ruleCollection(rules []TableRule, db, tbl string) string {
+	name := db + "." + tbl
+	for _, r := range rules {
+		if r.Collection != "" && r.re.MatchString(name) {
+			return r.Collection
+		}
+	}
+	return ""
+}
+
+// collectionOf returns the events collection of d, as routed when its
+// transaction committed (see commitTxLocked)
+func (s *MongoSink) collectionOf(d EventDoc) string {
+	if d.Coll != "" {
+		return d.Coll
+	}
+	return s.events.Name()
 }
 
-// writeBatchWithGTID writes batch and GTID atomically with crash recovery via staging
+// writeBatchWithGTID writes batch and GTID to MongoDB, or to the local spool
+// while MongoDB is unreachable or older batches are still spooled, so that
+// batches always reach MongoDB in order
 func (s *MongoSink) writeBatchWithGTID(ctx context.Context, docs []EventDoc, source, gtid, file string, pos uint32) error {
 	if len(docs) == 0 {
 		return nil
 	}
+	if s.spool == nil {
+		return s.writeBatchToMongo(ctx, docs, source, gtid, file, pos)
+	}
+
+	b := spoolBatch{Events: docs, Source: source, GTID: gtid, File: file, Pos: pos, SpooledAt: time.Now().UTC()}
+	if s.spool.Pending() > 0 {
+		return s.spool.Append(b)
+	}
+	err := s.writeBatchToMongo(ctx, docs, source, gtid, file, pos)
+	if err == nil || !isMongoUnavailable(err) {
+		return err
+	}
+	log.Printf("MongoDB unavailable (%v), spooling batches to %s", err, s.spool.dir)
+	return s.spool.Append(b)
+}
+
+// isMongoUnavailable reports whether err means MongoDB could not be reached,
+// as opposed to rejecting the write
+func isMongoUnavailable(err error) bool {
+	var rej *rejectedEvents
+	var bwe mongo.BulkWriteException
+	var we mongo.WriteException
+	if errors.As(err, &rej) || errors.As(err, &bwe) && len(bwe.WriteErrors) > 0 || errors.As(err, &we) && len(we.WriteErrors) > 0 {
+		return false // the server refused the write
+	}
+	if mongo.IsNetworkError(err) || mongo.IsTimeout(err) || errors.Is(err, context.DeadlineExceeded) {
+		return true
+	}
+	var cmdErr mongo.CommandError
+	if errors.As(err, &cmdErr) && cmdErr.Code != noSuchTransaction &&
+		(cmdErr.HasErrorLabel("RetryableWriteError") || cmdErr.HasErrorLabel("TransientTransactionError")) {
+		return true
+	}
+	return strings.Contains(err.Error(), "server selection error")
+}
+
+// noSuchTransaction follows an earlier error that aborted the transaction;
+// MongoDB labels it transient, but retrying repeats that error
+const noSuchTransaction = 251
+
+// writeBatchToMongo writes batch and GTID atomically with crash recovery via
+// staging. Large values are offloaded first; a batch too big for one staging
+// document is written in parts, and only the last part saves the offset: a
+// crash in between replays the batch from the previous offset, and events of
+// the parts already written are skipped as duplicates.
+func (s *MongoSink) writeBatchToMongo(ctx context.Context, docs []EventDoc, source, gtid, file string, pos uint32) error {
+	seq := lastSeq(docs) // taken before any event is dead-lettered
+	err := retryWithBackoff(ctx, func(retryCtx context.Context) error {
+		return s.offloadValues(retryCtx, docs)
+	}, s.retry.Attempts, s.retry.InitialDelay, s.retry.MaxDelay)
+	if err != nil {
+		return fmt.Errorf("offload large values: %w", err)
+	}
+	docs, rej := screenEvents(docs)
+	if rej != nil {
+		if err := s.deadLetter(ctx, source, rej); err != nil {
+			return err
+		}
+	}
+
+	maxBytes := s.stagingBytes
+	if maxBytes <= 0 {
+		maxBytes = maxEventBytes
+	}
+	parts := splitBatch(docs, maxBytes)
+	for _, part := range parts[:len(parts)-1] {
+		if err := s.writeStagedPart(ctx, part, source); err != nil {
+			return err
+		}
+	}
+	return s.writeStagedBatch(ctx, parts[len(parts)-1], source, gtid, file, pos, seq)
+}
+
+// lastSeq returns the highest sequence number in docs
+func lastSeq(docs []EventDoc) int64 {
+	var seq int64
+	for _, d := range docs {
+		seq = max(seq, d.Seq)
+	}
+	return seq
+}
+
+// writeStagedPart writes events of a split batch without moving the offset;
+// its staging document has no GTID, so recovery only replays its events.
+// The saved sequence number does move, so a replay never reuses one.
+func (s *MongoSink) writeStagedPart(ctx context.Context, docs []EventDoc, source string) error {
+	batchID := fmt.Sprintf("%s_%d_part", source, time.Now().UnixNano())
+	stagingDoc := bson.M{
+		"_id":       batchID,
+		"events":    docs,
+		"source":    source,
+		"gtid":      "",
+		"seq":       lastSeq(docs),
+		"createdAt": time.Now().UTC(),
+		"status":    "pending",
+	}
+	return retryWithBackoff(ctx, func(retryCtx context.Context) error {
+		if _, err := s.staging.InsertOne(retryCtx, stagingDoc); err != nil && !mongo.IsDuplicateKeyError(err) {
+			return fmt.Errorf("staging insert: %w", err)
+		}
+		err := s.dropRejected(retryCtx, source, docs, func(docs []EventDoc) error {
+			_, err := s.insertEvents(retryCtx, docs)
+			return err
+		})
+		if err != nil {
+			return fmt.Errorf("write batch part: %w", err)
+		}
+		if err := s.saveSeq(retryCtx, source, lastSeq(docs)); err != nil {
+			return fmt.Errorf("save sequence: %w", err)
+		}
+		_, _ = s.staging.UpdateByID(retryCtx, batchID, bson.M{"$set": bson.M{"status": "committed", "committedAt": time.Now().UTC()}})
+		return nil
+	}, s.retry.Attempts, s.retry.InitialDelay, s.retry.MaxDelay)
+}
 
+// writeStagedBatch writes docs and the offset, with the last sequence number
+// of the batch, through a staging document
+func (s *MongoSink) writeStagedBatch(ctx context.Context, docs []EventDoc, source, gtid, file string, pos uint32, seq int64) error {
 	// Create staging document to protect against crashes
 	batchID := fmt.Sprintf("%s_%d_%s", source, time.Now().UnixNano(), gtid)
 	stagingDoc := bson.M{
@@ -187,6 +774,7 @@ func (s *MongoSink) writeBatchWithGTID(ctx context.Context, docs []EventDoc, sou
 		"gtid":      gtid,
 		"file":      file,
 		"pos":       pos,
+		"seq":       seq,
 		"createdAt": time.Now().UTC(),
 		"status":    "pending", // pending -> committed -> archived
 	}
@@ -194,12 +782,15 @@ func (s *MongoSink) writeBatchWithGTID(ctx context.Context, docs []EventDoc, sou
 	// Use retryWithBackoff to handle transient failures
 	return retryWithBackoff(ctx, func(retryCtx context.Context) error {
 		// First, write to staging (crash recovery point)
-		if _, err := s.staging.InsertOne(retryCtx, stagingDoc); err != nil {
-			return fmt.Errorf("staging insert: %w", err)
+		if _, err := s.staging.InsertOne(retryCtx, stagingDoc); err != nil && !mongo.IsDuplicateKeyError(err) {
+			return fmt.Errorf("staging insert: %w", err) // a duplicate is our own earlier attempt
 		}
 
-		// Try with transaction if MongoDB supports it, fall back to non-transactional if not
-		err := s.writeBatchWithTransaction(retryCtx, docs, source, gtid, file, pos)
+		// Try with transaction if MongoDB supports it, fall back to non-transactional if not.
+		// Rejected events are dead-lettered and the batch written without them.
+		err := s.dropRejected(retryCtx, source, docs, func(docs []EventDoc) error {
+			return s.writeBatchWithTransaction(retryCtx, docs, source, gtid, file, pos, seq)
+		})
 		if err != nil {
 			// Check if error is due to transaction limitations (replica set requirement or time-series collection)
 			errStr := err.Error()
@@ -207,11 +798,12 @@ func (s *MongoSink) writeBatchWithGTID(ctx context.Context, docs []EventDoc, sou
 				strings.Contains(errStr, "Cannot insert into a time-series collection in a multi-document transaction") {
 				// Fallback: write without transaction (WARNING: not atomic, but works)
 				// Log warning only once to avoid spam
-				if !s.noTxWarningLogged {
+				s.noTxWarning.Do(func() {
 					log.Println("WARNING: MongoDB transactions not supported (standalone or time-series collection), using non-transactional writes. Data safety reduced.")
-					s.noTxWarningLogged = true
-				}
-				err = s.writeBatchWithoutTransaction(retryCtx, docs, source, gtid, file, pos)
+				})
+				err = s.dropRejected(retryCtx, source, docs, func(docs []EventDoc) error {
+					return s.writeBatchWithoutTransaction(retryCtx, docs, source, gtid, file, pos, seq)
+				})
 				if err != nil {
 					return fmt.Errorf("write batch (non-transactional fallback): %w", err)
 				}
@@ -223,7 +815,131 @@ func (s *MongoSink) writeBatchWithGTID(ctx context.Context, docs []EventDoc, sou
 		// Mark staging as committed (for recovery)
 		_, _ = s.staging.UpdateByID(retryCtx, batchID, bson.M{"$set": bson.M{"status": "committed", "committedAt": time.Now().UTC()}})
 		return nil
-	}, 5, 100*time.Millisecond)
+	}, s.retry.Attempts, s.retry.InitialDelay, s.retry.MaxDelay)
+}
+
+// resumeGTID is where streaming continues: the newest spooled batch while
+// the spool holds any, otherwise the saved offset
+func (s *MongoSink) resumeGTID(ctx context.Context, source string) (string, bool, error) {
+	if s.spool != nil {
+		if gtid := s.spool.LastGTID(source); gtid != "" {
+			return gtid, true, nil
+		}
+	}
+	return s.loadGTID(ctx, source)
+}
+
+// RunSpoolDrainer writes spooled batches to MongoDB oldest first once it is
+// reachable again; the offset advances with each drained batch. A batch
+// MongoDB refuses cfg.MaxAttempts times is dead-lettered (deadLetterBatch).
+// Blocks until ctx is done.
+func (s *MongoSink) RunSpoolDrainer(ctx context.Context, cfg SpoolConfig) {
+	if s.spool == nil {
+		return
+	}
+	interval := cfg.DrainInterval
+	if interval <= 0 {
+		interval = 5 * time.Second
+	}
+	t := time.NewTicker(interval)
+	defer t.Stop()
+
+	write := func(b spoolBatch) error {
+		return s.writeBatchToMongo(ctx, b.Events, b.Source, b.GTID, b.File, b.Pos)
+	}
+	giveUp := func(b spoolBatch, cause error) error {
+		return s.deadLetterBatch(ctx, b, cause)
+	}
+	for {
+		drained, err := s.spool.drain(ctx, cfg.MaxAttempts, write, giveUp)
+		if err != nil && !isMongoUnavailable(err) {
+			log.Printf("Error draining spool: %v", err)
+		}
+		if drained > 0 {
+			log.Printf("Drained %d spooled batches to MongoDB, %d remaining", drained, s.spool.Pending())
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+	}
+}
+
+// deadLetterBatch gives up on a spooled batch: its events go to the
+// dead-letter collection, where sdl -retry-dead-letters can retry them, and
+// the offset moves past the batch
+func (s *MongoSink) deadLetterBatch(ctx context.Context, b spoolBatch, cause error) error {
+	rej := &rejectedEvents{}
+	for _, d := range b.Events {
+		rej.add(d, "spooled batch: "+cause.Error())
+	}
+	if len(rej.docs) > 0 {
+		if err := s.deadLetter(ctx, b.Source, rej); err != nil {
+			return err
+		}
+	}
+	if err := s.saveSeq(ctx, b.Source, lastSeq(b.Events)); err != nil {
+		return err
+	}
+	if err := s.saveGTID(ctx, b.Source, b.GTID, b.File, b.Pos); err != nil {
+		return err
+	}
+	log.Printf("[%s] Gave up on spooled batch (GTID %s) after repeated failures; %d events dead-lettered", b.Source, b.GTID, len(b.Events))
+	return nil
+}
+
+// writeSchemaChange stores a DDL record; replays of the same statement are ignored
+func (s *MongoSink) writeSchemaChange(ctx context.Context, doc SchemaChangeDoc) error {
+	return retryWithBackoff(ctx, func(retryCtx context.Context) error {
+		_, err := s.schemaChanges.InsertOne(retryCtx, doc)
+		if err != nil && !mongo.IsDuplicateKeyError(err) {
+			return err
+		}
+		return nil
+	}, s.retry.Attempts, s.retry.InitialDelay, s.retry.MaxDelay)
+}
+
+// registerSchema returns the schema_history version matching cols, adding a
+// new version when the definition differs from the latest stored one
+func (s *MongoSink) registerSchema(ctx context.Context, source, db, tbl string, cols []SchemaColumn) (int, error) {
+	raw, err := bson.Marshal(bson.M{"columns": cols})
+	if err != nil {
+		return 0, fmt.Errorf("encode columns: %w", err)
+	}
+	sum := sha1.Sum(raw)
+	hash := hex.EncodeToString(sum[:])
+
+	var version int
+	err = retryWithBackoff(ctx, func(retryCtx context.Context) error {
+		var latest SchemaVersionDoc
+		err := s.schemaHistory.FindOne(retryCtx,
+			bson.M{"source": source, "db": db, "tbl": tbl},
+			options.FindOne().SetSort(bson.D{{Key: "version", Value: -1}}),
+		).Decode(&latest)
+		if err != nil && err != mongo.ErrNoDocuments {
+			return err
+		}
+		if err == nil && latest.Hash == hash {
+			version = latest.Version
+			return nil
+		}
+
+		version = latest.Version + 1
+		_, err = s.schemaHistory.InsertOne(retryCtx, SchemaVersionDoc{
+			ID:      fmt.Sprintf("%s|%s.%s|%d", source, db, tbl, version),
+			Source:  source,
+			DB:      db,
+			Tbl:     tbl,
+			Version: version,
+			Hash:    hash,
+			Columns: cols,
+			TS:      time.Now().UTC(),
+		})
+		return err
+	}, s.retry.Attempts, s.retry.InitialDelay, s.retry.MaxDelay)
+	return version, err
 }
 
 func (s *MongoSink) saveGTID(ctx context.Context, source, gtid string, file string, pos uint32) error {
@@ -253,7 +969,7 @@ func (s *MongoSink) loadGTID(ctx context.Context, source string) (string, bool,
 			return err
 		}
 		return nil
-	}, 5, 100*time.Millisecond)
+	}, s.retry.Attempts, s.retry.InitialDelay, s.retry.MaxDelay)
 
 	if err != nil && err != mongo.ErrNoDocuments {
 		return "", false, err
@@ -265,8 +981,39 @@ func (s *MongoSink) loadGTID(ctx context.Context, source string) (string, bool,
 	return doc.GTID, true, nil
 }
 
+// saveSeq raises the saved sequence number of source to at least seq
+func (s *MongoSink) saveSeq(ctx context.Context, source string, seq int64) error {
+	_, err := s.offsets.UpdateByID(ctx, source, bson.M{
+		"$set": bson.M{"source": source},
+		"$max": bson.M{"seq": seq},
+	}, options.Update().SetUpsert(true))
+	return err
+}
+
+// resumeSeq returns the last sequence number given out for source: the
+// newest spooled batch's or the saved one, whichever is higher
+func (s *MongoSink) resumeSeq(ctx context.Context, source string) (int64, error) {
+	var doc struct {
+		Seq int64 `bson:"seq"`
+	}
+	err := retryWithBackoff(ctx, func(retryCtx context.Context) error {
+		err := s.offsets.FindOne(retryCtx, bson.M{"_id": source}).Decode(&doc)
+		if err == mongo.ErrNoDocuments {
+			return nil
+		}
+		return err
+	}, s.retry.Attempts, s.retry.InitialDelay, s.retry.MaxDelay)
+	if err != nil {
+		return 0, err
+	}
+	if s.spool != nil {
+		return max(doc.Seq, s.spool.LastSeq(source)), nil
+	}
+	return doc.Seq, nil
+}
+
 // writeBatchWithTransaction writes batch and GTID within a transaction (requires replica set)
-func (s *MongoSink) writeBatchWithTransaction(ctx context.Context, docs []EventDoc, source, gtid, file string, pos uint32) error {
+func (s *MongoSink) writeBatchWithTransaction(ctx context.Context, docs []EventDoc, source, gtid, file string, pos uint32, seq int64) error {
 	session, err := s.client.StartSession()
 	if err != nil {
 		return fmt.Errorf("start session: %w", err)
@@ -274,33 +1021,13 @@ func (s *MongoSink) writeBatchWithTransaction(ctx context.Context, docs []EventD
 	defer session.EndSession(ctx)
 
 	_, err = session.WithTransaction(ctx, func(sessCtx mongo.SessionContext) (interface{}, error) {
-		// Write events batch
-		ws := make([]mongo.WriteModel, 0, len(docs))
-		for i := range docs {
-			ws = append(ws, mongo.NewInsertOneModel().SetDocument(docs[i]))
-		}
-		_, err := s.events.BulkWrite(sessCtx, ws, options.BulkWrite().SetOrdered(false))
-		if err != nil {
-			var bwe *mongo.BulkWriteException
-			if errors.As(err, &bwe) {
-				allDup := true
-				for _, we := range bwe.WriteErrors {
-					if we.Code != 11000 {
-						allDup = false
-						break
-					}
-				}
-				if !allDup {
-					return nil, err
-				}
-				// All duplicates, continue to save GTID
-			} else {
-				return nil, err
-			}
+		// Write events batch (all-duplicate writes continue to save GTID)
+		if _, err := s.insertEvents(sessCtx, docs); err != nil {
+			return nil, err
 		}
 
 		// Save GTID offset
-		_, err = s.offsets.UpdateByID(sessCtx, source, bson.M{
+		_, err := s.offsets.UpdateByID(sessCtx, source, bson.M{
 			"$set": bson.M{
 				"source":    source,
 				"gtid":      gtid,
@@ -308,6 +1035,7 @@ func (s *MongoSink) writeBatchWithTransaction(ctx context.Context, docs []EventD
 				"pos":       pos,
 				"updatedAt": time.Now().UTC(),
 			},
+			"$max": bson.M{"seq": seq},
 		}, options.Update().SetUpsert(true))
 		if err != nil {
 			return nil, fmt.Errorf("save GTID: %w", err)
@@ -322,34 +1050,14 @@ func (s *MongoSink) writeBatchWithTransaction(ctx context.Context, docs []EventD
 // writeBatchWithoutTransaction writes batch and GTID without transaction (fallback for standalone MongoDB)
 // WARNING: This is NOT atomic - if service crashes between writes, GTID may be saved without events or vice versa
 // Only used when MongoDB is not a replica set
-func (s *MongoSink) writeBatchWithoutTransaction(ctx context.Context, docs []EventDoc, source, gtid, file string, pos uint32) error {
-	// Write events batch first
-	ws := make([]mongo.WriteModel, 0, len(docs))
-	for i := range docs {
-		ws = append(ws, mongo.NewInsertOneModel().SetDocument(docs[i]))
-	}
-	_, err := s.events.BulkWrite(ctx, ws, options.BulkWrite().SetOrdered(false))
-	if err != nil {
-		var bwe *mongo.BulkWriteException
-		if errors.As(err, &bwe) {
-			allDup := true
-			for _, we := range bwe.WriteErrors {
-				if we.Code != 11000 {
-					allDup = false
-					break
-				}
-			}
-			if !allDup {
-				return fmt.Errorf("bulk write events: %w", err)
-			}
-			// All duplicates, continue to save GTID
-		} else {
-			return fmt.Errorf("bulk write events: %w", err)
-		}
+func (s *MongoSink) writeBatchWithoutTransaction(ctx context.Context, docs []EventDoc, source, gtid, file string, pos uint32, seq int64) error {
+	// Write events batch first (all-duplicate writes continue to save GTID)
+	if _, err := s.insertEvents(ctx, docs); err != nil {
+		return fmt.Errorf("bulk write events: %w", err)
 	}
 
 	// Save GTID offset after events (best effort on non-transactional)
-	_, err = s.offsets.UpdateByID(ctx, source, bson.M{
+	_, err := s.offsets.UpdateByID(ctx, source, bson.M{
 		"$set": bson.M{
 			"source":    source,
 			"gtid":      gtid,
@@ -357,6 +1065,7 @@ func (s *MongoSink) writeBatchWithoutTransaction(ctx context.Context, docs []Eve
 			"pos":       pos,
 			"updatedAt": time.Now().UTC(),
 		},
+		"$max": bson.M{"seq": seq},
 	}, options.Update().SetUpsert(true))
 	if err != nil {
 		return fmt.Errorf("save GTID (non-transactional): %w", err)
@@ -365,473 +1074,3823 @@ func (s *MongoSink) writeBatchWithoutTransaction(ctx context.Context, docs []Eve
 	return nil
 }
 
-// RecoverPendingBatches attempts to recover uncommitted batches from staging collection
-// This handles the case where service crashed before flushing batch to MongoDB
-func (s *MongoSink) RecoverPendingBatches(ctx context.Context) error {
-	cursor, err := s.staging.Find(ctx, bson.M{"status": "pending"})
+// stagedBatch is a staging document as written by writeBatchWithGTID
+type stagedBatch struct {
+	ID        string     `bson:"_id"`
+	Events    []EventDoc `bson:"events"`
+	Source    string     `bson:"source"`
+	GTID      string     `bson:"gtid"`
+	File      string     `bson:"file"`
+	Pos       uint32     `bson:"pos"`
+	Seq       int64      `bson:"seq"`
+	CreatedAt time.Time  `bson:"createdAt"`
+}
+
+// RecoveryReport summarises what RecoverPendingBatches replayed
+type RecoveryReport struct {
+	Batches  int    // pending batches found
+	Events   int    // events they held
+	Inserted int    // events that were missing from the events collection
+	Offset   string // GTID set the offset was advanced to, if it was behind
+}
+
+// RecoverPendingBatches replays batches left "pending" in staging by a crash
+// between the staging insert and the commit. Events are re-inserted
+// idempotently (ones already stored are skipped by _id), the offset is moved
+// up to the batch GTID if it is behind, and the batch is marked "recovered".
+// Batches are replayed oldest first.
+func (s *MongoSink) RecoverPendingBatches(ctx context.Context, source, flavor string) (RecoveryReport, error) {
+	var report RecoveryReport
+	cursor, err := s.staging.Find(ctx,
+		bson.M{"status": "pending", "source": source},
+		options.Find().SetSort(bson.D{{Key: "createdAt", Value: 1}}),
+	)
 	if err != nil {
-		return fmt.Errorf("find pending batches: %w", err)
+		return report, fmt.Errorf("find pending batches: %w", err)
 	}
 	defer cursor.Close(ctx)
 
-	var stagingDocs []bson.M
-	if err := cursor.All(ctx, &stagingDocs); err != nil {
-		return fmt.Errorf("decode pending batches: %w", err)
+	var batches []stagedBatch
+	if err := cursor.All(ctx, &batches); err != nil {
+		return report, fmt.Errorf("decode pending batches: %w", err)
 	}
-
-	if len(stagingDocs) > 0 {
-		log.Printf("Found %d pending batches to recover", len(stagingDocs))
-		for _, doc := range stagingDocs {
-			log.Printf("Recovering batch %v", doc["_id"])
-			// Mark as archived (don't re-process)
-			_, _ = s.staging.UpdateByID(ctx, doc["_id"], bson.M{
-				"$set": bson.M{
-					"status":     "archived",
-					"archivedAt": time.Now().UTC(),
-				},
-			})
-		}
+	if len(batches) == 0 {
+		return report, nil
 	}
+	log.Printf("Found %d pending batches to recover", len(batches))
 
-	return nil
+	for _, b := range batches {
+		inserted := 0
+		err := s.dropRejected(ctx, source, b.Events, func(docs []EventDoc) error {
+			n, err := s.writeBatch(ctx, docs)
+			inserted += n
+			return err
+		})
+		if err != nil {
+			return report, fmt.Errorf("replay batch %s: %w", b.ID, err)
+		}
+
+		advanced, err := s.advanceOffset(ctx, source, flavor, b.GTID, b.File, b.Pos)
+		if err != nil {
+			return report, fmt.Errorf("advance offset for batch %s: %w", b.ID, err)
+		}
+		if err := s.saveSeq(ctx, source, max(b.Seq, lastSeq(b.Events))); err != nil {
+			return report, fmt.Errorf("save sequence for batch %s: %w", b.ID, err)
+		}
+
+		_, err = s.staging.UpdateByID(ctx, b.ID, bson.M{
+			"$set": bson.M{
+				"status":      "recovered",
+				"recoveredAt": time.Now().UTC(),
+				"inserted":    inserted,
+			},
+		})
+		if err != nil {
+			return report, fmt.Errorf("mark batch %s recovered: %w", b.ID, err)
+		}
+
+		report.Batches++
+		report.Events += len(b.Events)
+		report.Inserted += inserted
+		if advanced {
+			report.Offset = b.GTID
+		}
+		log.Printf("Recovered batch %s: %d events, %d were missing, offset advanced: %v",
+			b.ID, len(b.Events), inserted, advanced)
+	}
+	return report, nil
+}
+
+// advanceOffset saves gtid as the offset unless the saved one already
+// contains it; returns whether the offset moved
+func (s *MongoSink) advanceOffset(ctx context.Context, source, flavor, gtid, file string, pos uint32) (bool, error) {
+	if gtid == "" {
+		return false, nil // snapshot chunk or part of a split batch; no offset to move
+	}
+	staged, err := mysql.ParseGTIDSet(flavor, gtid)
+	if err != nil {
+		return false, fmt.Errorf("parse staged GTID %q: %w", gtid, err)
+	}
+	saved, ok, err := s.loadGTID(ctx, source)
+	if err != nil {
+		return false, err
+	}
+	if ok {
+		cur, err := mysql.ParseGTIDSet(flavor, saved)
+		if err != nil {
+			return false, fmt.Errorf("parse saved GTID %q: %w", saved, err)
+		}
+		if cur.Contain(staged) {
+			return false, nil
+		}
+	}
+	if err := s.saveGTID(ctx, source, gtid, file, pos); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// maxEventBytes caps one event document, leaving room under MongoDB's 16MB
+// document limit for the staging envelope around it
+const maxEventBytes = 15 << 20
+
+// LargeValuePolicy keeps big column values out of event documents
+type LargeValuePolicy struct {
+	Threshold int    `toml:"threshold"` // values above this many bytes are replaced by a ValueRef (0: only to fit maxEventBytes)
+	Mode      string `toml:"mode"`      // "summary" (hash, length, preview) or "gridfs" (also stored in the <events>_values bucket)
+	Preview   int    `toml:"preview"`   // bytes of text kept in ValueRef.Preview
+}
+
+// applyEnv overrides p from LARGE_VALUE_THRESHOLD, LARGE_VALUE_MODE and
+// LARGE_VALUE_PREVIEW
+func (p *LargeValuePolicy) applyEnv() {
+	p.Threshold = getenvInt("LARGE_VALUE_THRESHOLD", p.Threshold)
+	p.Mode = getenv("LARGE_VALUE_MODE", p.Mode)
+	p.Preview = getenvInt("LARGE_VALUE_PREVIEW", p.Preview)
+}
+
+// offloadValues replaces the column values of docs above the threshold by
+// references, then the largest remaining ones of any event still above
+// maxEventBytes. Replaced values are gone from docs, so a retry only uploads
+// what is left.
+func (s *MongoSink) offloadValues(ctx context.Context, docs []EventDoc) error {
+	// offload replaces the old (from) or new value of d by its reference
+	offload := func(d *Delta, from bool) error {
+		v, ref := &d.T, &d.TRef
+		if from {
+			v, ref = &d.F, &d.FRef
+		}
+		r, err := s.valueRef(ctx, *v)
+		if err != nil {
+			return err
+		}
+		*v, *ref = nil, r
+		return nil
+	}
+
+	for i := range docs {
+		doc := &docs[i]
+		if s.values.Threshold > 0 {
+			for col, d := range doc.Chg {
+				for _, from := range []bool{true, false} {
+					v := d.T
+					if from {
+						v = d.F
+					}
+					if valueSize(v) > s.values.Threshold {
+						if err := offload(&d, from); err != nil {
+							return err
+						}
+					}
+				}
+				doc.Chg[col] = d
+			}
+		}
+		for {
+			raw, err := bson.Marshal(doc)
+			if err != nil || len(raw) <= maxEventBytes {
+				break // an event that does not encode is dead-lettered by screenEvents
+			}
+			col, from, size := "", false, 0
+			for c, d := range doc.Chg {
+				if n := valueSize(d.F); n > size {
+					col, from, size = c, true, n
+				}
+				if n := valueSize(d.T); n > size {
+					col, from, size = c, false, n
+				}
+			}
+			if col == "" {
+				break // nothing left to offload; screenEvents dead-letters it
+			}
+			d := doc.Chg[col]
+			if err := offload(&d, from); err != nil {
+				return err
+			}
+			doc.Chg[col] = d
+		}
+	}
+	return nil
+}
+
+// valueSize is the stored size of a string, binary or JSON column value;
+// other types are too small to matter
+func valueSize(v any) int {
+	switch x := v.(type) {
+	case string:
+		return len(x)
+	case []byte:
+		return len(x)
+	case bson.D, bson.A:
+		raw, err := bson.Marshal(bson.D{{Key: "v", Value: x}})
+		if err != nil {
+			return 0
+		}
+		return len(raw)
+	}
+	return 0
+}
+
+// valueRef describes v and, in "gridfs" mode, stores its bytes in the
+// values bucket under their SHA-256, so equal values are stored once and a
+// retried upload finds its file
+func (s *MongoSink) valueRef(ctx context.Context, v any) (*ValueRef, error) {
+	ref := &ValueRef{}
+	var b []byte
+	switch x := v.(type) {
+	case string:
+		ref.Kind, b = "string", []byte(x)
+	case []byte:
+		ref.Kind, b = "binary", x
+	default:
+		raw, err := bson.MarshalExtJSON(bson.D{{Key: "v", Value: x}}, false, false)
+		if err != nil {
+			return nil, fmt.Errorf("encode JSON value: %w", err)
+		}
+		ref.Kind, b = "json", bytes.TrimSuffix(bytes.TrimPrefix(raw, []byte(`{"v":`)), []byte("}"))
+	}
+	sum := sha256.Sum256(b)
+	ref.Len, ref.SHA256 = len(b), hex.EncodeToString(sum[:])
+	if ref.Kind != "binary" || utf8.Valid(b) {
+		p := b
+		if len(p) > s.values.Preview {
+			p = p[:s.values.Preview]
+			for len(p) > 0 && !utf8.Valid(p) {
+				p = p[:len(p)-1] // cut at a rune boundary
+			}
+		}
+		ref.Preview = string(p)
+	}
+	if s.valueFiles == nil {
+		return ref, nil
+	}
+
+	s.valuesMu.Lock()
+	defer s.valuesMu.Unlock()
+	files := s.valueFiles.GetFilesCollection()
+	if n, err := files.CountDocuments(ctx, bson.M{"_id": ref.SHA256}); err != nil {
+		return nil, fmt.Errorf("look up value file: %w", err)
+	} else if n == 0 {
+		// Chunks of an upload cut short by a crash would clash with ours
+		if _, err := s.valueFiles.GetChunksCollection().DeleteMany(ctx, bson.M{"files_id": ref.SHA256}); err != nil {
+			return nil, fmt.Errorf("clear partial value file: %w", err)
+		}
+		deadline, _ := ctx.Deadline()
+		_ = s.valueFiles.SetWriteDeadline(deadline)
+		err := s.valueFiles.UploadFromStreamWithID(ref.SHA256, ref.SHA256, bytes.NewReader(b),
+			options.GridFSUpload().SetMetadata(bson.M{"kind": ref.Kind}))
+		if err != nil && !mongo.IsDuplicateKeyError(err) {
+			return nil, fmt.Errorf("upload value file: %w", err)
+		}
+	}
+	ref.File = ref.SHA256
+	return ref, nil
+}
+
+// splitBatch cuts docs into runs whose encoded events stay under maxBytes,
+// so each fits in one staging document; an event larger than maxBytes gets
+// a run of its own
+func splitBatch(docs []EventDoc, maxBytes int) [][]EventDoc {
+	var parts [][]EventDoc
+	start, size := 0, 0
+	for i := range docs {
+		n := maxBytes // unencodable: let the write report it
+		if raw, err := bson.Marshal(docs[i]); err == nil {
+			n = len(raw)
+		}
+		if i > start && size+n > maxBytes {
+			parts = append(parts, docs[start:i])
+			start, size = i, 0
+		}
+		size += n
+	}
+	return append(parts, docs[start:])
+}
+
+// StagingPolicy controls how long written batches stay in staging
+type StagingPolicy struct {
+	Retention  time.Duration `toml:"retention"`      // keep committed/recovered/archived batches this long; 0 keeps them forever
+	Interval   time.Duration `toml:"prune_interval"` // how often to prune and refresh StagingStats
+	AlertAge   time.Duration `toml:"alert_age"`      // warn when a batch has been pending longer than this
+	AlertBytes int64         `toml:"alert_bytes"`    // warn when the staging collection grows beyond this
+	MaxBytes   int           `toml:"max_bytes"`      // split batches into staging documents of at most this size
+}
+
+// applyEnv overrides p from STAGING_RETENTION, STAGING_PRUNE_INTERVAL,
+// STAGING_ALERT_AGE, STAGING_ALERT_BYTES and STAGING_MAX_BYTES
+func (p *StagingPolicy) applyEnv() {
+	p.MaxBytes = getenvInt("STAGING_MAX_BYTES", p.MaxBytes)
+	p.Retention = getenvDuration("STAGING_RETENTION", p.Retention)
+	p.Interval = getenvDuration("STAGING_PRUNE_INTERVAL", p.Interval)
+	p.AlertAge = getenvDuration("STAGING_ALERT_AGE", p.AlertAge)
+	p.AlertBytes = int64(getenvInt("STAGING_ALERT_BYTES", int(p.AlertBytes)))
+}
+
+// StagingStats describes the staging collection; it is kept on the source's
+// offsets document under "staging"
+type StagingStats struct {
+	Pending       int64     `bson:"pending"`
+	Done          int64     `bson:"done"`  // committed, recovered or archived, awaiting pruning
+	Bytes         int64     `bson:"bytes"` // whole collection, all sources
+	OldestPending time.Time `bson:"oldest_pending,omitempty"`
+	OldestDone    time.Time `bson:"oldest_done,omitempty"`
+	Pruned        int64     `bson:"pruned"` // removed by the last pass
+	UpdatedAt     time.Time `bson:"updatedAt"`
+}
+
+// stagingDone are the statuses of batches whose events are in the events
+// collection; pending batches are never pruned
+var stagingDone = bson.A{"committed", "recovered", "archived"}
+
+// pruneStaging deletes finished batches of source created before cutoff
+func (s *MongoSink) pruneStaging(ctx context.Context, source string, cutoff time.Time) (int64, error) {
+	res, err := s.staging.DeleteMany(ctx, bson.M{
+		"source":    source,
+		"status":    bson.M{"$in": stagingDone},
+		"createdAt": bson.M{"$lt": cutoff},
+	})
+	if err != nil {
+		return 0, err
+	}
+	return res.DeletedCount, nil
+}
+
+// stagingStats counts and ages the staging batches of source
+func (s *MongoSink) stagingStats(ctx context.Context, source string) (StagingStats, error) {
+	var st StagingStats
+	var err error
+	pending := bson.M{"source": source, "status": "pending"}
+	done := bson.M{"source": source, "status": bson.M{"$in": stagingDone}}
+
+	if st.Pending, err = s.staging.CountDocuments(ctx, pending); err != nil {
+		return st, err
+	}
+	if st.Done, err = s.staging.CountDocuments(ctx, done); err != nil {
+		return st, err
+	}
+	if st.OldestPending, err = s.oldestStaged(ctx, pending); err != nil {
+		return st, err
+	}
+	if st.OldestDone, err = s.oldestStaged(ctx, done); err != nil {
+		return st, err
+	}
+
+	cur, err := s.staging.Aggregate(ctx, mongo.Pipeline{{{Key: "$collStats", Value: bson.M{"storageStats": bson.M{}}}}})
+	if err != nil {
+		return st, err
+	}
+	defer cur.Close(ctx)
+	if cur.Next(ctx) {
+		var cs struct {
+			StorageStats struct {
+				Size int64 `bson:"size"`
+			} `bson:"storageStats"`
+		}
+		if err := cur.Decode(&cs); err != nil {
+			return st, err
+		}
+		st.Bytes = cs.StorageStats.Size
+	}
+	return st, cur.Err()
+}
+
+// oldestStaged returns createdAt of the oldest batch matching filter, or zero
+func (s *MongoSink) oldestStaged(ctx context.Context, filter bson.M) (time.Time, error) {
+	var doc struct {
+		CreatedAt time.Time `bson:"createdAt"`
+	}
+	err := s.staging.FindOne(ctx, filter,
+		options.FindOne().SetSort(bson.D{{Key: "createdAt", Value: 1}}).SetProjection(bson.M{"createdAt": 1}),
+	).Decode(&doc)
+	if err == mongo.ErrNoDocuments {
+		return time.Time{}, nil
+	}
+	return doc.CreatedAt, err
+}
+
+// RunStagingPruner removes finished staging batches older than the retention
+// and publishes StagingStats every interval. Blocks until ctx is done.
+func (s *MongoSink) RunStagingPruner(ctx context.Context, source string, p StagingPolicy) {
+	if p.Interval <= 0 {
+		return
+	}
+	t := time.NewTicker(p.Interval)
+	defer t.Stop()
+
+	for {
+		var pruned int64
+		if p.Retention > 0 {
+			n, err := s.pruneStaging(ctx, source, time.Now().UTC().Add(-p.Retention))
+			if err != nil {
+				log.Printf("Error pruning staging: %v", err)
+			}
+			pruned = n
+		}
+
+		st, err := s.stagingStats(ctx, source)
+		if err != nil {
+			log.Printf("Error reading staging stats: %v", err)
+		} else {
+			st.Pruned = pruned
+			st.UpdatedAt = time.Now().UTC()
+			if _, err := s.offsets.UpdateByID(ctx, source, bson.M{"$set": bson.M{"staging": st}}); err != nil {
+				log.Printf("Error saving staging stats: %v", err)
+			}
+
+			log.Printf("Staging: %d pending, %d finished, %d pruned, %d bytes", st.Pending, st.Done, st.Pruned, st.Bytes)
+			if !st.OldestPending.IsZero() && p.AlertAge > 0 && time.Since(st.OldestPending) > p.AlertAge {
+				log.Printf("WARNING: staging batch pending since %s; writes to %s may be failing",
+					st.OldestPending.Format(time.RFC3339), s.events.Name())
+			}
+			if p.AlertBytes > 0 && st.Bytes > p.AlertBytes {
+				log.Printf("WARNING: staging collection is %d bytes (limit %d); check STAGING_RETENTION", st.Bytes, p.AlertBytes)
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+	}
+}
+
+// SpoolConfig bounds the local spool; an empty Dir disables it
+type SpoolConfig struct {
+	Dir           string        `toml:"dir"`
+	MaxBytes      int64         `toml:"max_bytes"`     // Append fails once the spool would exceed this
+	SegmentBytes  int64         `toml:"segment_bytes"` // start a new segment file beyond this size
+	DrainInterval time.Duration `toml:"drain_interval"`
+	MaxAttempts   int           `toml:"max_attempts"` // dead-letter a batch MongoDB refuses this many times in a row
+}
+
+// applyEnv overrides c from SPOOL_DIR, SPOOL_MAX_BYTES, SPOOL_SEGMENT_BYTES,
+// SPOOL_DRAIN_INTERVAL and SPOOL_MAX_ATTEMPTS
+func (c *SpoolConfig) applyEnv() {
+	if v, ok := os.LookupEnv("SPOOL_DIR"); ok {
+		c.Dir = v // may be set empty to disable the spool
+	}
+	c.MaxBytes = int64(getenvInt("SPOOL_MAX_BYTES", int(c.MaxBytes)))
+	c.SegmentBytes = int64(getenvInt("SPOOL_SEGMENT_BYTES", int(c.SegmentBytes)))
+	c.DrainInterval = getenvDuration("SPOOL_DRAIN_INTERVAL", c.DrainInterval)
+	c.MaxAttempts = getenvInt("SPOOL_MAX_ATTEMPTS", c.MaxAttempts)
+}
+
+// spoolBatch is one batch as stored in the spool
+type spoolBatch struct {
+	Events    []EventDoc `bson:"events"`
+	Source    string     `bson:"source"`
+	GTID      string     `bson:"gtid"`
+	File      string     `bson:"file"`
+	Pos       uint32     `bson:"pos"`
+	SpooledAt time.Time  `bson:"spooledAt"`
+}
+
+// errSpoolFull stops capture rather than dropping batches; the binlog is the
+// buffer of last resort
+var errSpoolFull = errors.New("spool full")
+
+const spoolHeaderLen = 8 // uint32 payload length + uint32 CRC-32C of the payload
+
+var spoolCRC = crc32.MakeTable(crc32.Castagnoli)
+
+// spool is an append-only write-ahead queue of batches on local disk. Records
+// are [length][CRC-32C][BSON spoolBatch], appended and fsynced to numbered
+// segment files (000...1.seg); the cursor file holds how far draining got.
+// Fully drained segments are deleted.
+type spool struct {
+	mu       sync.Mutex
+	dir      string
+	maxBytes int64
+	segBytes int64
+
+	w    *os.File // segment being appended
+	wSeg uint64
+	wOff int64
+
+	rSeg uint64 // drain cursor
+	rOff int64
+
+	size     int64             // bytes in segment files
+	count    int               // records not yet drained
+	pending  map[string]int    // records not yet drained, per source
+	lastGTID map[string]string // GTID set of the newest spooled batch, per source
+	lastSeq  map[string]int64  // highest event sequence number spooled, per source
+	failures int               // failed writes of the oldest batch in a row
+}
+
+func segmentPath(dir string, seg uint64) string {
+	return filepath.Join(dir, fmt.Sprintf("%020d.seg", seg))
+}
+
+// openSpool opens or creates the spool in cfg.Dir, verifying every record
+// not yet drained. A torn record at the end of the newest segment (crash
+// during Append) is truncated; corruption anywhere else is an error.
+func openSpool(cfg SpoolConfig) (*spool, error) {
+	if err := os.MkdirAll(cfg.Dir, 0o750); err != nil {
+		return nil, err
+	}
+	sp := &spool{
+		dir:      cfg.Dir,
+		maxBytes: cfg.MaxBytes,
+		segBytes: cfg.SegmentBytes,
+		pending:  make(map[string]int),
+		lastGTID: make(map[string]string),
+		lastSeq:  make(map[string]int64),
+	}
+
+	names, err := filepath.Glob(filepath.Join(cfg.Dir, "*.seg"))
+	if err != nil {
+		return nil, err
+	}
+	var segs []uint64
+	for _, name := range names {
+		n, err := strconv.ParseUint(strings.TrimSuffix(filepath.Base(name), ".seg"), 10, 64)
+		if err == nil {
+			segs = append(segs, n)
+		}
+	}
+	sort.Slice(segs, func(i, j int) bool { return segs[i] < segs[j] })
+
+	if raw, err := os.ReadFile(filepath.Join(cfg.Dir, "cursor")); err == nil {
+		if _, err := fmt.Sscanf(string(raw), "%d %d", &sp.rSeg, &sp.rOff); err != nil {
+			return nil, fmt.Errorf("parse spool cursor: %w", err)
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	} else if len(segs) > 0 {
+		sp.rSeg = segs[0]
+	}
+
+	for i, seg := range segs {
+		path := segmentPath(cfg.Dir, seg)
+		if seg < sp.rSeg {
+			if err := os.Remove(path); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		start := int64(0)
+		if seg == sp.rSeg {
+			start = sp.rOff
+		}
+		end, err := sp.scanSegment(path, start)
+		if err != nil {
+			if i != len(segs)-1 {
+				return nil, fmt.Errorf("spool segment %s: %w", path, err)
+			}
+			log.Printf("Warning: truncating torn spool record in %s at offset %d: %v", path, end, err)
+			if err := os.Truncate(path, end); err != nil {
+				return nil, err
+			}
+		}
+		sp.size += end
+		sp.wSeg = seg
+	}
+
+	if sp.wSeg == 0 {
+		sp.wSeg = max(sp.rSeg, 1)
+		sp.rSeg = sp.wSeg
+	}
+	if sp.w, err = os.OpenFile(segmentPath(cfg.Dir, sp.wSeg), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o640); err != nil {
+		return nil, err
+	}
+	info, err := sp.w.Stat()
+	if err != nil {
+		return nil, err
+	}
+	sp.wOff = info.Size()
+	if sp.count > 0 {
+		log.Printf("Spool %s holds %d undrained batches (%d bytes)", cfg.Dir, sp.count, sp.size)
+	}
+	return sp, nil
+}
+
+// scanSegment checks the records of one segment from offset start, counting
+// them; it returns the end of the last valid record
+func (sp *spool) scanSegment(path string, start int64) (int64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	off := start
+	for {
+		b, n, err := readSpoolRecord(f, off)
+		if err == io.EOF {
+			return off, nil
+		}
+		if err != nil {
+			return off, err
+		}
+		sp.addLocked(b)
+		off += n
+	}
+}
+
+// readSpoolRecord decodes the record at off and returns it with its length
+// on disk; io.EOF means off is the clean end of the segment
+func readSpoolRecord(f *os.File, off int64) (spoolBatch, int64, error) {
+	var b spoolBatch
+	var hdr [spoolHeaderLen]byte
+	if _, err := f.ReadAt(hdr[:], off); err != nil {
+		if err == io.EOF {
+			if info, serr := f.Stat(); serr == nil && info.Size() == off {
+				return b, 0, io.EOF
+			}
+			return b, 0, io.ErrUnexpectedEOF
+		}
+		return b, 0, err
+	}
+	payload := make([]byte, binary.LittleEndian.Uint32(hdr[0:4]))
+	if _, err := f.ReadAt(payload, off+spoolHeaderLen); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return b, 0, err
+	}
+	if crc32.Checksum(payload, spoolCRC) != binary.LittleEndian.Uint32(hdr[4:8]) {
+		return b, 0, fmt.Errorf("checksum mismatch at offset %d", off)
+	}
+	if err := bson.Unmarshal(payload, &b); err != nil {
+		return b, 0, fmt.Errorf("decode record at offset %d: %w", off, err)
+	}
+	return b, spoolHeaderLen + int64(len(payload)), nil
+}
+
+// Append durably adds a batch to the end of the spool
+func (sp *spool) Append(b spoolBatch) error {
+	payload, err := bson.Marshal(b)
+	if err != nil {
+		return fmt.Errorf("encode spooled batch: %w", err)
+	}
+	rec := make([]byte, spoolHeaderLen+len(payload))
+	binary.LittleEndian.PutUint32(rec[0:4], uint32(len(payload)))
+	binary.LittleEndian.PutUint32(rec[4:8], crc32.Checksum(payload, spoolCRC))
+	copy(rec[spoolHeaderLen:], payload)
+
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+	if sp.maxBytes > 0 && sp.size+int64(len(rec)) > sp.maxBytes {
+		return fmt.Errorf("%w: %d bytes in %s (SPOOL_MAX_BYTES %d)", errSpoolFull, sp.size, sp.dir, sp.maxBytes)
+	}
+	if sp.wOff > 0 && sp.segBytes > 0 && sp.wOff+int64(len(rec)) > sp.segBytes {
+		if err := sp.rotateLocked(); err != nil {
+			return err
+		}
+	}
+	if _, err := sp.w.Write(rec); err != nil {
+		return fmt.Errorf("write spool: %w", err)
+	}
+	if err := sp.w.Sync(); err != nil {
+		return fmt.Errorf("sync spool: %w", err)
+	}
+	sp.wOff += int64(len(rec))
+	sp.size += int64(len(rec))
+	sp.addLocked(b)
+	return nil
+}
+
+// addLocked counts a newly spooled batch; caller must hold sp.mu
+func (sp *spool) addLocked(b spoolBatch) {
+	sp.count++
+	sp.pending[b.Source]++
+	if b.GTID != "" {
+		sp.lastGTID[b.Source] = b.GTID
+	}
+	sp.lastSeq[b.Source] = max(sp.lastSeq[b.Source], lastSeq(b.Events))
+}
+
+// rotateLocked starts a new segment file; caller must hold sp.mu
+func (sp *spool) rotateLocked() error {
+	if err := sp.w.Close(); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(segmentPath(sp.dir, sp.wSeg+1), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o640)
+	if err != nil {
+		return err
+	}
+	sp.w = f
+	sp.wSeg++
+	sp.wOff = 0
+	return nil
+}
+
+// Peek returns the oldest undrained batch and its length on disk
+func (sp *spool) Peek() (spoolBatch, int64, error) {
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+	for {
+		f, err := os.Open(segmentPath(sp.dir, sp.rSeg))
+		if err != nil {
+			return spoolBatch{}, 0, err
+		}
+		b, n, err := readSpoolRecord(f, sp.rOff)
+		f.Close()
+		if err != io.EOF {
+			return b, n, err
+		}
+		if sp.rSeg >= sp.wSeg {
+			return b, 0, fmt.Errorf("spool cursor at end with %d batches pending", sp.count)
+		}
+		// Segment fully drained: move on and reclaim it
+		if err := sp.moveCursorLocked(sp.rSeg+1, 0); err != nil {
+			return b, 0, err
+		}
+	}
+}
+
+// Advance marks the batch b returned by Peek, n bytes on disk, as drained
+func (sp *spool) Advance(b spoolBatch, n int64) error {
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+	if err := sp.moveCursorLocked(sp.rSeg, sp.rOff+n); err != nil {
+		return err
+	}
+	sp.count--
+	sp.failures = 0
+	if sp.pending[b.Source]--; sp.pending[b.Source] <= 0 {
+		delete(sp.pending, b.Source)
+		delete(sp.lastGTID, b.Source)
+		delete(sp.lastSeq, b.Source)
+	}
+	if sp.count == 0 {
+		// Empty: start a fresh segment so all space is reclaimed
+		if err := sp.rotateLocked(); err != nil {
+			return err
+		}
+		return sp.moveCursorLocked(sp.wSeg, 0)
+	}
+	return nil
+}
+
+// drain hands batches to write oldest first, advancing past each one written,
+// until the spool is empty or write fails. A batch write refuses maxAttempts
+// times in a row for a reason other than MongoDB being unreachable is passed
+// to giveUp and skipped.
+func (sp *spool) drain(ctx context.Context, maxAttempts int, write func(spoolBatch) error, giveUp func(spoolBatch, error) error) (int, error) {
+	drained := 0
+	for sp.Pending() > 0 && ctx.Err() == nil {
+		b, n, err := sp.Peek()
+		if err != nil {
+			return drained, fmt.Errorf("read spool: %w", err)
+		}
+		if err := write(b); err != nil {
+			if isMongoUnavailable(err) {
+				return drained, err
+			}
+			sp.mu.Lock()
+			sp.failures++
+			failures := sp.failures
+			sp.mu.Unlock()
+			if failures < maxAttempts {
+				return drained, fmt.Errorf("spooled batch (GTID %s), attempt %d of %d: %w", b.GTID, failures, maxAttempts, err)
+			}
+			if err := giveUp(b, err); err != nil {
+				return drained, fmt.Errorf("give up on spooled batch (GTID %s): %w", b.GTID, err)
+			}
+		}
+		if err := sp.Advance(b, n); err != nil {
+			return drained, fmt.Errorf("advance spool cursor: %w", err)
+		}
+		drained++
+	}
+	return drained, nil
+}
+
+// moveCursorLocked persists the drain cursor and deletes segments before it;
+// caller must hold sp.mu
+func (sp *spool) moveCursorLocked(seg uint64, off int64) error {
+	tmp := filepath.Join(sp.dir, "cursor.tmp")
+	if err := os.WriteFile(tmp, []byte(fmt.Sprintf("%d %d\n", seg, off)), 0o640); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, filepath.Join(sp.dir, "cursor")); err != nil {
+		return err
+	}
+	for old := sp.rSeg; old < seg; old++ {
+		path := segmentPath(sp.dir, old)
+		if info, err := os.Stat(path); err == nil {
+			sp.size -= info.Size()
+		}
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	sp.rSeg, sp.rOff = seg, off
+	return nil
+}
+
+// Pending returns the number of batches waiting to be drained
+func (sp *spool) Pending() int {
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+	return sp.count
+}
+
+// LastGTID returns the GTID set of the newest spooled batch of source, or ""
+// when none of its batches are waiting
+func (sp *spool) LastGTID(source string) string {
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+	return sp.lastGTID[source]
+}
+
+// LastSeq returns the highest sequence number among the spooled events of
+// source, or 0 when none of its batches are waiting
+func (sp *spool) LastSeq(source string) int64 {
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+	return sp.lastSeq[source]
+}
+
+// Close closes the segment being appended
+func (sp *spool) Close() error {
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+	return sp.w.Close()
+}
+
+// FlushPolicy bounds how long captured events may sit in memory before
+// they are written to MongoDB. A batch is flushed as soon as any limit is hit.
+type FlushPolicy struct {
+	MaxEvents int           `toml:"max_events"` // flush when the batch holds this many events
+	MaxBytes  int           `toml:"max_bytes"`  // flush when the encoded batch reaches this size
+	MaxAge    time.Duration `toml:"max_age"`    // flush when the oldest event has waited this long
+}
+
+// applyEnv overrides p from BATCH_MAX_EVENTS, BATCH_MAX_BYTES and BATCH_MAX_AGE
+func (p *FlushPolicy) applyEnv() {
+	p.MaxEvents = getenvInt("BATCH_MAX_EVENTS", p.MaxEvents)
+	p.MaxBytes = getenvInt("BATCH_MAX_BYTES", p.MaxBytes)
+	p.MaxAge = getenvDuration("BATCH_MAX_AGE", p.MaxAge)
+}
+
+type Handler struct {
+	canal.DummyEventHandler
+
+	sink   *MongoSink
+	source string
+	batch  []EventDoc
+
+	// mu guards the batch: OnRow runs on the Canal goroutine while the
+	// flush ticker runs on its own
+	mu         sync.Mutex
+	policy     FlushPolicy
+	batchBytes int       // approximate BSON size of the pending batch
+	batchStart time.Time // when the first pending event was added
+
+	lastFile string
+	lastPos  uint64
+	lastGTID string // GTID of the open transaction (server_uuid:gno or domain-server-seq)
+	seq      int64  // last sequence number given out, see commitTxLocked
+	loc      *time.Location
+
+	// Position tracking for current batch
+	batchFile string
+	batchPos  uint32
+	batchGTID string
+
+	// Open transaction: row events are buffered here until OnXID so that a
+	// batch (and the offset saved with it) never ends mid-transaction
+	tx          []EventDoc
+	txBytes     int
+	txID        string
+	txEvents    int                 // rows events seen so far, numbers them for makeID
+	txCommitted bool                // OnXID seen, waiting for OnPosSynced
+	txEndPos    mysql.Position      // position right after the XID event
+	txTouched   map[string]struct{} // rowKey of every row the transaction changed
+
+	// Table rules of the open transaction, picked up from the sink at each
+	// transaction boundary so a SIGHUP reload never splits a transaction
+	rules []TableRule
+
+	// Incremental snapshot chunk waiting for the stream to reach its high
+	// watermark (see runIncrementalSnapshot)
+	window *snapshotWindow
+
+	// Schema tracking for data integrity; guarded by mu like the batch, as
+	// snapshot chunks are converted on their own goroutine
+	tableSchemas   map[string][]string    // table -> column names
+	schemaVersions map[string]int         // table -> current schema_history version
+	identities     map[string]rowIdentity // table -> meta.pk source, set with schemaVersions
+	getTable       func(db, table string) (*schema.Table, error)
+	execute        func(cmd string, args ...any) (*mysql.Result, error)
+	pendingDDL     []SchemaChangeDoc // tables reported by OnTableChanged, completed in OnDDL
+}
+
+func (h *Handler) String() string { return "audit-handler" }
+
+// Flush writes any remaining events in batch to MongoDB atomically with GTID
+func (h *Handler) Flush(ctx context.Context) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if len(h.batch) == 0 {
+		return nil
+	}
+	log.Printf("Flushing %d remaining events", len(h.batch))
+	return h.flushLocked(ctx)
+}
+
+// flushLocked writes the pending batch; caller must hold h.mu
+func (h *Handler) flushLocked(ctx context.Context) error {
+	if len(h.batch) == 0 {
+		return nil
+	}
+	if err := h.sink.writeBatchWithGTID(ctx, h.batch, h.source, h.batchGTID, h.batchFile, h.batchPos); err != nil {
+		return fmt.Errorf("flush batch: %w", err)
+	}
+	h.batch = h.batch[:0]
+	h.batchBytes = 0
+	h.batchStart = time.Time{}
+	return nil
+}
+
+// shouldFlushLocked reports whether the pending batch has hit a size limit
+func (h *Handler) shouldFlushLocked() bool {
+	if h.policy.MaxEvents > 0 && len(h.batch) >= h.policy.MaxEvents {
+		return true
+	}
+	if h.policy.MaxBytes > 0 && h.batchBytes >= h.policy.MaxBytes {
+		return true
+	}
+	return false
+}
+
+// RunFlushTicker flushes batches older than policy.MaxAge so that quiet
+// sources still reach MongoDB within a bounded latency. Blocks until ctx is done.
+func (h *Handler) RunFlushTicker(ctx context.Context) {
+	if h.policy.MaxAge <= 0 {
+		return
+	}
+	interval := h.policy.MaxAge / 2
+	if interval < 100*time.Millisecond {
+		interval = 100 * time.Millisecond
+	}
+	t := time.NewTicker(interval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			h.mu.Lock()
+			if len(h.batch) > 0 && time.Since(h.batchStart) >= h.policy.MaxAge {
+				if err := h.flushLocked(ctx); err != nil {
+					log.Printf("Error flushing aged batch: %v", err)
+				}
+			}
+			h.mu.Unlock()
+		}
+	}
+}
+
+// snapshotAction marks rows read by a snapshot rather than from the binlog
+const snapshotAction = "snapshot"
+
+func shortOP(action string) string {
+	switch action {
+	case canal.InsertAction:
+		return "i"
+	case snapshotAction:
+		return "r"
+	case canal.DeleteAction:
+		return "d"
+	default:
+		return "u"
+	}
+}
+
+// makeID derives an event's _id from where the row sits in the binlog: the
+// transaction (its GTID, else the txID), the rows event within it and the
+// row within that event. A replay of the transaction yields the same IDs;
+// no two rows share one, whatever their key or timestamp.
+func makeID(source, tx string, event, row int) string {
+	s := fmt.Sprintf("%q|%q|%d|%d", source, tx, event, row)
+	sum := sha1.Sum([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
+
+// keyPart keeps key values as decoded, so event IDs do not depend on the
+// type mapping, except BIGINT UNSIGNED values BSON cannot hold as integers
+func keyPart(v any) any {
+	if n, ok := v.(uint64); ok {
+		return encodeUint(n)
+	}
+	return v
+}
+
+// rowPK returns the primary key value of a row read by SELECT, which holds
+// every column (see keyValue)
+func rowPK(t *schema.Table, row []any) any {
+	pk, _ := keyValue(t, t.PKColumns, row)
+	return pk
+}
+
+// keyValue returns the value of the key columns cols of row: the value
+// itself for a single column, else a document of column name to value in
+// key order. A key column missing from row, or not logged in its image, is
+// an error rather than a key built from the other columns.
+func keyValue(t *schema.Table, cols []int, row []any) (any, error) {
+	if len(cols) == 0 {
+		return nil, errors.New("no key columns")
+	}
+	key := make(bson.D, 0, len(cols))
+	for _, idx := range cols {
+		if idx >= len(row) || idx >= len(t.Columns) {
+			return nil, fmt.Errorf("key column %d not in row of %d columns", idx, len(row))
+		}
+		if isAbsent(row[idx]) {
+			return nil, fmt.Errorf("key column %s not logged", t.Columns[idx].Name)
+		}
+		key = append(key, bson.E{Key: t.Columns[idx].Name, Value: keyPart(row[idx])})
+	}
+	if len(key) == 1 {
+		return key[0].Value, nil
+	}
+	return key, nil
+}
+
+// pkEscaper escapes the separator of composite keys in pkString
+var pkEscaper = strings.NewReplacer(`\`, `\\`, `|`, `\|`)
+
+// pkString renders a key canonically: a scalar as text, a composite key as
+// its values joined with "|", with "\" and "|" inside values escaped. For
+// keys without those characters this is the format events used before
+// composite keys became documents.
+func pkString(pk any) string {
+	d, ok := pk.(bson.D)
+	if !ok {
+		return toS(pk)
+	}
+	parts := make([]string, len(d))
+	for i, e := range d {
+		parts[i] = pkEscaper.Replace(toS(e.Value))
+	}
+	return strings.Join(parts, "|")
+}
+
+// rowIdentity is how rows of a table are identified in meta.pk: by the
+// primary key, else by the first unique key on NOT NULL columns (the one
+// InnoDB would promote to clustered index), else by a hash of the whole row
+type rowIdentity struct {
+	kind  string // "pk", "uk" or "hash"
+	index string // unique key name for "uk"
+	cols  []int  // key columns for "pk" and "uk"
+	table *schema.Table
+}
+
+// tableIdentity picks the identity of t; nullable comes from
+// information_schema, and columns missing from it count as nullable
+func tableIdentity(t *schema.Table, nullable map[string]bool) rowIdentity {
+	if len(t.PKColumns) > 0 {
+		return rowIdentity{kind: "pk", cols: t.PKColumns, table: t}
+	}
+	for _, idx := range t.Indexes {
+		if idx.NoneUnique != 0 || len(idx.Columns) == 0 {
+			continue
+		}
+		cols := make([]int, 0, len(idx.Columns))
+		for _, name := range idx.Columns {
+			isNull, known := nullable[name]
+			ci := t.FindColumn(name)
+			if !known || isNull || ci < 0 {
+				break
+			}
+			cols = append(cols, ci)
+		}
+		if len(cols) == len(idx.Columns) {
+			return rowIdentity{kind: "uk", index: idx.Name, cols: cols, table: t}
+		}
+	}
+	return rowIdentity{kind: "hash"}
+}
+
+// key returns the identity value of row and the identity that produced it:
+// a row lacking a key column is identified by its full-row hash instead
+func (id rowIdentity) key(row []any) (any, rowIdentity) {
+	if id.kind != "hash" {
+		if k, err := keyValue(id.table, id.cols, row); err == nil {
+			return k, id
+		}
+	}
+	return rowHash(row), rowIdentity{kind: "hash"}
+}
+
+// rowHash is the full-row identity; identical rows share a hash and nothing
+// else tells them apart
+func rowHash(row []any) string {
+	h := sha1.New()
+	for _, v := range row {
+		var b []byte
+		switch x := v.(type) {
+		case nil:
+			h.Write([]byte{0})
+			continue
+		case []byte:
+			b = x
+		default:
+			b = []byte(toS(x))
+		}
+		fmt.Fprintf(h, "%d:", len(b))
+		h.Write(b)
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// flag is the Meta.Key of events identified this way
+func (id rowIdentity) flag() string {
+	switch id.kind {
+	case "uk":
+		return "uk:" + id.index
+	case "hash":
+		return "hash"
+	}
+	return ""
+}
+
+func (id rowIdentity) String() string {
+	return map[string]string{"pk": "primary key", "uk": "unique key " + id.index, "hash": "full-row hash"}[id.kind]
+}
+
+// encodeRow maps the values of a binlog or snapshot row to their BSON
+// representation by column type; columns beyond the table metadata (and
+// nils) pass through unchanged
+func encodeRow(t *schema.Table, row []any) []any {
+	out := make([]any, len(row))
+	for i, v := range row {
+		if i < len(t.Columns) && !isAbsent(v) {
+			v = encodeValue(&t.Columns[i], v)
+		}
+		out[i] = v
+	}
+	return out
+}
+
+// encodeValue stores v the way MySQL means it rather than the way the
+// decoder hands it over. Binlog and snapshot rows differ in Go type (ENUM
+// arrives as an index from the binlog and as its name from SELECT), so
+// every branch accepts both.
+func encodeValue(col *schema.TableColumn, v any) any {
+	if v == nil {
+		return nil
+	}
+	switch col.Type {
+	case schema.TYPE_DECIMAL:
+		if d, err := primitive.ParseDecimal128(asString(v)); err == nil {
+			return d
+		}
+		return asString(v) // more than 34 significant digits
+	case schema.TYPE_ENUM:
+		if i, ok := asInt(v); ok {
+			if i < 1 || int(i) > len(col.EnumValues) {
+				return "" // the error value of an invalid insert in non-strict mode
+			}
+			return col.EnumValues[i-1]
+		}
+		return asString(v)
+	case schema.TYPE_SET:
+		names := []string{}
+		if bits, ok := asInt(v); ok {
+			for i, name := range col.SetValues {
+				if i < 64 && bits&(1<<i) != 0 {
+					names = append(names, name)
+				}
+			}
+		} else if s := asString(v); s != "" {
+			names = strings.Split(s, ",")
+		}
+		return names
+	case schema.TYPE_BIT:
+		var n uint64
+		switch x := v.(type) {
+		case []byte:
+			for _, b := range x {
+				n = n<<8 | uint64(b)
+			}
+		case string:
+			for _, b := range []byte(x) {
+				n = n<<8 | uint64(b)
+			}
+		default:
+			i, _ := asInt(v)
+			n = uint64(i)
+		}
+		if strings.HasPrefix(strings.ToLower(col.RawType), "bit(1)") {
+			return n != 0
+		}
+		return encodeUint(n)
+	case schema.TYPE_JSON:
+		var b []byte
+		switch x := v.(type) {
+		case []byte:
+			b = x
+		case string:
+			b = []byte(x)
+		default:
+			return v
+		}
+		if len(b) == 0 {
+			return nil // empty document, MySQL reads it as JSON null
+		}
+		doc, err := decodeJSON(b)
+		if err != nil {
+			return string(b)
+		}
+		return doc
+	case schema.TYPE_NUMBER, schema.TYPE_MEDIUM_INT:
+		if col.IsUnsigned {
+			return encodeUnsigned(v)
+		}
+		if i, ok := asInt(v); ok {
+			return i
+		}
+		return v
+	case schema.TYPE_BINARY:
+		if s, ok := v.(string); ok {
+			return []byte(s)
+		}
+		return v
+	case schema.TYPE_STRING:
+		cs, _, _ := strings.Cut(strings.ToLower(col.Collation), "_")
+		if cs == "" || cs == "binary" {
+			return v // BLOB types and binary strings keep their bytes
+		}
+		var b []byte
+		switch x := v.(type) {
+		case []byte:
+			b = x
+		case string:
+			b = []byte(x)
+		default:
+			return v
+		}
+		return decodeCharset(cs, b)
+	}
+	return v
+}
+
+// encodeUnsigned reads v as an unsigned integer; a signed value is the
+// same bits of a decoder that missed the UNSIGNED flag
+func encodeUnsigned(v any) any {
+	switch x := v.(type) {
+	case uint8:
+		return int64(x)
+	case uint16:
+		return int64(x)
+	case uint32:
+		return int64(x)
+	case uint64:
+		return encodeUint(x)
+	case uint:
+		return encodeUint(uint64(x))
+	case int8:
+		return int64(uint8(x))
+	case int16:
+		return int64(uint16(x))
+	case int32:
+		return int64(uint32(x))
+	case int64:
+		return encodeUint(uint64(x))
+	case int:
+		return encodeUint(uint64(x))
+	}
+	return v
+}
+
+// encodeUint stores n as int64, or as Decimal128 above the int64 range
+// (BIGINT UNSIGNED, BIT(64)), which BSON has no integer type for
+func encodeUint(n uint64) any {
+	if n <= math.MaxInt64 {
+		return int64(n)
+	}
+	d, _ := primitive.ParseDecimal128(strconv.FormatUint(n, 10))
+	return d
+}
+
+func asInt(v any) (int64, bool) {
+	switch x := v.(type) {
+	case int8:
+		return int64(x), true
+	case int16:
+		return int64(x), true
+	case int32:
+		return int64(x), true
+	case int64:
+		return x, true
+	case int:
+		return int64(x), true
+	case uint8:
+		return int64(x), true
+	case uint16:
+		return int64(x), true
+	case uint32:
+		return int64(x), true
+	case uint64:
+		return int64(x), true
+	}
+	return 0, false
+}
+
+func asString(v any) string {
+	if b, ok := v.([]byte); ok {
+		return string(b)
+	}
+	return toS(v)
+}
+
+// mysqlCharsets maps MySQL character sets to their decoders; UTF-8 and
+// ASCII need none. MySQL's latin1 is cp1252.
+var mysqlCharsets = map[string]encoding.Encoding{
+	"latin1":   charmap.Windows1252,
+	"latin2":   charmap.ISO8859_2,
+	"latin5":   charmap.ISO8859_9,
+	"latin7":   charmap.ISO8859_13,
+	"cp1250":   charmap.Windows1250,
+	"cp1251":   charmap.Windows1251,
+	"cp1256":   charmap.Windows1256,
+	"cp1257":   charmap.Windows1257,
+	"cp850":    charmap.CodePage850,
+	"cp852":    charmap.CodePage852,
+	"cp866":    charmap.CodePage866,
+	"greek":    charmap.ISO8859_7,
+	"hebrew":   charmap.ISO8859_8,
+	"koi8r":    charmap.KOI8R,
+	"koi8u":    charmap.KOI8U,
+	"macroman": charmap.Macintosh,
+	"gbk":      simplifiedchinese.GBK,
+	"gb2312":   simplifiedchinese.GBK,
+	"gb18030":  simplifiedchinese.GB18030,
+	"big5":     traditionalchinese.Big5,
+	"sjis":     japanese.ShiftJIS,
+	"cp932":    japanese.ShiftJIS,
+	"ujis":     japanese.EUCJP,
+	"eucjpms":  japanese.EUCJP,
+	"euckr":    korean.EUCKR,
+	"ucs2":     unicode.UTF16(unicode.BigEndian, unicode.IgnoreBOM),
+	"utf16":    unicode.UTF16(unicode.BigEndian, unicode.IgnoreBOM),
+	"utf16le":  unicode.UTF16(unicode.LittleEndian, unicode.IgnoreBOM),
+}
+
+// decodeCharset converts a string column's bytes to UTF-8. Bytes that are
+// not valid in the declared charset (or a charset without a decoder) are
+// kept as binary rather than stored as a corrupt string.
+func decodeCharset(cs string, b []byte) any {
+	if enc, ok := mysqlCharsets[cs]; ok {
+		if s, err := enc.NewDecoder().Bytes(b); err == nil {
+			return string(s)
+		}
+	} else if utf8.Valid(b) {
+		return string(b)
+	}
+	return append([]byte(nil), b...)
+}
+
+// decodeJSON parses a JSON column into BSON, keeping object key order
+// (bson.D) and integers as int64 where they fit
+func decodeJSON(b []byte) (any, error) {
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.UseNumber()
+	v, err := decodeJSONValue(dec)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		return nil, fmt.Errorf("trailing data after JSON value")
+	}
+	return v, nil
+}
+
+func decodeJSONValue(dec *json.Decoder) (any, error) {
+	tok, err := dec.Token()
+	if err != nil {
+		return nil, err
+	}
+	switch x := tok.(type) {
+	case json.Delim:
+		if x == '[' {
+			arr := bson.A{}
+			for dec.More() {
+				v, err := decodeJSONValue(dec)
+				if err != nil {
+					return nil, err
+				}
+				arr = append(arr, v)
+			}
+			_, err := dec.Token() // ]
+			return arr, err
+		}
+		doc := bson.D{}
+		for dec.More() {
+			k, err := dec.Token()
+			if err != nil {
+				return nil, err
+			}
+			v, err := decodeJSONValue(dec)
+			if err != nil {
+				return nil, err
+			}
+			doc = append(doc, bson.E{Key: k.(string), Value: v})
+		}
+		_, err := dec.Token() // }
+		return doc, err
+	case json.Number:
+		if i, err := x.Int64(); err == nil {
+			return i, nil
+		}
+		return x.Float64()
+	}
+	return tok, nil // string, bool or nil
+}
+
+// jsonDelta turns the change of a JSON column into path deltas by
+// comparing the two whole documents structurally. Scalars and a missing old
+// value keep the whole-value delta d.
+func jsonDelta(d Delta) Delta {
+	if !isJSONContainer(d.F) || !isJSONContainer(d.T) {
+		return d
+	}
+	if paths := diffJSON("$", d.F, d.T, nil); len(paths) > 0 {
+		return Delta{P: paths}
+	}
+	return d
+}
+
+func isJSONContainer(v any) bool {
+	switch v.(type) {
+	case bson.D, bson.A:
+		return true
+	}
+	return false
+}
+
+// diffJSON appends the paths that differ between a and b, in MySQL JSON
+// path syntax: members in the order of a, then those only b has, and
+// array elements by index
+func diffJSON(path string, a, b any, out []PathDelta) []PathDelta {
+	switch x := a.(type) {
+	case bson.D:
+		if y, ok := b.(bson.D); ok {
+			seen := make(map[string]bool, len(x))
+			for _, e := range x {
+				seen[e.Key] = true
+				p := path + jsonPathKey(e.Key)
+				if v, ok := docValue(y, e.Key); ok {
+					out = diffJSON(p, e.Value, v, out)
+				} else {
+					out = append(out, PathDelta{Path: p, Op: "r", F: e.Value})
+				}
+			}
+			for _, e := range y {
+				if !seen[e.Key] {
+					out = append(out, PathDelta{Path: path + jsonPathKey(e.Key), Op: "a", T: e.Value})
+				}
+			}
+			return out
+		}
+	case bson.A:
+		if y, ok := b.(bson.A); ok {
+			for i := 0; i < len(x) || i < len(y); i++ {
+				p := path + "[" + strconv.Itoa(i) + "]"
+				switch {
+				case i >= len(y):
+					out = append(out, PathDelta{Path: p, Op: "r", F: x[i]})
+				case i >= len(x):
+					out = append(out, PathDelta{Path: p, Op: "a", T: y[i]})
+				default:
+					out = diffJSON(p, x[i], y[i], out)
+				}
+			}
+			return out
+		}
+	}
+	if !reflect.DeepEqual(a, b) {
+		out = append(out, PathDelta{Path: path, Op: "c", F: a, T: b})
+	}
+	return out
+}
+
+func docValue(d bson.D, key string) (any, bool) {
+	for _, e := range d {
+		if e.Key == key {
+			return e.Value, true
+		}
+	}
+	return nil, false
+}
+
+var jsonIdent = regexp.MustCompile(`^[A-Za-z_$][A-Za-z0-9_$]*$`)
+
+// jsonPathKey is the path leg of an object member, quoted unless it is an
+// identifier
+func jsonPathKey(key string) string {
+	if jsonIdent.MatchString(key) {
+		return "." + key
+	}
+	b, _ := json.Marshal(key)
+	return "." + string(b)
+}
+
+// absentColumn stands for a column missing from a row image
+// (binlog_row_image MINIMAL or NOBLOB), which the binlog decoder otherwise
+// leaves nil, the same as NULL
+type absentColumn struct{}
+
+// markAbsentColumns makes c's binlog parser put absentColumn{} in the row
+// slots its rows events' column bitmaps leave out. Canal hands rows to
+// OnRow without the bitmaps, so the decode function it installs on the
+// parser is wrapped; neither field is exported, hence the reflection, which
+// only holds for the go-mysql pinned in go.mod (see checkRowImage for what
+// happens when it fails). Must be called before c runs.
+func markAbsentColumns(c *canal.Canal) error {
+	syncer, err := unexportedField[*replication.BinlogSyncer](reflect.ValueOf(c).Elem(), "syncer")
+	if err != nil {
+		return err
+	} else if syncer == nil {
+		return errors.New("canal has no binlog syncer")
+	}
+	parser, err := unexportedField[*replication.BinlogParser](reflect.ValueOf(syncer).Elem(), "parser")
+	if err != nil {
+		return err
+	} else if parser == nil {
+		return errors.New("binlog syncer has no parser")
+	}
+	decode, err := unexportedField[func(*replication.RowsEvent, []byte) error](reflect.ValueOf(parser).Elem(), "rowsEventDecodeFunc")
+	if err != nil {
+		return err
+	}
+	if decode == nil {
+		decode = (*replication.RowsEvent).Decode
+	}
+	parser.SetRowsEventDecodeFunc(func(e *replication.RowsEvent, data []byte) error {
+		if err := decode(e, data); err != nil {
+			return err
+		}
+		for i, skipped := range e.SkippedColumns {
+			for _, col := range skipped {
+				e.Rows[i][col] = absentColumn{}
+			}
+		}
+		return nil
+	})
+	return nil
+}
+
+// errRowImage means row images may lack columns that the logger cannot
+// tell from NULL; retrying does not help, so capture stops for good
+var errRowImage = errors.New("row image bitmaps unavailable")
+
+// checkRowImage says whether capture can go on after markAbsentColumns
+// failed with hookErr: only if the server logs full row images (image is
+// "" on servers too old to have binlog_row_image), as otherwise every
+// column left out of an image would be recorded as NULL
+func checkRowImage(image string, hookErr error) error {
+	if hookErr == nil || image == "" || strings.EqualFold(image, "FULL") {
+		return nil
+	}
+	return fmt.Errorf("%w with binlog_row_image=%s: %v (set binlog_row_image=FULL or build with go-mysql %s)",
+		errRowImage, image, hookErr, goMySQLVersion)
+}
+
+// goMySQLVersion is the go-mysql release markAbsentColumns is written
+// against, as pinned in go.mod
+const goMySQLVersion = "v1.13.0"
+
+// binlogRowImage returns the server's global binlog_row_image, "" if it has
+// none
+func binlogRowImage(c *canal.Canal) (string, error) {
+	res, err := c.Execute(`SHOW GLOBAL VARIABLES LIKE 'binlog_row_image'`)
+	if err != nil {
+		return "", fmt.Errorf("read binlog_row_image: %w", err)
+	}
+	if res.RowNumber() == 0 {
+		return "", nil
+	}
+	return res.GetString(0, 1)
+}
+
+func unexportedField[T any](v reflect.Value, name string) (T, error) {
+	var zero T
+	f := v.FieldByName(name)
+	if !f.IsValid() || f.Type() != reflect.TypeFor[T]() {
+		return zero, fmt.Errorf("%s has no field %s of type %s", v.Type(), name, reflect.TypeFor[T]())
+	}
+	return reflect.NewAt(f.Type(), unsafe.Pointer(f.UnsafeAddr())).Elem().Interface().(T), nil
+}
+
+func isAbsent(v any) bool {
+	_, ok := v.(absentColumn)
+	return ok
+}
+
+// rowImage names the binlog_row_image a rows event was logged with, as far
+// as its rows tell: "" for full images, "noblob" if only BLOB, TEXT and
+// JSON columns are missing, "minimal" otherwise
+func rowImage(t *schema.Table, rows [][]any) string {
+	image := ""
+	for _, row := range rows {
+		for i, v := range row {
+			if !isAbsent(v) {
+				continue
+			}
+			if i >= len(t.Columns) || !isBlobColumn(&t.Columns[i]) {
+				return "minimal"
+			}
+			image = "noblob"
+		}
+	}
+	return image
+}
+
+func isBlobColumn(col *schema.TableColumn) bool {
+	raw := strings.ToLower(col.RawType)
+	return col.Type == schema.TYPE_JSON || strings.Contains(raw, "blob") || strings.Contains(raw, "text")
+}
+
+// mergeImage completes an update's after image with the before image's
+// values of the columns it leaves out (unchanged under MINIMAL and NOBLOB),
+// so the row's key can be taken from it
+func mergeImage(before, after []any) []any {
+	merged := append([]any(nil), after...)
+	for i, v := range merged {
+		if isAbsent(v) && i < len(before) {
+			merged[i] = before[i]
+		}
+	}
+	return merged
+}
+
+// rowKey identifies a row across binlog and SELECT results, whose values
+// may differ in Go type (int32 vs int64) but not in text form
+func rowKey(db, tbl string, pk any) string {
+	return db + "." + tbl + "|" + pkString(pk)
+}
+
+func (h *Handler) OnRow(e *canal.RowsEvent) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.onRowLocked(e)
+}
+
+// onRowLocked converts a rows event into events of the open transaction;
+// caller must hold h.mu
+func (h *Handler) onRowLocked(e *canal.RowsEvent) error {
+	ts := time.Unix(int64(e.Header.Timestamp), 0).UTC()
+	db, tbl := e.Table.Schema, e.Table.Name
+
+	// Build column names only for columns that are in the binlog row data
+	// (excludes virtual/generated columns)
+	colNames := make([]string, 0, len(e.Table.Columns))
+	for _, c := range e.Table.Columns {
+		// Only add column names up to the actual row data length
+		// We'll validate against actual row length in the loop
+		colNames = append(colNames, c.Name)
+	}
+	h.tableSchemas[db+"."+tbl] = colNames
+
+	schemaVer, ok := h.schemaVersions[db+"."+tbl]
+	if !ok {
+		v, err := h.registerSchema(e.Table)
+		if err != nil {
+			return fmt.Errorf("register schema %s.%s: %w", db, tbl, err)
+		}
+		schemaVer = v
+	}
+	id := h.identities[db+"."+tbl]
+
+	cf := columnFilterFor(h.rules, db, tbl)
+
+	// Keys come from the rows as decoded; change values go through the type
+	// mapping
+	encoded := make([][]any, len(e.Rows))
+	for i, row := range e.Rows {
+		encoded[i] = encodeRow(e.Table, row)
+	}
+
+	// Partial images leave columns out; an update's key comes from its
+	// after image completed with the before image
+	image := rowImage(e.Table, e.Rows)
+	rows := e.Rows
+	if image != "" && e.Action == canal.UpdateAction {
+		rows = make([][]any, len(e.Rows))
+		for i := 0; i < len(e.Rows); i += 2 {
+			rows[i], rows[i+1] = e.Rows[i], mergeImage(e.Rows[i], e.Rows[i+1])
+		}
+	}
+
+	// Remember which rows the transaction touches (both images of an
+	// update) so an incremental snapshot chunk can drop them
+	for _, row := range rows {
+		k, _ := id.key(row)
+		h.txTouched[rowKey(db, tbl, k)] = struct{}{}
+	}
+
+	event := h.txEvents
+	h.txEvents++
+
+	occurrences := map[string]int{} // snapshot rows per hash key, see below
+
+	// keyID is the identity pk was taken with (see rowIdentity.key)
+	addDoc := func(row int, pk any, keyID rowIdentity, prevPK any, chg map[string]Delta, op string) error {
+		maskChanges(h.rules, db, tbl, chg)
+		if h.txID == "" {
+			// No GTID event seen (e.g. gtid_mode=OFF): key the transaction by
+			// the position of its first rows event
+			h.txID = fmt.Sprintf("%s:%d", h.lastFile, e.Header.LogPos-e.Header.EventSize)
+		}
+		tx := h.lastGTID
+		if tx == "" {
+			tx = h.txID
+		}
+		if e.Action == snapshotAction {
+			// A chunk read again after a crash can hold other rows (or drop
+			// some to the stream), so snapshot rows are told apart by key;
+			// identical rows of a keyless table share their hash and are
+			// told apart by how many came before them in the chunk
+			k := pkString(pk)
+			tx, row = tx+"|"+k, 0
+			if keyID.kind == "hash" {
+				row = occurrences[k]
+				occurrences[k]++
+			}
+		}
+		doc := EventDoc{
+			ID:     makeID(h.source, tx, event, row),
+			Source: h.source,
+			TS:     ts,
+			OP:     op,
+			Meta:   Meta{DB: db, Tbl: tbl, PK: pk, Key: keyID.flag()},
+			Img:    image,
+			Chg:    chg,
+			Src:    map[string]any{"binlog": map[string]any{"file": h.lastFile, "pos": h.lastPos}, "gtid": h.lastGTID},
+			TSIST:  ts.In(h.loc).Format("2006-01-02 15:04:05"),
+
+			SchemaVer: schemaVer,
+		}
+		if _, ok := pk.(bson.D); ok {
+			doc.Meta.PKStr = pkString(pk)
+		}
+		if prevPK != nil {
+			doc.Meta.PrevPK = prevPK
+			if _, ok := prevPK.(bson.D); ok {
+				doc.Meta.PrevStr = pkString(prevPK)
+			}
+		}
+		if e.Action == snapshotAction {
+			doc.Src["snapshot"] = true
+		}
+		doc.TxID = h.txID
+		doc.TxSeq = len(h.tx)
+		h.tx = append(h.tx, doc)
+		if raw, err := bson.Marshal(doc); err == nil {
+			h.txBytes += len(raw)
+		}
+		return nil
+	}
+
+	switch e.Action {
+	case canal.InsertAction, snapshotAction:
+		for r, row := range e.Rows {
+			chg := map[string]Delta{}
+			maxIdx := len(colNames)
+			if len(row) < maxIdx {
+				maxIdx = len(row)
+			}
+			for i := 0; i < maxIdx; i++ {
+				if cf.audited(colNames[i]) && !isAbsent(row[i]) {
+					chg[colNames[i]] = Delta{F: nil, T: encoded[r][i]}
+				}
+			}
+			pk, keyID := id.key(row)
+			if err := addDoc(r, pk, keyID, nil, chg, shortOP(e.Action)); err != nil {
+				return fmt.Errorf("insert action: %w", err)
+			}
+		}
+	case canal.DeleteAction:
+		for r, row := range e.Rows {
+			chg := map[string]Delta{}
+			maxIdx := len(colNames)
+			if len(row) < maxIdx {
+				maxIdx = len(row)
+			}
+			for i := 0; i < maxIdx; i++ {
+				if cf.audited(colNames[i]) && !isAbsent(row[i]) {
+					chg[colNames[i]] = Delta{F: encoded[r][i], T: nil}
+				}
+			}
+			pk, keyID := id.key(row)
+			if err := addDoc(r, pk, keyID, nil, chg, "d"); err != nil {
+				return fmt.Errorf("delete action: %w", err)
+			}
+		}
+	case canal.UpdateAction:
+		for i := 0; i < len(e.Rows); i += 2 {
+			before, after := e.Rows[i], e.Rows[i+1]
+			encBefore, encAfter := encoded[i], encoded[i+1]
+			chg := map[string]Delta{}
+			maxIdx := len(colNames)
+			if len(before) < maxIdx {
+				maxIdx = len(before)
+			}
+			if len(after) < maxIdx {
+				maxIdx = len(after)
+			}
+			ignored := false
+			for c := 0; c < maxIdx; c++ {
+				if isAbsent(after[c]) {
+					continue // not assigned by the update
+				}
+				if !reflect.DeepEqual(before[c], after[c]) {
+					if !cf.audited(colNames[c]) {
+						ignored = true
+						continue
+					}
+					d := Delta{F: encBefore[c], T: encAfter[c]}
+					if isAbsent(before[c]) {
+						d.F = nil // old value not logged
+					}
+					if e.Table.Columns[c].Type == schema.TYPE_JSON {
+						d = jsonDelta(d)
+					}
+					chg[colNames[c]] = d
+				}
+			}
+			// An update of key columns links the row's history under the old
+			// key to the new one, so it is never dropped as ignored; a key
+			// and a fallback hash of the same row are not linked
+			pk, keyID := id.key(rows[i+1])
+			prevPK, prevID := id.key(before)
+			if prevID.kind != keyID.kind || pkString(pk) == pkString(prevPK) {
+				prevPK = nil
+			}
+			op := "u"
+			if len(chg) == 0 && ignored && prevPK == nil {
+				// Only ignored columns changed
+				if !cf.touch {
+					continue
+				}
+				op = "t"
+			}
+			if err := addDoc(i/2, pk, keyID, prevPK, chg, op); err != nil {
+				return fmt.Errorf("update action: %w", err)
+			}
+		}
+	}
+	return nil
+}
+
+func (h *Handler) OnPosSynced(
+	header *replication.EventHeader,
+	pos mysql.Position,
+	set mysql.GTIDSet,
+	force bool,
+) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.lastFile = pos.Name
+	h.lastPos = uint64(pos.Pos)
+
+	// Non-transactional engines (MyISAM, MEMORY) end a transaction with a
+	// COMMIT query instead of an XID event
+	if !h.txCommitted && len(h.tx) > 0 && header.EventType == replication.QUERY_EVENT {
+		h.txCommitted = true
+		h.txEndPos = pos
+	}
+
+	// The executed GTID set only goes to the offsets document (via batchGTID);
+	// events keep the GTID of their own transaction.
+	// Canal calls OnPosSynced right after OnXID with the executed set that
+	// now includes the transaction, so this is where it joins the batch.
+	if h.txCommitted {
+		if w := h.window; w != nil && !w.ready {
+			// Chunk still being read: remember what the stream changes
+			prefix := w.table.Schema + "." + w.table.Name + "|"
+			for k := range h.txTouched {
+				if strings.HasPrefix(k, prefix) {
+					w.touched[k] = h.txEndPos
+				}
+			}
+		} else if w != nil {
+			if h.txEndPos.Compare(w.high) > 0 {
+				// Committed after the chunk was read: the chunk goes first
+				if err := h.emitWindowLocked(); err != nil {
+					return err
+				}
+			} else if h.txEndPos.Compare(w.low) > 0 {
+				// Committed while the chunk was read: the streamed change wins
+				for k := range h.txTouched {
+					if _, ok := w.rows[k]; ok {
+						delete(w.rows, k)
+						w.dropped++
+					}
+				}
+			}
+		}
+		h.commitTxLocked(set)
+		if h.shouldFlushLocked() {
+			if err := h.flushLocked(context.Background()); err != nil {
+				return fmt.Errorf("write batch with GTID: %w", err)
+			}
+		}
+	}
+	if h.window != nil && h.window.ready && pos.Compare(h.window.high) >= 0 {
+		if err := h.emitWindowLocked(); err != nil {
+			return err
+		}
+	}
+	// Note: GTID is now saved atomically with batch write in writeBatchWithGTID
+	return nil
+}
+
+// commitTxLocked moves the committed transaction into the batch and points
+// the batch offset just past it; caller must hold h.mu
+func (h *Handler) commitTxLocked(set mysql.GTIDSet) {
+	// Sequence numbers follow batch order; events of a transaction that is
+	// discarded never take one
+	for i := range h.tx {
+		h.seq++
+		h.tx[i].Seq = h.seq
+		// Routed now, under the rules the transaction was captured with, so
+		// a reload does not move it however late it is written
+		h.tx[i].Coll = ruleCollection(h.rules, h.tx[i].Meta.DB, h.tx[i].Meta.Tbl)
+	}
+	if len(h.tx) > 0 {
+		if len(h.batch) == 0 {
+			h.batchStart = time.Now()
+		}
+		h.batch = append(h.batch, h.tx...)
+		h.batchBytes += h.txBytes
+
+		h.batchFile = h.txEndPos.Name
+		h.batchPos = h.txEndPos.Pos
+		if set != nil {
+			h.batchGTID = set.String()
+		}
+	}
+	h.tx = h.tx[:0]
+	h.txBytes = 0
+	h.txID = ""
+	h.txEvents = 0
+	h.txCommitted = false
+	h.lastGTID = ""
+	clear(h.txTouched)
+	h.rules = h.sink.tableRules()
+}
+
+func (h *Handler) OnRotate(header *replication.EventHeader, ev *replication.RotateEvent) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.lastFile = string(ev.NextLogName)
+	h.lastPos = ev.Position
+	return nil
+}
+
+// systemSchemas are never audited, whatever the table filters say
+var systemSchemas = map[string]bool{"mysql": true, "information_schema": true, "performance_schema": true, "sys": true}
+
+// OnTableChanged queues a schema_changes record for OnDDL and drops the
+// cached definition; tables the row filters exclude are ignored
+func (h *Handler) OnTableChanged(header *replication.EventHeader, schema, table string) error {
+	if systemSchemas[strings.ToLower(schema)] {
+		return nil
+	}
+	if h.getTable != nil {
+		if _, err := h.getTable(schema, table); err == canal.ErrExcludedTable {
+			return nil
+		}
+	}
+	key := fmt.Sprintf("%s.%s", schema, table)
+	h.mu.Lock()
+	h.pendingDDL = append(h.pendingDDL, SchemaChangeDoc{DB: schema, Tbl: table, Before: h.tableSchemas[key]})
+	delete(h.tableSchemas, key)
+	delete(h.schemaVersions, key)
+	delete(h.identities, key)
+	h.mu.Unlock()
+	log.Printf("Schema change detected: %s - flushing batch for safety", key)
+	// Flush current batch to ensure consistency
+	if err := h.Flush(context.Background()); err != nil {
+		log.Printf("Error flushing on schema change: %v", err)
+		// Don't stop replication, just warn
+	}
+	return nil
+}
+
+// OnDDL records the statement for every table OnTableChanged reported for it
+func (h *Handler) OnDDL(header *replication.EventHeader, nextPos mysql.Position, queryEvent *replication.QueryEvent) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	pending := h.pendingDDL
+	h.pendingDDL = nil
+
+	ts := time.Unix(int64(header.Timestamp), 0).UTC()
+	stmt := string(queryEvent.Query)
+	for _, d := range pending {
+		if h.getTable != nil {
+			if t, err := h.getTable(d.DB, d.Tbl); err == nil {
+				d.After = make([]string, 0, len(t.Columns))
+				for _, c := range t.Columns {
+					d.After = append(d.After, c.Name)
+				}
+				// Record the new definition now rather than on the next row
+				if _, err := h.registerSchema(t); err != nil {
+					log.Printf("Warning: could not register schema for %s.%s: %v", d.DB, d.Tbl, err)
+				}
+			}
+		}
+		sum := sha1.Sum([]byte(fmt.Sprintf("%s|%s|%d|%s|%s", h.source, nextPos.Name, nextPos.Pos, d.DB, d.Tbl)))
+		d.ID = hex.EncodeToString(sum[:])
+		d.TS = ts
+		d.Source = h.source
+		d.Stmt = stmt
+		d.GTID = h.lastGTID
+		d.File = nextPos.Name
+		d.Pos = nextPos.Pos
+		d.TSIST = ts.In(h.loc).Format("2006-01-02 15:04:05")
+
+		if err := h.sink.writeSchemaChange(context.Background(), d); err != nil {
+			return fmt.Errorf("record DDL for %s.%s: %w", d.DB, d.Tbl, err)
+		}
+		log.Printf("Recorded DDL for %s.%s: %s", d.DB, d.Tbl, clipStmt(stmt, 120))
+	}
+	return nil
+}
+
+// registerSchema stores the definition of t in schema_history and caches
+// the resulting version for the table; caller must hold h.mu
+func (h *Handler) registerSchema(t *schema.Table) (int, error) {
+	nullable := h.columnNullability(t.Schema, t.Name)
+	pk := make(map[int]bool, len(t.PKColumns))
+	for _, idx := range t.PKColumns {
+		pk[idx] = true
+	}
+	cols := make([]SchemaColumn, len(t.Columns))
+	for i, c := range t.Columns {
+		cols[i] = SchemaColumn{Name: c.Name, Type: c.RawType, Nullable: nullable[c.Name], PK: pk[i]}
+	}
+
+	v, err := h.sink.registerSchema(context.Background(), h.source, t.Schema, t.Name, cols)
+	if err != nil {
+		return 0, err
+	}
+	h.schemaVersions[t.Schema+"."+t.Name] = v
+	h.identities[t.Schema+"."+t.Name] = tableIdentity(t, nullable)
+	return v, nil
+}
+
+// columnNullability reads IS_NULLABLE for each column; canal's table
+// metadata does not carry it
+func (h *Handler) columnNullability(db, tbl string) map[string]bool {
+	out := map[string]bool{}
+	if h.execute == nil {
+		return out
+	}
+	r, err := h.execute("SELECT COLUMN_NAME, IS_NULLABLE FROM information_schema.COLUMNS WHERE TABLE_SCHEMA = ? AND TABLE_NAME = ?", db, tbl)
+	if err != nil {
+		log.Printf("Warning: could not read column nullability for %s.%s: %v", db, tbl, err)
+		return out
+	}
+	for i := 0; i < r.RowNumber(); i++ {
+		name, _ := r.GetString(i, 0)
+		isNull, _ := r.GetString(i, 1)
+		out[name] = isNull == "YES"
+	}
+	return out
+}
+
+func clipStmt(s string, n int) string {
+	s = strings.Join(strings.Fields(s), " ")
+	if len(s) > n {
+		return s[:n-3] + "..."
+	}
+	return s
+}
+
+// OnXID marks the open transaction as committed; its events are handed to
+// the batch in OnPosSynced once Canal has the updated GTID set
+func (h *Handler) OnXID(header *replication.EventHeader, nextPos mysql.Position) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.txCommitted = true
+	h.txEndPos = nextPos
+	return nil
+}
+
+func (h *Handler) OnGTID(header *replication.EventHeader, ev mysql.BinlogGTIDEvent) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	// A GTID event opens a new transaction; anything still buffered belongs
+	// to one that never reached XID and will be replayed from the offset
+	if len(h.tx) > 0 {
+		log.Printf("Discarding %d events of unterminated transaction %s", len(h.tx), h.txID)
+	}
+	h.tx = h.tx[:0]
+	h.txBytes = 0
+	h.txEvents = 0
+	h.txCommitted = false
+	clear(h.txTouched)
+	h.rules = h.sink.tableRules()
+	h.txID = fmt.Sprintf("%s:%d", h.lastFile, header.LogPos-header.EventSize)
+	h.lastGTID = transactionGTID(ev)
+	return nil
+}
+
+// transactionGTID renders the GTID of a single transaction: server_uuid:gno
+// (server_uuid:tag:gno for tagged GTIDs) on MySQL, domain-server-seq on
+// MariaDB. Anonymous GTIDs (gtid_mode OFF or ON_PERMISSIVE: zero SID, GNO 0)
+// do not identify a transaction and render as "".
+func transactionGTID(ev mysql.BinlogGTIDEvent) string {
+	switch e := ev.(type) {
+	case *replication.GTIDEvent:
+		if e.GNO == 0 || bytes.Count(e.SID, []byte{0}) == len(e.SID) {
+			return ""
+		}
+		if len(e.SID) == 16 {
+			sid := e.SID
+			u := fmt.Sprintf("%x-%x-%x-%x-%x", sid[0:4], sid[4:6], sid[6:8], sid[8:10], sid[10:16])
+			if e.Tag != "" {
+				return fmt.Sprintf("%s:%s:%d", u, e.Tag, e.GNO)
+			}
+			return fmt.Sprintf("%s:%d", u, e.GNO)
+		}
+	case *replication.MariadbGTIDEvent:
+		return e.GTID.String()
+	}
+	if set, err := ev.GTIDNext(); err == nil && set != nil {
+		return set.String()
+	}
+	return ""
+}
+
+// func (h *Handler) OnRowGTID(mysql.GTIDSet) error              { return nil }
+
+// SnapshotConfig controls the optional initial snapshot and ad-hoc
+// incremental snapshots
+type SnapshotConfig struct {
+	Mode       string        `toml:"mode"`        // "never" or "initial" (only when no offset is saved)
+	ChunkSize  int           `toml:"chunk_size"`  // rows per SELECT
+	SignalPoll time.Duration `toml:"signal_poll"` // how often snapshot_signals is checked
+}
+
+// applyEnv overrides c from SNAPSHOT_MODE, SNAPSHOT_CHUNK_SIZE and
+// SNAPSHOT_SIGNAL_POLL
+func (c *SnapshotConfig) applyEnv() {
+	c.Mode = getenv("SNAPSHOT_MODE", c.Mode)
+	c.ChunkSize = getenvInt("SNAPSHOT_CHUNK_SIZE", c.ChunkSize)
+	c.SignalPoll = getenvDuration("SNAPSHOT_SIGNAL_POLL", c.SignalPoll)
+}
+
+// reportKeylessTables logs every captured table without a primary key and
+// the identity its events use in meta.pk instead
+func reportKeylessTables(c *canal.Canal, h *Handler) error {
+	r, err := c.Execute("SELECT t.TABLE_SCHEMA, t.TABLE_NAME FROM information_schema.TABLES t " +
+		"WHERE t.TABLE_TYPE = 'BASE TABLE' AND t.TABLE_SCHEMA NOT IN ('mysql', 'information_schema', 'performance_schema', 'sys') " +
+		"AND NOT EXISTS (SELECT 1 FROM information_schema.TABLE_CONSTRAINTS k WHERE k.TABLE_SCHEMA = t.TABLE_SCHEMA " +
+		"AND k.TABLE_NAME = t.TABLE_NAME AND k.CONSTRAINT_TYPE = 'PRIMARY KEY') " +
+		"ORDER BY t.TABLE_SCHEMA, t.TABLE_NAME")
+	if err != nil {
+		return fmt.Errorf("list tables without primary key: %w", err)
+	}
+	n := 0
+	for i := 0; i < r.RowNumber(); i++ {
+		db, _ := r.GetString(i, 0)
+		tbl, _ := r.GetString(i, 1)
+		t, err := c.GetTable(db, tbl)
+		if err == canal.ErrExcludedTable || err == schema.ErrTableNotExist {
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("table %s.%s: %w", db, tbl, err)
+		}
+		n++
+		log.Printf("[%s] %s.%s has no primary key; rows are identified by %s", h.source, db, tbl,
+			tableIdentity(t, h.columnNullability(db, tbl)))
+	}
+	if n > 0 {
+		log.Printf("[%s] %d captured tables have no primary key (meta.key on their events)", h.source, n)
+	}
+	return nil
+}
+
+// SnapshotProgress is how far the initial snapshot of a source got, kept in
+// its binlog_offsets document until the snapshot completes
+type SnapshotProgress struct {
+	GTID    string    `bson:"gtid"`    // GTID set the snapshot was taken at; streaming starts there
+	Started time.Time `bson:"started"` // ts of the snapshot's "r" events
+	Done    []string  `bson:"done"`    // db.tbl of tables read completely
+	DB      string    `bson:"db,omitempty"`
+	Tbl     string    `bson:"tbl,omitempty"`
+	LastPK  []any     `bson:"last_pk,omitempty"` // PK of the last row stored of db.tbl
+	Rows    int       `bson:"rows"`              // rows of db.tbl stored
+}
+
+// loadSnapshotProgress returns the progress of an interrupted initial
+// snapshot of source, or nil
+func (s *MongoSink) loadSnapshotProgress(ctx context.Context, source string) (*SnapshotProgress, error) {
+	var doc struct {
+		Snapshot *SnapshotProgress `bson:"snapshot"`
+	}
+	err := retryWithBackoff(ctx, func(retryCtx context.Context) error {
+		err := s.offsets.FindOne(retryCtx, bson.M{"_id": source}).Decode(&doc)
+		if err == mongo.ErrNoDocuments {
+			return nil
+		}
+		return err
+	}, s.retry.Attempts, s.retry.InitialDelay, s.retry.MaxDelay)
+	if err != nil || doc.Snapshot == nil {
+		return nil, err
+	}
+	for i, v := range doc.Snapshot.LastPK {
+		if b, ok := v.(primitive.Binary); ok {
+			doc.Snapshot.LastPK[i] = b.Data // binary PKs come back from BSON wrapped
+		}
+	}
+	return doc.Snapshot, nil
+}
+
+// saveSnapshotProgress stores p; nil removes it once the snapshot is complete
+func (s *MongoSink) saveSnapshotProgress(ctx context.Context, source string, p *SnapshotProgress) error {
+	update := bson.M{"$set": bson.M{"source": source, "snapshot": p}}
+	if p == nil {
+		update = bson.M{"$unset": bson.M{"snapshot": ""}}
+	}
+	return retryWithBackoff(ctx, func(retryCtx context.Context) error {
+		_, err := s.offsets.UpdateByID(retryCtx, source, update, options.Update().SetUpsert(true))
+		return err
+	}, s.retry.Attempts, s.retry.InitialDelay, s.retry.MaxDelay)
+}
+
+// runInitialSnapshot emits an "r" event for every existing row of the
+// captured tables, all read in one consistent snapshot, and saves the GTID
+// set of that snapshot as the offset binlog streaming resumes from.
+// Progress is saved after every chunk; a restart continues after the last
+// stored chunk with the original GTID set, so the rows read before it keep
+// their IDs.
+func runInitialSnapshot(ctx context.Context, c *canal.Canal, cfg *canal.Config, h *Handler, chunkSize int) error {
+	if chunkSize <= 0 {
+		chunkSize = 1000
+	}
+	snap, err := h.sink.loadSnapshotProgress(ctx, h.source)
+	if err != nil {
+		return fmt.Errorf("load snapshot progress: %w", err)
+	}
+	conn, err := client.Connect(cfg.Addr, cfg.User, cfg.Password, "")
+	if err != nil {
+		return fmt.Errorf("snapshot connect: %w", err)
+	}
+	defer conn.Close()
+
+	var gset mysql.GTIDSet
+	if snap != nil {
+		// Rows read from here on are newer than the GTID set; streaming
+		// replays the changes in between on top of them
+		if gset, err = mysql.ParseGTIDSet(cfg.Flavor, snap.GTID); err != nil {
+			return fmt.Errorf("parse snapshot GTID set %q: %w", snap.GTID, err)
+		}
+		if _, err := conn.Execute("SET SESSION TRANSACTION ISOLATION LEVEL REPEATABLE READ"); err != nil {
+			return fmt.Errorf("snapshot isolation: %w", err)
+		}
+		if _, err := conn.Execute("START TRANSACTION WITH CONSISTENT SNAPSHOT"); err != nil {
+			return fmt.Errorf("start snapshot: %w", err)
+		}
+		defer conn.Execute("ROLLBACK")
+		log.Printf("Resuming snapshot taken at GTID set %s (%d tables done)", snap.GTID, len(snap.Done))
+	} else {
+		if gset, err = startSnapshot(c, conn); err != nil {
+			return err
+		}
+		defer conn.Execute("ROLLBACK")
+		log.Printf("Snapshot started at GTID set %s", gset.String())
+		snap = &SnapshotProgress{GTID: gset.String(), Started: time.Now().UTC().Truncate(time.Second)}
+		if err := h.sink.saveSnapshotProgress(ctx, h.source, snap); err != nil {
+			return fmt.Errorf("save snapshot progress: %w", err)
+		}
+	}
+
+	r, err := conn.Execute("SELECT TABLE_SCHEMA, TABLE_NAME FROM information_schema.TABLES " +
+		"WHERE TABLE_TYPE = 'BASE TABLE' AND TABLE_SCHEMA NOT IN ('mysql', 'information_schema', 'performance_schema', 'sys') " +
+		"ORDER BY TABLE_SCHEMA, TABLE_NAME")
+	if err != nil {
+		return fmt.Errorf("list tables: %w", err)
+	}
+
+	h.mu.Lock()
+	h.batchGTID = "" // keep the offset empty until the snapshot completes
+	h.lastGTID = ""
+	h.lastFile, h.lastPos = "", 0
+	h.mu.Unlock()
+
+	done := make(map[string]bool, len(snap.Done))
+	for _, name := range snap.Done {
+		done[name] = true
+	}
+	for i := 0; i < r.RowNumber(); i++ {
+		db, _ := r.GetString(i, 0)
+		tbl, _ := r.GetString(i, 1)
+		if done[db+"."+tbl] {
+			continue
+		}
+
+		// GetTable applies the same include/exclude filters as streaming
+		t, err := c.GetTable(db, tbl)
+		if err == canal.ErrExcludedTable || err == schema.ErrTableNotExist {
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("snapshot table %s.%s: %w", db, tbl, err)
+		}
+
+		interrupted, rows := snap.DB == db && snap.Tbl == tbl, snap.Rows
+		if resumeTable(snap, t) {
+			log.Printf("Resuming snapshot of %s.%s after %d rows", db, tbl, snap.Rows)
+		} else if interrupted {
+			log.Printf("Restarting snapshot of %s.%s (no primary key to resume after %d rows)", db, tbl, rows)
+		}
+		n, err := snapshotTable(ctx, conn, h, t, chunkSize, snap)
+		if err != nil {
+			return fmt.Errorf("snapshot table %s.%s: %w", db, tbl, err)
+		}
+		log.Printf("Snapshot of %s.%s: %d rows", db, tbl, n)
+
+		snap.Done = append(snap.Done, db+"."+tbl)
+		snap.DB, snap.Tbl, snap.LastPK, snap.Rows = "", "", nil, 0
+		if err := h.sink.saveSnapshotProgress(ctx, h.source, snap); err != nil {
+			return fmt.Errorf("save snapshot progress: %w", err)
+		}
+	}
+
+	// Hand off to binlog streaming at the snapshot's GTID set
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.batchGTID = gset.String()
+	if len(h.batch) > 0 {
+		if err := h.flushLocked(ctx); err != nil {
+			return fmt.Errorf("flush snapshot: %w", err)
+		}
+	} else if err := h.sink.saveGTID(ctx, h.source, h.batchGTID, "", 0); err != nil {
+		return fmt.Errorf("save snapshot GTID: %w", err)
+	}
+	if err := h.sink.saveSnapshotProgress(ctx, h.source, nil); err != nil {
+		log.Printf("Warning: could not clear snapshot progress: %v", err)
+	}
+	log.Printf("Snapshot complete, streaming from GTID set %s", h.batchGTID)
+	return nil
+}
+
+// startSnapshot opens a consistent snapshot transaction on conn and returns
+// the GTID set it corresponds to
+func startSnapshot(c *canal.Canal, conn *client.Conn) (mysql.GTIDSet, error) {
+	// Hold a global read lock only while the snapshot and its GTID set are
+	// taken, so the two describe exactly the same point
+	locked := true
+	if _, err := conn.Execute("FLUSH TABLES WITH READ LOCK"); err != nil {
+		log.Printf("Warning: FLUSH TABLES WITH READ LOCK failed (%v); transactions committed while the snapshot starts will also be replayed from the binlog", err)
+		locked = false
+	}
+
+	// Without the lock, read the GTID set first so concurrent commits are
+	// replayed rather than lost
+	var gset mysql.GTIDSet
+	var err error
+	if !locked {
+		if gset, err = c.GetMasterGTIDSet(); err != nil {
+			return nil, fmt.Errorf("snapshot GTID set: %w", err)
+		}
+	}
+	if _, err := conn.Execute("SET SESSION TRANSACTION ISOLATION LEVEL REPEATABLE READ"); err != nil {
+		return nil, fmt.Errorf("snapshot isolation: %w", err)
+	}
+	if _, err := conn.Execute("START TRANSACTION WITH CONSISTENT SNAPSHOT"); err != nil {
+		return nil, fmt.Errorf("start snapshot: %w", err)
+	}
+	if locked {
+		gset, err = c.GetMasterGTIDSet()
+		if _, uerr := conn.Execute("UNLOCK TABLES"); uerr != nil && err == nil {
+			err = uerr
+		}
+		if err != nil {
+			return nil, fmt.Errorf("snapshot GTID set: %w", err)
+		}
+	}
+	return gset, nil
+}
+
+// resumeTable points snap at t, keeping its progress if the snapshot was
+// interrupted inside t; returns whether it was. Tables without a primary key
+// start over: OFFSET only pages stably within one snapshot transaction, and
+// a resumed snapshot is a new one.
+func resumeTable(snap *SnapshotProgress, t *schema.Table) bool {
+	if snap.DB == t.Schema && snap.Tbl == t.Name && len(t.PKColumns) > 0 {
+		return true
+	}
+	snap.DB, snap.Tbl, snap.LastPK, snap.Rows = t.Schema, t.Name, nil, 0
+	return false
+}
+
+// snapshotTxID names a chunk of the initial snapshot after the GTID set the
+// snapshot was taken at, so a resumed snapshot gives its rows the same IDs
+func snapshotTxID(gtid, db, tbl string, chunk int) string {
+	return fmt.Sprintf("snapshot:%s:%s.%s:%d", gtid, db, tbl, chunk)
+}
+
+// snapshotTable reads t in primary-key order, chunkSize rows at a time,
+// starting after snap.LastPK, and passes each chunk through the handler as
+// one transaction. Every chunk is flushed and recorded in snap before the
+// next is read.
+func snapshotTable(ctx context.Context, conn *client.Conn, h *Handler, t *schema.Table, chunkSize int, snap *SnapshotProgress) (int, error) {
+	total := 0
+	for chunk := snap.Rows / chunkSize; ; chunk++ {
+		if err := ctx.Err(); err != nil {
+			return total, err
+		}
+
+		q, args := chunkQuery(t, chunkSize, snap.LastPK, snap.Rows)
+		r, err := conn.Execute(q, args...)
+		if err != nil {
+			return total, err
+		}
+		rows := snapshotRows(t, r)
+		if len(rows) == 0 {
+			return total, nil
+		}
+
+		txID := snapshotTxID(snap.GTID, t.Schema, t.Name, chunk)
+		if err := h.emitSnapshotRows(t, rows, snap.Started, txID); err != nil {
+			return total, err
+		}
+		h.mu.Lock()
+		err = h.flushLocked(ctx)
+		h.mu.Unlock()
+		if err != nil {
+			return total, err
+		}
+		total += len(rows)
+		snap.Rows += len(rows)
+		if len(t.PKColumns) > 0 {
+			snap.LastPK = chunkEnd(t, rows)
+		}
+		if err := h.sink.saveSnapshotProgress(ctx, h.source, snap); err != nil {
+			return total, fmt.Errorf("save snapshot progress: %w", err)
+		}
+		if len(rows) < chunkSize {
+			return total, nil
+		}
+	}
 }
 
-type Handler struct {
-	canal.DummyEventHandler
+// chunkQuery selects the chunk after PK values last (nil for the first one).
+// Tables without a PK fall back to OFFSET, which is only stable inside a
+// snapshot transaction (see resumeTable).
+func chunkQuery(t *schema.Table, chunkSize int, last []any, offset int) (string, []any) {
+	cols := make([]string, len(t.Columns))
+	for i, c := range t.Columns {
+		cols[i] = quoteIdent(c.Name)
+	}
+	pkCols := make([]string, len(t.PKColumns))
+	marks := make([]string, len(t.PKColumns))
+	for i, idx := range t.PKColumns {
+		pkCols[i] = quoteIdent(t.Columns[idx].Name)
+		marks[i] = "?"
+	}
+	base := fmt.Sprintf("SELECT %s FROM %s.%s", strings.Join(cols, ", "), quoteIdent(t.Schema), quoteIdent(t.Name))
 
-	sink   *MongoSink
-	source string
-	batch  []EventDoc
+	switch {
+	case len(pkCols) == 0:
+		return fmt.Sprintf("%s LIMIT %d OFFSET %d", base, chunkSize, offset), nil
+	case last == nil:
+		return fmt.Sprintf("%s ORDER BY %s LIMIT %d", base, strings.Join(pkCols, ", "), chunkSize), nil
+	default:
+		return fmt.Sprintf("%s WHERE (%s) > (%s) ORDER BY %s LIMIT %d", base,
+			strings.Join(pkCols, ", "), strings.Join(marks, ", "), strings.Join(pkCols, ", "), chunkSize), last
+	}
+}
 
-	lastFile string
-	lastPos  uint64
-	lastGTID string
-	loc      *time.Location
+// chunkEnd returns the PK values of the last row, where the next chunk starts
+func chunkEnd(t *schema.Table, rows [][]any) []any {
+	lastRow := rows[len(rows)-1]
+	last := make([]any, len(t.PKColumns))
+	for i, idx := range t.PKColumns {
+		last[i] = lastRow[idx]
+	}
+	return last
+}
 
-	// Position tracking for current batch
-	batchFile string
-	batchPos  uint32
-	batchGTID string
+// snapshotRows converts a chunk result to rows shaped like binlog rows
+func snapshotRows(t *schema.Table, r *mysql.Result) [][]any {
+	rows := make([][]any, len(r.Values))
+	for i, vals := range r.Values {
+		row := make([]any, len(vals))
+		for j := range vals {
+			row[j] = snapshotValue(&t.Columns[j], vals[j].Value())
+		}
+		rows[i] = row
+	}
+	return rows
+}
 
-	// Schema tracking for data integrity
-	tableSchemas map[string][]string // table -> column names
+// emitSnapshotRows runs snapshot rows through OnRow like a binlog rows event
+// and commits them as one transaction
+func (h *Handler) emitSnapshotRows(t *schema.Table, rows [][]any, ts time.Time, txID string) error {
+	h.mu.Lock()
+	h.txID = txID
+	h.mu.Unlock()
+
+	ev := &canal.RowsEvent{
+		Table:  t,
+		Action: snapshotAction,
+		Rows:   rows,
+		Header: &replication.EventHeader{Timestamp: uint32(ts.Unix())},
+	}
+	if err := h.OnRow(ev); err != nil {
+		return err
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.txEndPos = mysql.Position{}
+	h.commitTxLocked(nil)
+	if h.shouldFlushLocked() {
+		return h.flushLocked(context.Background())
+	}
+	return nil
 }
 
-func (h *Handler) String() string { return "audit-handler" }
+// snapshotValue converts a SELECT result value to the Go type the binlog
+// decoder produces for the same column, so snapshot and streamed rows compare equal
+func snapshotValue(col *schema.TableColumn, v any) any {
+	b, ok := v.([]byte)
+	if !ok {
+		return v
+	}
+	raw := strings.ToLower(col.RawType)
+	if col.Type == schema.TYPE_BINARY || strings.Contains(raw, "blob") || strings.Contains(raw, "text") {
+		return append([]byte(nil), b...)
+	}
+	return string(b)
+}
 
-// Flush writes any remaining events in batch to MongoDB atomically with GTID
-func (h *Handler) Flush(ctx context.Context) error {
-	if len(h.batch) == 0 {
-		return nil
+// snapshotWindow is one incremental snapshot chunk, read between the low and
+// high watermark binlog positions. Streamed transactions committed between
+// the two remove the rows they touch; the rest are emitted once the stream
+// reaches the high watermark, so they land exactly where they were read.
+// The window is registered before the low watermark is read, so no such
+// transaction slips past while the chunk is being read.
+type snapshotWindow struct {
+	table     *schema.Table
+	rows      map[string][]any // rowKey -> row
+	order     []string         // PK order of rows
+	low, high mysql.Position
+	ts        time.Time
+	txID      string
+
+	ready   bool                      // rows and watermarks set
+	touched map[string]mysql.Position // until ready: rowKey -> end of the last streamed change
+
+	done    chan struct{} // closed when the chunk is emitted
+	emitted int
+	dropped int
+	err     error
+}
+
+// openWindow registers a chunk of t with the handler before it is read;
+// fillWindow hands over the rows, and the caller then waits on done
+func (h *Handler) openWindow(t *schema.Table, txID string) (*snapshotWindow, error) {
+	w := &snapshotWindow{
+		table:   t,
+		ts:      time.Now().UTC().Truncate(time.Second),
+		txID:    txID,
+		touched: make(map[string]mysql.Position),
+		done:    make(chan struct{}),
 	}
-	log.Printf("Flushing %d remaining events", len(h.batch))
-	if err := h.sink.writeBatchWithGTID(ctx, h.batch, h.source, h.batchGTID, h.batchFile, h.batchPos); err != nil {
-		return fmt.Errorf("flush batch: %w", err)
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.window != nil {
+		return nil, fmt.Errorf("another snapshot chunk is in flight")
+	}
+	h.window = w
+	return w, nil
+}
+
+// fillWindow sets the rows read between low and high, dropping those the
+// stream changed after low while they were read
+func (h *Handler) fillWindow(w *snapshotWindow, rows [][]any, low, high mysql.Position) error {
+	t := w.table
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.window != w {
+		return fmt.Errorf("snapshot chunk was cancelled")
+	}
+	w.rows = make(map[string][]any, len(rows))
+	w.order = make([]string, 0, len(rows))
+	for _, row := range rows {
+		k := rowKey(t.Schema, t.Name, rowPK(t, row))
+		if end, ok := w.touched[k]; ok && end.Compare(low) > 0 {
+			w.dropped++
+			continue
+		}
+		w.rows[k] = row
+		w.order = append(w.order, k)
+	}
+	w.low, w.high, w.ready, w.touched = low, high, true, nil
+
+	// A quiet stream may already be at the high watermark
+	cur := mysql.Position{Name: h.lastFile, Pos: uint32(h.lastPos)}
+	if !h.txCommitted && len(h.tx) == 0 && cur.Compare(high) >= 0 {
+		return h.emitWindowLocked()
 	}
-	h.batch = h.batch[:0]
 	return nil
 }
 
-func hasPrimaryKey(e *canal.RowsEvent) bool {
-	return len(e.Table.PKColumns) > 0
+// cancelWindow drops w if it has not been emitted yet
+func (h *Handler) cancelWindow(w *snapshotWindow) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.window == w {
+		h.window = nil
+		close(w.done)
+	}
 }
 
-func shortOP(action string) string {
+// emitWindowLocked commits the surviving chunk rows to the batch as one
+// transaction ahead of any open one, then flushes so that a signal's saved
+// progress never runs ahead of stored events; caller must hold h.mu
+func (h *Handler) emitWindowLocked() error {
+	w := h.window
+	h.window = nil
+	defer close(w.done)
+
+	rows := make([][]any, 0, len(w.order))
+	for _, k := range w.order {
+		if row, ok := w.rows[k]; ok {
+			rows = append(rows, row)
+		}
+	}
+	if len(rows) > 0 {
+		tx, txBytes, txID, txEvents, gtid := h.tx, h.txBytes, h.txID, h.txEvents, h.lastGTID
+		committed, endPos, touched, rules := h.txCommitted, h.txEndPos, h.txTouched, h.rules
+		h.tx, h.txBytes, h.txID, h.txEvents, h.lastGTID = nil, 0, w.txID, 0, ""
+		h.txTouched = make(map[string]struct{})
+		h.txEndPos = mysql.Position{Name: h.batchFile, Pos: h.batchPos} // offset stays put
+
+		err := h.onRowLocked(&canal.RowsEvent{
+			Table:  w.table,
+			Action: snapshotAction,
+			Rows:   rows,
+			Header: &replication.EventHeader{Timestamp: uint32(w.ts.Unix())},
+		})
+		if err == nil {
+			h.commitTxLocked(nil)
+		}
+
+		h.tx, h.txBytes, h.txID, h.txEvents, h.lastGTID = tx, txBytes, txID, txEvents, gtid
+		h.txCommitted, h.txEndPos, h.txTouched, h.rules = committed, endPos, touched, rules
+		if err != nil {
+			w.err = err
+			return fmt.Errorf("emit snapshot chunk: %w", err)
+		}
+	}
+	w.emitted = len(rows)
+	if err := h.flushLocked(context.Background()); err != nil {
+		w.err = err
+		return err
+	}
+	return nil
+}
+
+// SnapshotSignal requests an incremental snapshot of one table. Operators
+// insert {db, tbl, status: "pending"} into snapshot_signals; the daemon
+// records progress on the same document.
+type SnapshotSignal struct {
+	ID        any       `bson:"_id"`
+	Source    string    `bson:"source,omitempty"` // empty: any source capturing the table
+	DB        string    `bson:"db"`
+	Tbl       string    `bson:"tbl"`
+	ChunkSize int       `bson:"chunk_size,omitempty"`
+	Status    string    `bson:"status"` // pending -> running -> done | failed
+	LastPK    []any     `bson:"last_pk,omitempty"`
+	Rows      int       `bson:"rows"`
+	Error     string    `bson:"error,omitempty"`
+	Started   time.Time `bson:"started,omitempty"`
+	Finished  time.Time `bson:"finished,omitempty"`
+}
+
+// claimSignal returns the snapshot this source should run next: one it was
+// running before a restart, otherwise the oldest pending one, which it marks
+// running. Returns nil when there is nothing to do.
+func (s *MongoSink) claimSignal(ctx context.Context, source string) (*SnapshotSignal, error) {
+	var sig SnapshotSignal
+	err := s.signals.FindOne(ctx, bson.M{"status": "running", "source": source}).Decode(&sig)
+	if err == nil {
+		return &sig, nil
+	}
+	if err != mongo.ErrNoDocuments {
+		return nil, err
+	}
+
+	err = s.signals.FindOneAndUpdate(ctx,
+		bson.M{"status": "pending", "$or": bson.A{
+			bson.M{"source": source},
+			bson.M{"source": bson.M{"$in": bson.A{"", nil}}},
+		}},
+		bson.M{"$set": bson.M{"status": "running", "source": source, "started": time.Now().UTC()}},
+		options.FindOneAndUpdate().SetSort(bson.D{{Key: "_id", Value: 1}}).SetReturnDocument(options.After),
+	).Decode(&sig)
+	if err == mongo.ErrNoDocuments {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &sig, nil
+}
+
+func (s *MongoSink) updateSignal(ctx context.Context, id any, set bson.M) error {
+	return retryWithBackoff(ctx, func(retryCtx context.Context) error {
+		_, err := s.signals.UpdateByID(retryCtx, id, bson.M{"$set": set})
+		return err
+	}, s.retry.Attempts, s.retry.InitialDelay, s.retry.MaxDelay)
+}
+
+// RunSignalWatcher polls snapshot_signals and runs requested incremental
+// snapshots one at a time while streaming continues. Blocks until ctx is done.
+func RunSignalWatcher(ctx context.Context, c *canal.Canal, h *Handler, cfg SnapshotConfig) {
+	if cfg.SignalPoll <= 0 {
+		return
+	}
+	t := time.NewTicker(cfg.SignalPoll)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+
+		sig, err := h.sink.claimSignal(ctx, h.source)
+		if err != nil {
+			log.Printf("Error checking snapshot signals: %v", err)
+			continue
+		}
+		if sig == nil {
+			continue
+		}
+		if sig.ChunkSize <= 0 {
+			sig.ChunkSize = cfg.ChunkSize
+		}
+
+		log.Printf("Incremental snapshot of %s.%s requested", sig.DB, sig.Tbl)
+		err = runIncrementalSnapshot(ctx, c, h, sig)
+		if ctx.Err() != nil {
+			return // left running; resumed from last_pk on restart
+		}
+		set := bson.M{"status": "done", "finished": time.Now().UTC()}
+		if err != nil {
+			log.Printf("Incremental snapshot of %s.%s failed: %v", sig.DB, sig.Tbl, err)
+			set = bson.M{"status": "failed", "error": err.Error(), "finished": time.Now().UTC()}
+		} else {
+			log.Printf("Incremental snapshot of %s.%s complete: %d rows", sig.DB, sig.Tbl, sig.Rows)
+		}
+		if err := h.sink.updateSignal(context.Background(), sig.ID, set); err != nil {
+			log.Printf("Error updating snapshot signal: %v", err)
+		}
+	}
+}
+
+// runIncrementalSnapshot re-reads one table in PK chunks without locking or
+// pausing the stream (watermark algorithm, see snapshotWindow). Progress is
+// saved on the signal after every chunk.
+func runIncrementalSnapshot(ctx context.Context, c *canal.Canal, h *Handler, sig *SnapshotSignal) error {
+	t, err := c.GetTable(sig.DB, sig.Tbl)
+	if err == canal.ErrExcludedTable {
+		return fmt.Errorf("table is not captured by INCLUDE_REGEX/EXCLUDE_REGEX")
+	}
+	if err != nil {
+		return err
+	}
+	if len(t.PKColumns) == 0 {
+		return fmt.Errorf("table has no primary key (watermark chunks need one)")
+	}
+
+	sigID := fmt.Sprint(sig.ID)
+	if oid, ok := sig.ID.(primitive.ObjectID); ok {
+		sigID = oid.Hex()
+	}
+	last := sig.LastPK
+	for i, v := range last {
+		if b, ok := v.(primitive.Binary); ok {
+			last[i] = b.Data // binary PKs come back from BSON wrapped
+		}
+	}
+	for chunk := sig.Rows / sig.ChunkSize; ; chunk++ {
+		txID := fmt.Sprintf("snapshot:%s.%s:%s:%d", t.Schema, t.Name, sigID, chunk)
+		w, err := h.openWindow(t, txID)
+		if err != nil {
+			return err
+		}
+		rows, err := readWindowChunk(c, h, w, t, sig.ChunkSize, last)
+		if err != nil || len(rows) == 0 {
+			h.cancelWindow(w)
+			return err
+		}
+		select {
+		case <-w.done:
+		case <-ctx.Done():
+			h.cancelWindow(w)
+			return ctx.Err()
+		}
+		if w.err != nil {
+			return w.err
+		}
+
+		last = chunkEnd(t, rows)
+		sig.Rows += len(rows)
+		if err := h.sink.updateSignal(ctx, sig.ID, bson.M{"last_pk": last, "rows": sig.Rows}); err != nil {
+			return fmt.Errorf("save progress: %w", err)
+		}
+		if w.dropped > 0 {
+			log.Printf("Snapshot chunk %s: %d rows emitted, %d superseded by streamed changes", txID, w.emitted, w.dropped)
+		}
+		if len(rows) < sig.ChunkSize {
+			return nil
+		}
+	}
+}
+
+// readWindowChunk reads the chunk after last between two watermarks and
+// fills w with it
+func readWindowChunk(c *canal.Canal, h *Handler, w *snapshotWindow, t *schema.Table, chunkSize int, last []any) ([][]any, error) {
+	low, err := c.GetMasterPos()
+	if err != nil {
+		return nil, fmt.Errorf("low watermark: %w", err)
+	}
+	q, args := chunkQuery(t, chunkSize, last, 0)
+	r, err := c.Execute(q, args...)
+	if err != nil {
+		return nil, fmt.Errorf("read chunk: %w", err)
+	}
+	rows := snapshotRows(t, r)
+	if len(rows) == 0 {
+		return nil, nil
+	}
+	high, err := c.GetMasterPos()
+	if err != nil {
+		return nil, fmt.Errorf("high watermark: %w", err)
+	}
+	return rows, h.fillWindow(w, rows, low, high)
+}
+
+func quoteIdent(s string) string {
+	return "`" + strings.ReplaceAll(s, "`", "``") + "`"
+}
+
+func getenv(k, def string) string {
+	if v := os.Getenv(k); v != "" {
+		return v
+	}
+	return def
+}
+
+func getenvInt(k string, def int) int {
+	if v := os.Getenv(k); v != "" {
+		if n, err := strconv.Atoi(v); err == nil {
+			return n
+		}
+		log.Printf("Warning: invalid %s=%q, using %d", k, v, def)
+	}
+	return def
+}
+
+func getenvDuration(k string, def time.Duration) time.Duration {
+	if v := os.Getenv(k); v != "" {
+		if d, err := time.ParseDuration(v); err == nil {
+			return d
+		}
+		log.Printf("Warning: invalid %s=%q, using %v", k, v, def)
+	}
+	return def
+}
+
+// Config is the daemon configuration: built-in defaults, then the TOML file
+// named by -config or SDL_CONFIG, then environment variables, so systemd
+// units can still override single keys
+type Config struct {
+	Timezone string           `toml:"timezone"`
+	MaskKey  string           `toml:"mask_key"` // HMAC key of "hash" column masks
+	Mongo    MongoConfig      `toml:"mongo"`
+	Sources  []SourceConfig   `toml:"sources"`
+	Tables   []TableRule      `toml:"tables"`
+	Batch    FlushPolicy      `toml:"batch"`
+	Retry    RetryPolicy      `toml:"retry"`
+	Snapshot SnapshotConfig   `toml:"snapshot"`
+	Staging  StagingPolicy    `toml:"staging"`
+	Spool    SpoolConfig      `toml:"spool"`
+	Values   LargeValuePolicy `toml:"large_values"`
+}
+
+// MongoConfig names the sink deployment and its collections
+type MongoConfig struct {
+	URI           string `toml:"uri"`
+	DB            string `toml:"db"`
+	Events        string `toml:"events"` // default collection for row events
+	Offsets       string `toml:"offsets"`
+	SchemaChanges string `toml:"schema_changes"`
+	SchemaHistory string `toml:"schema_history"`
+	Signals       string `toml:"signals"`
+	DeadLetters   string `toml:"dead_letters"`
+}
+
+// applyEnv overrides c from MONGO_URI, MONGO_DB, MONGO_COLL,
+// MONGO_OFFSETS_COLL, MONGO_SCHEMA_COLL, MONGO_SCHEMA_HISTORY_COLL,
+// MONGO_SIGNAL_COLL and MONGO_DEAD_LETTER_COLL
+func (c *MongoConfig) applyEnv() {
+	c.URI = getenv("MONGO_URI", c.URI)
+	c.DB = getenv("MONGO_DB", c.DB)
+	c.Events = getenv("MONGO_COLL", c.Events)
+	c.Offsets = getenv("MONGO_OFFSETS_COLL", c.Offsets)
+	c.SchemaChanges = getenv("MONGO_SCHEMA_COLL", c.SchemaChanges)
+	c.SchemaHistory = getenv("MONGO_SCHEMA_HISTORY_COLL", c.SchemaHistory)
+	c.Signals = getenv("MONGO_SIGNAL_COLL", c.Signals)
+	c.DeadLetters = getenv("MONGO_DEAD_LETTER_COLL", c.DeadLetters)
+}
+
+// RetryPolicy bounds the retries of MongoDB writes and the restart backoff
+// of a failed source
+type RetryPolicy struct {
+	Attempts       int           `toml:"attempts"`         // tries per MongoDB operation
+	InitialDelay   time.Duration `toml:"initial_delay"`    // first backoff, doubled per attempt
+	MaxDelay       time.Duration `toml:"max_delay"`        // cap of the MongoDB backoff
+	SourceMaxDelay time.Duration `toml:"source_max_delay"` // cap of the source restart backoff
+}
+
+// applyEnv overrides p from RETRY_ATTEMPTS, RETRY_INITIAL_DELAY,
+// RETRY_MAX_DELAY and RETRY_SOURCE_MAX_DELAY
+func (p *RetryPolicy) applyEnv() {
+	p.Attempts = getenvInt("RETRY_ATTEMPTS", p.Attempts)
+	p.InitialDelay = getenvDuration("RETRY_INITIAL_DELAY", p.InitialDelay)
+	p.MaxDelay = getenvDuration("RETRY_MAX_DELAY", p.MaxDelay)
+	p.SourceMaxDelay = getenvDuration("RETRY_SOURCE_MAX_DELAY", p.SourceMaxDelay)
+}
+
+// TableRule applies settings to the tables whose "db.table" name matches
+// Match. Rules are checked in file order; the first matching rule that sets
+// a field wins.
+type TableRule struct {
+	Match         string            `toml:"match"`          // regexp on "db.table"
+	Collection    string            `toml:"collection"`     // events collection instead of mongo.events
+	Mask          map[string]string `toml:"mask"`           // column -> "drop", "redact", "hash" or "truncate:N"
+	Columns       []string          `toml:"columns"`        // audit only these columns
+	IgnoreColumns []string          `toml:"ignore_columns"` // never audit these columns
+	IgnoredUpdate string            `toml:"ignored_update"` // "skip" (default) or "touch" when only ignored columns changed
+
+	re    *regexp.Regexp
+	masks map[string]columnMask // Mask compiled, keyed by lower-case column
+}
+
+// columnFilter is the column selection of one table, resolved from the
+// first matching rule that sets each of Columns, IgnoreColumns and
+// IgnoredUpdate
+type columnFilter struct {
+	include map[string]bool // lower-case; nil audits every column
+	exclude map[string]bool
+	touch   bool // record "t" events for updates of ignored columns only
+}
+
+func columnFilterFor(rules []TableRule, db, tbl string) columnFilter {
+	var f columnFilter
+	name := db + "." + tbl
+	policySet := false
+	lower := func(cols []string) map[string]bool {
+		m := make(map[string]bool, len(cols))
+		for _, c := range cols {
+			m[strings.ToLower(c)] = true
+		}
+		return m
+	}
+	for _, r := range rules {
+		if !r.re.MatchString(name) {
+			continue
+		}
+		if f.include == nil && len(r.Columns) > 0 {
+			f.include = lower(r.Columns)
+		}
+		if f.exclude == nil && len(r.IgnoreColumns) > 0 {
+			f.exclude = lower(r.IgnoreColumns)
+		}
+		if !policySet && r.IgnoredUpdate != "" {
+			f.touch, policySet = r.IgnoredUpdate == "touch", true
+		}
+	}
+	return f
+}
+
+// audited reports whether changes of col go into chg
+func (f columnFilter) audited(col string) bool {
+	col = strings.ToLower(col)
+	return (f.include == nil || f.include[col]) && !f.exclude[col]
+}
+
+// columnMask hides the values of one column in chg while keeping the fact
+// that it changed
+type columnMask struct {
+	action string // drop, redact, hash or truncate
+	n      int    // truncate: characters (bytes for binary values) kept
+	key    []byte // hash: HMAC-SHA256 key
+}
+
+// parseMask compiles a TableRule.Mask value
+func parseMask(spec string, key []byte) (columnMask, error) {
+	action, arg, _ := strings.Cut(spec, ":")
+	m := columnMask{action: action}
 	switch action {
-	case canal.InsertAction:
-		return "i"
-	case canal.DeleteAction:
-		return "d"
+	case "drop", "redact":
+	case "hash":
+		if len(key) == 0 {
+			return m, errors.New("hash needs mask_key (MASK_HMAC_KEY)")
+		}
+		m.key = key
+	case "truncate":
+		n, err := strconv.Atoi(arg)
+		if err != nil || n <= 0 {
+			return m, fmt.Errorf("want truncate:N with N > 0, got %q", spec)
+		}
+		m.n = n
 	default:
-		return "u"
+		return m, fmt.Errorf("unknown mask %q (want drop, redact, hash or truncate:N)", spec)
+	}
+	return m, nil
+}
+
+// apply returns the masked form of one column value. NULL stays NULL so
+// that set/unset transitions remain visible; drop is handled by the caller.
+func (m columnMask) apply(v any) any {
+	if v == nil {
+		return nil
+	}
+	switch m.action {
+	case "redact":
+		return "[redacted]"
+	case "hash":
+		// Equal values hash equal, so changes can still be correlated
+		mac := hmac.New(sha256.New, m.key)
+		if b, ok := v.([]byte); ok {
+			mac.Write(b)
+		} else {
+			fmt.Fprint(mac, v)
+		}
+		return hex.EncodeToString(mac.Sum(nil))
+	case "truncate":
+		switch x := v.(type) {
+		case string:
+			if r := []rune(x); len(r) > m.n {
+				return string(r[:m.n])
+			}
+		case []byte:
+			if len(x) > m.n {
+				return x[:m.n]
+			}
+		}
+	}
+	return v
+}
+
+// maskChanges masks chg in place with the masks of db.tbl: the first rule
+// matching the table that names a column decides for it
+func maskChanges(rules []TableRule, db, tbl string, chg map[string]Delta) {
+	name := db + "." + tbl
+	done := map[string]bool{}
+	for _, r := range rules {
+		if len(r.masks) == 0 || !r.re.MatchString(name) {
+			continue
+		}
+		for col, d := range chg {
+			lc := strings.ToLower(col)
+			m, ok := r.masks[lc]
+			if !ok || done[lc] {
+				continue
+			}
+			done[lc] = true
+			if m.action == "drop" {
+				chg[col] = Delta{M: m.action}
+			} else {
+				for i, p := range d.P {
+					d.P[i].F, d.P[i].T = m.apply(p.F), m.apply(p.T)
+				}
+				chg[col] = Delta{F: m.apply(d.F), T: m.apply(d.T), P: d.P, M: m.action}
+			}
+		}
+	}
+}
+
+// SourceConfig describes one MySQL primary to capture from
+type SourceConfig struct {
+	Name     string   `toml:"name"` // label used in MYSQL_<NAME>_* variables; empty for the single-source setup
+	Addr     string   `toml:"addr"`
+	User     string   `toml:"user"`
+	Password string   `toml:"password"`
+	Flavor   string   `toml:"flavor"`
+	ServerID uint32   `toml:"server_id"`
+	Include  []string `toml:"include"` // table regexps on "db.table"
+	Exclude  []string `toml:"exclude"`
+}
+
+// ID identifies the source in binlog_offsets, staging and schema documents
+func (sc SourceConfig) ID() string { return "mysql://" + sc.Addr }
+
+func (sc SourceConfig) canalConfig() *canal.Config {
+	cfg := canal.NewDefaultConfig()
+	cfg.Addr = sc.Addr
+	cfg.User = sc.User
+	cfg.Password = sc.Password
+	cfg.Flavor = sc.Flavor
+	cfg.ServerID = sc.ServerID
+	cfg.IncludeTableRegex = sc.Include
+	cfg.ExcludeTableRegex = sc.Exclude
+
+	// No mysqldump; snapshots are taken by runInitialSnapshot (SNAPSHOT_MODE)
+	// and runIncrementalSnapshot (snapshot_signals)
+	cfg.Dump.ExecutionPath = ""
+	return cfg
+}
+
+// envPrefix returns the MYSQL_<NAME>_ prefix of a named source
+func (sc SourceConfig) envPrefix() string {
+	if sc.Name == "" {
+		return ""
+	}
+	return "MYSQL_" + strings.ToUpper(strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' {
+			return r
+		}
+		return '_'
+	}, sc.Name)) + "_"
+}
+
+// applyEnv overrides sc from MYSQL_<NAME>_ADDR, MYSQL_<NAME>_SERVER_ID,
+// MYSQL_<NAME>_INCLUDE_REGEX, ... The unprefixed variables (MYSQL_ADDR etc.)
+// override an unnamed source and only fill unset fields of a named one.
+func (sc *SourceConfig) applyEnv() error {
+	// value returns the variable that replaces a field: the prefixed one
+	// always, the unprefixed one for an unnamed source or an unset field
+	prefix := sc.envPrefix()
+	value := func(key, global string, unset bool) string {
+		if prefix != "" {
+			if v := os.Getenv(prefix + key); v != "" {
+				return v
+			}
+			if !unset {
+				return ""
+			}
+		}
+		return os.Getenv(global)
+	}
+	if v := value("ADDR", "MYSQL_ADDR", sc.Addr == ""); v != "" {
+		sc.Addr = v
+	}
+	if v := value("USER", "MYSQL_USER", sc.User == ""); v != "" {
+		sc.User = v
+	}
+	if v := value("PASS", "MYSQL_PASS", sc.Password == ""); v != "" {
+		sc.Password = v
+	}
+	if v := value("FLAVOR", "MYSQL_FLAVOR", sc.Flavor == ""); v != "" {
+		sc.Flavor = v
+	}
+	if v := value("INCLUDE_REGEX", "INCLUDE_REGEX", len(sc.Include) == 0); v != "" {
+		sc.Include = []string{v}
+	}
+	if v := value("EXCLUDE_REGEX", "EXCLUDE_REGEX", len(sc.Exclude) == 0); v != "" {
+		sc.Exclude = []string{v}
+	}
+	if v := value("SERVER_ID", "MYSQL_SERVER_ID", sc.ServerID == 0); v != "" {
+		n, err := strconv.ParseUint(v, 10, 32)
+		if err != nil {
+			return fmt.Errorf("source %q: invalid server id %q", sc.Name, v)
+		}
+		sc.ServerID = uint32(n)
+	}
+
+	// Defaults for whatever neither the file nor the environment set
+	if sc.Addr == "" {
+		sc.Addr = "127.0.0.1:3306"
+	}
+	if sc.User == "" {
+		sc.User = "repl"
+	}
+	if sc.Flavor == "" {
+		sc.Flavor = "mysql"
+	}
+	if sc.ServerID == 0 {
+		sc.ServerID = 2222
+	}
+	if len(sc.Include) == 0 {
+		sc.Include = []string{".*\\..*"}
+	}
+	if len(sc.Exclude) == 0 {
+		sc.Exclude = []string{"^(mysql|performance_schema|information_schema|sys)\\..*"}
 	}
+	return nil
 }
 
-func makeID(db, tbl string, pk any, ts time.Time, op string, file string, pos uint64, gtid string) string {
-	s := fmt.Sprintf("%s|%s|%v|%d|%s|%s|%d", db, tbl, pk, ts.UnixNano(), op, file, gtid, pos)
-	sum := sha1.Sum([]byte(s))
-	return hex.EncodeToString(sum[:])
+// defaultConfig returns the settings used when neither the file nor the
+// environment sets them
+func defaultConfig() Config {
+	return Config{
+		Timezone: "Asia/Kolkata",
+		Mongo: MongoConfig{
+			URI:           "mongodb://127.0.0.1:27017/?appName=audit",
+			DB:            "audit",
+			Events:        "row_changes",
+			Offsets:       "binlog_offsets",
+			SchemaChanges: "schema_changes",
+			SchemaHistory: "schema_history",
+			Signals:       "snapshot_signals",
+			DeadLetters:   "dead_letters",
+		},
+		Batch:    FlushPolicy{MaxEvents: 100, MaxBytes: 4 << 20, MaxAge: 5 * time.Second},
+		Retry:    RetryPolicy{Attempts: 5, InitialDelay: 100 * time.Millisecond, MaxDelay: 10 * time.Second, SourceMaxDelay: 60 * time.Second},
+		Snapshot: SnapshotConfig{Mode: "never", ChunkSize: 1000, SignalPoll: 5 * time.Second},
+		Staging:  StagingPolicy{Retention: 24 * time.Hour, Interval: 10 * time.Minute, AlertAge: 10 * time.Minute, AlertBytes: 1 << 30, MaxBytes: 8 << 20},
+		Spool:    SpoolConfig{Dir: "spool", MaxBytes: 1 << 30, SegmentBytes: 64 << 20, DrainInterval: 5 * time.Second, MaxAttempts: 10},
+		Values:   LargeValuePolicy{Threshold: 1 << 20, Mode: "summary", Preview: 256},
+	}
 }
 
-func toPK(e *canal.RowsEvent, row []any) any {
-	// single or composite PK
-	if n := len(e.Table.PKColumns); n == 1 {
-		return row[e.Table.PKColumns[0]]
-	} else if n > 1 {
-		parts := make([]string, n)
-		for i, idx := range e.Table.PKColumns {
-			parts[i] = fmt.Sprint(row[idx])
+// loadConfig reads path (if not empty), applies the environment and
+// validates the result
+func loadConfig(path string) (Config, error) {
+	cfg := defaultConfig()
+	if path != "" {
+		md, err := toml.DecodeFile(path, &cfg)
+		if err != nil {
+			return cfg, fmt.Errorf("read %s: %w", path, err)
+		}
+		if keys := md.Undecoded(); len(keys) > 0 {
+			names := make([]string, len(keys))
+			for i, k := range keys {
+				names[i] = k.String()
+			}
+			return cfg, fmt.Errorf("read %s: unknown keys: %s", path, strings.Join(names, ", "))
 		}
-		return strings.Join(parts, "|")
-	}
-	// fallback: first column (shouldn’t happen; we skip no-PK tables)
-	if len(row) > 0 {
-		return row[0]
 	}
-	return nil
-}
 
-func (h *Handler) OnRow(e *canal.RowsEvent) error {
-	if len(e.Table.PKColumns) == 0 {
-		return nil
-	} // skip tables without PK
+	cfg.Timezone = getenv("TZ", cfg.Timezone)
+	cfg.MaskKey = getenv("MASK_HMAC_KEY", cfg.MaskKey)
+	cfg.Mongo.applyEnv()
+	cfg.Batch.applyEnv()
+	cfg.Retry.applyEnv()
+	cfg.Snapshot.applyEnv()
+	cfg.Staging.applyEnv()
+	cfg.Spool.applyEnv()
+	cfg.Values.applyEnv()
 
-	ts := time.Unix(int64(e.Header.Timestamp), 0).UTC()
-	db, tbl := e.Table.Schema, e.Table.Name
+	// MYSQL_SOURCES picks the sources by name (e.g. "orders,billing"),
+	// keeping what the file says about each
+	if list := strings.TrimSpace(os.Getenv("MYSQL_SOURCES")); list != "" {
+		byName := map[string]SourceConfig{}
+		for _, sc := range cfg.Sources {
+			byName[sc.Name] = sc
+		}
+		cfg.Sources = nil
+		for _, name := range strings.Split(list, ",") {
+			name = strings.TrimSpace(name)
+			sc, ok := byName[name]
+			if !ok {
+				sc = SourceConfig{Name: name}
+			}
+			cfg.Sources = append(cfg.Sources, sc)
+		}
+	}
+	if len(cfg.Sources) == 0 {
+		cfg.Sources = []SourceConfig{{}}
+	}
+	var errs []error
+	for i := range cfg.Sources {
+		if err := cfg.Sources[i].applyEnv(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if err := errors.Join(append(errs, cfg.validate())...); err != nil {
+		return cfg, err
+	}
+	return cfg, nil
+}
 
-	// Build column names only for columns that are in the binlog row data
-	// (excludes virtual/generated columns)
-	colNames := make([]string, 0, len(e.Table.Columns))
-	for _, c := range e.Table.Columns {
-		// Only add column names up to the actual row data length
-		// We'll validate against actual row length in the loop
-		colNames = append(colNames, c.Name)
+// validate reports every invalid setting at once and compiles the table
+// rules
+func (cfg *Config) validate() error {
+	var errs []error
+	bad := func(format string, args ...any) {
+		errs = append(errs, fmt.Errorf(format, args...))
 	}
 
-	pkVal := func(row []any) any {
-		if n := len(e.Table.PKColumns); n == 1 {
-			idx := e.Table.PKColumns[0]
-			if idx >= len(row) {
-				return nil // PK column index out of range
-			}
-			return row[idx]
-		} else if n > 1 {
-			parts := make([]string, 0, n)
-			for _, idx := range e.Table.PKColumns {
-				if idx >= len(row) {
-					continue // Skip columns not in row
-				}
-				parts = append(parts, toS(row[idx]))
-			}
-			if len(parts) == 0 {
-				return nil
-			}
-			return strings.Join(parts, "|")
-		}
-		if len(row) > 0 {
-			return row[0]
+	if _, err := time.LoadLocation(cfg.Timezone); err != nil {
+		bad("timezone: %v", err)
+	}
+	m := cfg.Mongo
+	for key, v := range map[string]string{"uri": m.URI, "db": m.DB, "events": m.Events, "offsets": m.Offsets,
+		"schema_changes": m.SchemaChanges, "schema_history": m.SchemaHistory, "signals": m.Signals, "dead_letters": m.DeadLetters} {
+		if v == "" {
+			bad("mongo.%s: must not be empty", key)
 		}
-		return nil
+	}
+	if cfg.Batch.MaxEvents <= 0 {
+		bad("batch.max_events: must be positive, got %d", cfg.Batch.MaxEvents)
+	}
+	if cfg.Batch.MaxBytes < 0 || cfg.Batch.MaxAge < 0 {
+		bad("batch.max_bytes and batch.max_age: must not be negative")
+	}
+	if cfg.Retry.Attempts < 1 {
+		bad("retry.attempts: must be at least 1, got %d", cfg.Retry.Attempts)
+	}
+	if cfg.Retry.InitialDelay <= 0 || cfg.Retry.MaxDelay < cfg.Retry.InitialDelay || cfg.Retry.SourceMaxDelay <= 0 {
+		bad("retry: delays must be positive with max_delay >= initial_delay")
+	}
+	if cfg.Snapshot.Mode != "never" && cfg.Snapshot.Mode != "initial" {
+		bad("snapshot.mode: must be \"never\" or \"initial\", got %q", cfg.Snapshot.Mode)
+	}
+	if cfg.Snapshot.ChunkSize <= 0 || cfg.Snapshot.SignalPoll <= 0 {
+		bad("snapshot.chunk_size and snapshot.signal_poll: must be positive")
+	}
+	if cfg.Staging.Retention < 0 || cfg.Staging.Interval <= 0 {
+		bad("staging: retention must not be negative and prune_interval must be positive")
+	}
+	if cfg.Staging.MaxBytes <= 0 || cfg.Staging.MaxBytes > maxEventBytes {
+		bad("staging.max_bytes: must be between 1 and %d, got %d", maxEventBytes, cfg.Staging.MaxBytes)
+	}
+	if sp := cfg.Spool; sp.Dir != "" && (sp.MaxBytes <= 0 || sp.SegmentBytes <= 0 || sp.DrainInterval <= 0 || sp.MaxAttempts <= 0) {
+		bad("spool: max_bytes, segment_bytes, drain_interval and max_attempts must be positive")
+	}
+	if v := cfg.Values; v.Mode != "summary" && v.Mode != "gridfs" {
+		bad("large_values.mode: must be \"summary\" or \"gridfs\", got %q", v.Mode)
+	} else if v.Threshold < 0 || v.Preview < 0 {
+		bad("large_values.threshold and large_values.preview: must not be negative")
 	}
 
-	addDoc := func(pk any, chg map[string]Delta, op string) error {
-		doc := EventDoc{
-			ID:    makeID(db, tbl, pk, ts, op, h.lastFile, h.lastPos, h.lastGTID),
-			TS:    ts,
-			OP:    op,
-			Meta:  Meta{DB: db, Tbl: tbl, PK: pk},
-			Chg:   chg,
-			Src:   map[string]any{"binlog": map[string]any{"file": h.lastFile, "pos": h.lastPos}, "gtid": h.lastGTID},
-			TSIST: ts.In(h.loc).Format("2006-01-02 15:04:05"),
-		}
-		h.batch = append(h.batch, doc)
-
-		// Update batch position tracking
-		h.batchFile = h.lastFile
-		h.batchPos = uint32(h.lastPos)
-		h.batchGTID = h.lastGTID
-
-		if len(h.batch) >= 100 {
-			if err := h.sink.writeBatchWithGTID(context.Background(), h.batch, h.source, h.batchGTID, h.batchFile, h.batchPos); err != nil {
-				return fmt.Errorf("write batch with GTID: %w", err)
+	// Two sources on one primary would share an offsets row; two on one
+	// server ID would kick each other off as replicas
+	names := map[string]bool{}
+	addrs := map[string]string{}
+	serverIDs := map[uint32]string{}
+	for _, sc := range cfg.Sources {
+		if len(cfg.Sources) > 1 && (sc.Name == "" || names[sc.Name]) {
+			bad("source %q: every source needs a unique name when there are several", sc.Name)
+		}
+		names[sc.Name] = true
+		if sc.Flavor != mysql.MySQLFlavor && sc.Flavor != mysql.MariaDBFlavor {
+			bad("source %q: flavor must be %q or %q, got %q", sc.Name, mysql.MySQLFlavor, mysql.MariaDBFlavor, sc.Flavor)
+		}
+		for _, re := range append(append([]string{}, sc.Include...), sc.Exclude...) {
+			if _, err := regexp.Compile(re); err != nil {
+				bad("source %q: bad table regexp: %v", sc.Name, err)
 			}
-			h.batch = h.batch[:0]
 		}
-		return nil
+		if other, ok := addrs[sc.Addr]; ok {
+			bad("sources %q and %q both capture from %s", other, sc.Name, sc.Addr)
+		}
+		if other, ok := serverIDs[sc.ServerID]; ok {
+			bad("sources %q and %q both use server id %d", other, sc.Name, sc.ServerID)
+		}
+		addrs[sc.Addr] = sc.Name
+		serverIDs[sc.ServerID] = sc.Name
 	}
 
-	switch e.Action {
-	case canal.InsertAction:
-		for _, row := range e.Rows {
-			chg := map[string]Delta{}
-			maxIdx := len(colNames)
-			if len(row) < maxIdx {
-				maxIdx = len(row)
-			}
-			for i := 0; i < maxIdx; i++ {
-				chg[colNames[i]] = Delta{F: nil, T: row[i]}
-			}
-			if err := addDoc(pkVal(row), chg, "i"); err != nil {
-				return fmt.Errorf("insert action: %w", err)
-			}
+	for i := range cfg.Tables {
+		r := &cfg.Tables[i]
+		re, err := regexp.Compile(r.Match)
+		if err != nil {
+			bad("tables[%d]: bad match: %v", i, err)
+			continue
 		}
-	case canal.DeleteAction:
-		for _, row := range e.Rows {
-			chg := map[string]Delta{}
-			maxIdx := len(colNames)
-			if len(row) < maxIdx {
-				maxIdx = len(row)
-			}
-			for i := 0; i < maxIdx; i++ {
-				chg[colNames[i]] = Delta{F: row[i], T: nil}
-			}
-			if err := addDoc(pkVal(row), chg, "d"); err != nil {
-				return fmt.Errorf("delete action: %w", err)
+		r.re = re
+		r.masks = map[string]columnMask{}
+		for col, spec := range r.Mask {
+			m, err := parseMask(spec, []byte(cfg.MaskKey))
+			if err != nil {
+				bad("tables[%d] (%s): mask %s: %v", i, r.Match, col, err)
 			}
+			r.masks[strings.ToLower(col)] = m
 		}
-	case canal.UpdateAction:
-		for i := 0; i < len(e.Rows); i += 2 {
-			before, after := e.Rows[i], e.Rows[i+1]
-			chg := map[string]Delta{}
-			maxIdx := len(colNames)
-			if len(before) < maxIdx {
-				maxIdx = len(before)
-			}
-			if len(after) < maxIdx {
-				maxIdx = len(after)
-			}
-			for c := 0; c < maxIdx; c++ {
-				if !reflect.DeepEqual(before[c], after[c]) {
-					chg[colNames[c]] = Delta{F: before[c], T: after[c]}
-				}
-			}
-			if err := addDoc(pkVal(after), chg, "u"); err != nil {
-				return fmt.Errorf("update action: %w", err)
-			}
+		if r.IgnoredUpdate != "" && r.IgnoredUpdate != "skip" && r.IgnoredUpdate != "touch" {
+			bad("tables[%d] (%s): ignored_update must be \"skip\" or \"touch\", got %q", i, r.Match, r.IgnoredUpdate)
+		}
+		if r.Collection == "" && len(r.Mask) == 0 && len(r.Columns) == 0 && len(r.IgnoreColumns) == 0 && r.IgnoredUpdate == "" {
+			bad("tables[%d] (%s): sets nothing", i, r.Match)
 		}
 	}
-	return nil
+	return errors.Join(errs...)
 }
 
-func (h *Handler) OnPosSynced(
-	header *replication.EventHeader,
-	pos mysql.Position,
-	set mysql.GTIDSet,
-	force bool,
-) error {
-	h.lastFile = pos.Name
-	h.lastPos = uint64(pos.Pos)
-
-	// GTIDSet can be nil early on. Use lastGTID (from OnGTID) or empty string.
-	if set != nil {
-		h.lastGTID = set.String()
-	}
-	// Note: GTID is now saved atomically with batch write in writeBatchWithGTID
-	return nil
+// captureOptions are the settings shared by all sources
+type captureOptions struct {
+	Loc      *time.Location
+	Flush    FlushPolicy
+	Snapshot SnapshotConfig
+	Staging  StagingPolicy
+	Retry    RetryPolicy
 }
 
-func (h *Handler) OnRotate(header *replication.EventHeader, ev *replication.RotateEvent) error {
-	h.lastFile = string(ev.NextLogName)
-	h.lastPos = ev.Position
-	return nil
+// sourceRun is the reloadable configuration of one running source
+type sourceRun struct {
+	mu      sync.Mutex
+	cfg     SourceConfig
+	restart chan struct{} // closed when cfg changed under the running canal
 }
 
-func (h *Handler) OnTableChanged(header *replication.EventHeader, schema, table string) error {
-	key := fmt.Sprintf("%s.%s", schema, table)
-	delete(h.tableSchemas, key)
-	log.Printf("Schema change detected: %s - flushing batch for safety", key)
-	// Flush current batch to ensure consistency
-	if err := h.Flush(context.Background()); err != nil {
-		log.Printf("Error flushing on schema change: %v", err)
-		// Don't stop replication, just warn
-	}
-	return nil
+func newSourceRun(sc SourceConfig) *sourceRun {
+	return &sourceRun{cfg: sc, restart: make(chan struct{})}
 }
 
-func (h *Handler) OnXID(header *replication.EventHeader, nextPos mysql.Position) error { return nil }
+// current returns the configuration to start a canal with and the channel
+// closed when it is replaced
+func (r *sourceRun) current() (SourceConfig, <-chan struct{}) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.cfg, r.restart
+}
 
-func (h *Handler) OnGTID(header *replication.EventHeader, ev mysql.BinlogGTIDEvent) error {
-	// Store a readable snapshot; BinlogGTIDEvent has no String()
-	h.lastGTID = fmt.Sprintf("%+v", ev)
-	return nil
+// setFilters applies new table filters; canal cannot change them in place,
+// so it reports whether the source has to restart its canal
+func (r *sourceRun) setFilters(include, exclude []string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if reflect.DeepEqual(include, r.cfg.Include) && reflect.DeepEqual(exclude, r.cfg.Exclude) {
+		return false
+	}
+	r.cfg.Include, r.cfg.Exclude = include, exclude
+	close(r.restart)
+	r.restart = make(chan struct{})
+	return true
 }
 
-// func (h *Handler) OnRowGTID(mysql.GTIDSet) error              { return nil }
+// runCanalWithRetry captures one source until ctx is done. Any failure
+// (protocol error, MySQL or MongoDB outage, bad DDL) only restarts this
+// source: a fresh canal resumes from the saved offset after a backoff of
+// 2s, 4s, ... capped at retry.source_max_delay, while other sources keep
+// running. A reload of its table filters restarts it right away.
+func runCanalWithRetry(ctx context.Context, run *sourceRun, sink *MongoSink, opts captureOptions) {
+	src, _ := run.current()
+	source := src.ID()
+	go sink.RunStagingPruner(ctx, source, opts.Staging)
 
-func getenv(k, def string) string {
-	if v := os.Getenv(k); v != "" {
-		return v
+	// Recover any pending batches from previous crash
+	if report, err := sink.RecoverPendingBatches(ctx, source, src.Flavor); err != nil {
+		log.Printf("[%s] Warning: Could not recover pending batches: %v", source, err)
+		// Don't fail startup, continue with replication
+	} else if report.Batches > 0 {
+		log.Printf("[%s] Recovered %d pending batches: %d events, %d re-inserted, offset advanced to %q",
+			source, report.Batches, report.Events, report.Inserted, report.Offset)
 	}
-	return def
-}
 
-// runCanalWithRetry runs Canal with automatic reconnection on protocol errors
-func runCanalWithRetry(c *canal.Canal, sink *MongoSink, source string, maxRetries int) error {
-	var lastErr error
 	baseDelay := 2 * time.Second
-
-	for attempt := 0; attempt < maxRetries; attempt++ {
-		if attempt > 0 {
-			delay := time.Duration(1<<uint(attempt-1)) * baseDelay
-			if delay > 60*time.Second {
-				delay = 60 * time.Second
-			}
-			log.Printf("Canal retry attempt %d/%d after %v (previous error: %v)", attempt+1, maxRetries, delay, lastErr)
-			time.Sleep(delay)
+	delay := baseDelay
+	for attempt := 1; ; attempt++ {
+		started := time.Now()
+		src, restart := run.current()
+		err := runCanal(ctx, src, restart, sink, opts)
+		if ctx.Err() != nil {
+			return
+		}
+		select {
+		case <-restart:
+			log.Printf("[%s] Restarting capture with include %q, exclude %q", source, src.Include, src.Exclude)
+			continue
+		default:
+		}
+		if errors.Is(err, errRowImage) {
+			log.Fatalf("[%s] Capture stopped: %v", source, err)
+		}
+		if time.Since(started) > 10*time.Minute {
+			delay = baseDelay // it was healthy for a while; start backing off afresh
+		}
+		log.Printf("[%s] Capture stopped (attempt %d): %v; restarting in %v", source, attempt, err, delay)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(delay):
+		}
+		delay *= 2
+		if delay > opts.Retry.SourceMaxDelay {
+			delay = opts.Retry.SourceMaxDelay
 		}
+	}
+}
+
+// runCanal runs one canal for src until it fails, ctx is done or restart is
+// closed, then flushes the committed transactions it still holds. A canal
+// cannot be restarted once closed, so every attempt builds a new one.
+func runCanal(ctx context.Context, src SourceConfig, restart <-chan struct{}, sink *MongoSink, opts captureOptions) error {
+	source := src.ID()
+	cfg := src.canalConfig()
+	c, err := canal.NewCanal(cfg)
+	if err != nil {
+		return fmt.Errorf("create canal: %w", err)
+	}
 
-		// Load position from MongoDB
-		gtidStr, ok, err := sink.loadGTID(context.Background(), source)
+	h := &Handler{
+		sink:           sink,
+		source:         source,
+		loc:            opts.Loc,
+		policy:         opts.Flush,
+		tableSchemas:   make(map[string][]string),
+		schemaVersions: make(map[string]int),
+		identities:     make(map[string]rowIdentity),
+		txTouched:      make(map[string]struct{}),
+		rules:          sink.tableRules(),
+		getTable:       c.GetTable,
+		execute:        c.Execute,
+	}
+	c.SetEventHandler(h)
+	if hookErr := markAbsentColumns(c); hookErr != nil {
+		image, err := binlogRowImage(c)
+		if err == nil {
+			err = checkRowImage(image, hookErr)
+		}
 		if err != nil {
-			log.Printf("Warning: Could not load GTID from MongoDB: %v", err)
+			c.Close()
+			return err
 		}
+		log.Printf("[%s] Warning: cannot read row image bitmaps, binlog_row_image is FULL: %v", source, hookErr)
+	}
 
-		// Start Canal from saved position or master's current position
-		if ok && gtidStr != "" {
-			gtidSet, err := mysql.ParseGTIDSet(mysql.MySQLFlavor, gtidStr)
-			if err != nil {
-				log.Printf("Warning: Could not parse saved GTID '%s': %v, falling back to master position", gtidStr, err)
-				ok = false
-			} else {
-				log.Printf("Resuming from saved GTID: %s (attempt %d/%d)", gtidStr, attempt+1, maxRetries)
-				if err := c.StartFromGTID(gtidSet); err != nil {
-					lastErr = fmt.Errorf("start from GTID: %w", err)
-					continue
-				}
-			}
+	// Time-based flushing so low-traffic sources still land in MongoDB
+	runCtx, stopRun := context.WithCancel(ctx)
+	go h.RunFlushTicker(runCtx)
+	go func() {
+		select {
+		case <-runCtx.Done():
+		case <-restart:
+			// The open transaction is dropped and replayed from the offset
+			// saved with the last flushed one
 		}
-
-		if !ok || gtidStr == "" {
-			// No saved GTID, start from master's current position
-			gset, err := c.GetMasterGTIDSet()
-			if err != nil {
-				lastErr = fmt.Errorf("get master GTID: %w", err)
-				continue
-			}
-			log.Printf("Starting from master's GTID set: %s (attempt %d/%d)", gset.String(), attempt+1, maxRetries)
-			if err := c.StartFromGTID(gset); err != nil {
-				lastErr = fmt.Errorf("start from master GTID: %w", err)
-				continue
-			}
+		c.Close()
+	}()
+	defer func() {
+		stopRun()
+		flushCtx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+		if err := h.Flush(flushCtx); err != nil {
+			log.Printf("[%s] Error flushing batch: %v", source, err)
 		}
+	}()
 
-		// Run Canal - this blocks until error or stopped
-		log.Printf("Canal running (attempt %d/%d)...", attempt+1, maxRetries)
-		err = c.Run()
+	if err := reportKeylessTables(c, h); err != nil {
+		log.Printf("[%s] Warning: %v", source, err)
+	}
 
-		if err == nil {
-			return nil // Normal shutdown
-		}
+	// Sequence numbers continue from the last one stored or spooled
+	seq, err := sink.resumeSeq(runCtx, source)
+	if err != nil {
+		return fmt.Errorf("load sequence: %w", err)
+	}
+	h.mu.Lock()
+	h.seq = seq
+	h.mu.Unlock()
 
-		lastErr = err
-		errStr := err.Error()
-
-		// Check for recoverable protocol errors
-		isRecoverable := strings.Contains(errStr, "invalid sequence") ||
-			strings.Contains(errStr, "connection refused") ||
-			strings.Contains(errStr, "connection reset") ||
-			strings.Contains(errStr, "broken pipe") ||
-			strings.Contains(errStr, "EOF") ||
-			strings.Contains(errStr, "i/o timeout")
-
-		if !isRecoverable {
-			log.Printf("Non-recoverable Canal error: %v", err)
-			return err
+	// Bootstrap audit history on a fresh deployment
+	if opts.Snapshot.Mode == "initial" {
+		if _, ok, err := sink.loadGTID(runCtx, source); err != nil {
+			return fmt.Errorf("check saved offset before snapshot: %w", err)
+		} else if !ok {
+			log.Printf("[%s] No saved offset, taking initial snapshot", source)
+			if err := runInitialSnapshot(runCtx, c, cfg, h, opts.Snapshot.ChunkSize); err != nil {
+				return fmt.Errorf("initial snapshot: %w", err)
+			}
 		}
+	}
 
-		log.Printf("Recoverable Canal error detected: %v", err)
+	// Load position from the spool or MongoDB; never fall back to the
+	// master position just because MongoDB is down
+	gtidStr, ok, err := sink.resumeGTID(runCtx, source)
+	if err != nil {
+		return fmt.Errorf("load GTID: %w", err)
+	}
+	var gset mysql.GTIDSet
+	if ok {
+		if gset, err = mysql.ParseGTIDSet(src.Flavor, gtidStr); err != nil {
+			log.Printf("[%s] Warning: Could not parse saved GTID '%s': %v, falling back to master position", source, gtidStr, err)
+			ok = false
+		} else {
+			log.Printf("[%s] Resuming from saved GTID: %s", source, gtidStr)
+		}
+	}
+	if !ok {
+		// No saved GTID, start from master's current position
+		if gset, err = c.GetMasterGTIDSet(); err != nil {
+			return fmt.Errorf("get master GTID: %w", err)
+		}
+		log.Printf("[%s] Starting from master's GTID set: %s", source, gset.String())
+	}
 
-		// Close the Canal instance to reset connection
-		log.Println("Closing Canal connection for reconnection...")
-		c.Close()
+	// Seed the batch offset so a flush before the first streamed commit
+	// (an incremental snapshot chunk) keeps the resume position
+	h.mu.Lock()
+	h.batchGTID = gset.String()
+	h.mu.Unlock()
+	go RunSignalWatcher(runCtx, c, h, opts.Snapshot)
 
-		// Brief pause before retry
-		time.Sleep(1 * time.Second)
+	// Blocks until an error or c.Close()
+	err = c.StartFromGTID(gset)
+	if runCtx.Err() != nil {
+		return nil
 	}
+	if err == nil {
+		err = errors.New("canal stopped")
+	}
+	return err
+}
 
-	log.Printf("Max Canal retries (%d) exceeded, last error: %v", maxRetries, lastErr)
-	return fmt.Errorf("canal retry exhausted after %d attempts: %w", maxRetries, lastErr)
+// dotEnv loads .env without overriding the process environment, and again
+// on SIGHUP, dropping variables that were removed from the file
+type dotEnv struct {
+	path   string
+	proc   map[string]bool // set before .env was read; these always win
+	loaded map[string]bool // set from .env
 }
 
-func main() {
-	// Load .env (absolute path is safest under systemd)
-	_ = godotenv.Load(".env")
+func newDotEnv(path string) *dotEnv {
+	d := &dotEnv{path: path, proc: map[string]bool{}, loaded: map[string]bool{}}
+	for _, kv := range os.Environ() {
+		k, _, _ := strings.Cut(kv, "=")
+		d.proc[k] = true
+	}
+	return d
+}
 
-	// Timezone (server should already be IST; this just ensures conversion)
-	loc, _ := time.LoadLocation(getenv("TZ", "Asia/Kolkata"))
+func (d *dotEnv) load() error {
+	vars, err := godotenv.Read(d.path)
+	if err != nil {
+		return err
+	}
+	for k := range d.loaded {
+		if _, ok := vars[k]; !ok {
+			os.Unsetenv(k)
+			delete(d.loaded, k)
+		}
+	}
+	for k, v := range vars {
+		if !d.proc[k] {
+			os.Setenv(k, v)
+			d.loaded[k] = true
+		}
+	}
+	return nil
+}
 
-	// Mongo
-	mongoURI := getenv("MONGO_URI", "mongodb://127.0.0.1:27017/?appName=audit")
-	mongoDB := getenv("MONGO_DB", "audit")
-	mongoColl := getenv("MONGO_COLL", "row_changes")
-	offsetsColl := getenv("MONGO_OFFSETS_COLL", "binlog_offsets")
-	sink, err := newMongoSink(mongoURI, mongoDB, mongoColl, offsetsColl, loc)
+// reloadConfig re-reads the configuration on SIGHUP and applies what can
+// change while running: the table filters of each source and the table
+// rules. An invalid configuration is rejected as a whole.
+func reloadConfig(path string, env *dotEnv, cur *Config, runs map[string]*sourceRun, sink *MongoSink) {
+	if err := env.load(); err != nil && !errors.Is(err, os.ErrNotExist) {
+		log.Printf("Reload: read %s: %v", env.path, err)
+	}
+	next, err := loadConfig(path)
 	if err != nil {
-		log.Fatal(err)
+		log.Printf("Reload rejected, keeping the current configuration:\n%v", err)
+		return
 	}
 
-	// Canal config
-	cfg := canal.NewDefaultConfig()
-	cfg.Addr = getenv("MYSQL_ADDR", "127.0.0.1:3306")
-	cfg.User = getenv("MYSQL_USER", "repl")
-	cfg.Password = os.Getenv("MYSQL_PASS")
-	cfg.Flavor = getenv("MYSQL_FLAVOR", "mysql")
+	// Everything else needs a restart; say so instead of half-applying it
+	fixed := func(c Config) Config {
+		c.Tables, c.MaskKey = nil, ""
+		c.Sources = append([]SourceConfig(nil), c.Sources...)
+		for i := range c.Sources {
+			c.Sources[i].Include, c.Sources[i].Exclude = nil, nil
+		}
+		return c
+	}
+	if !reflect.DeepEqual(fixed(next), fixed(*cur)) {
+		log.Println("Reload: only table filters, [[tables]] rules and mask_key are applied; other changes need a restart")
+	}
 
-	// unique server id
-	if sid := getenv("MYSQL_SERVER_ID", "2222"); sid != "" {
-		if n, err := strconv.Atoi(sid); err == nil {
-			cfg.ServerID = uint32(n)
+	sink.setRules(next.Tables)
+	cur.Tables, cur.MaskKey = next.Tables, next.MaskKey
+	for _, sc := range next.Sources {
+		run, ok := runs[sc.ID()]
+		if !ok {
+			continue
+		}
+		if run.setFilters(sc.Include, sc.Exclude) {
+			log.Printf("[%s] Reload: table filters changed, restarting capture after the last committed transaction", sc.ID())
+		}
+		for i := range cur.Sources {
+			if cur.Sources[i].ID() == sc.ID() {
+				cur.Sources[i].Include, cur.Sources[i].Exclude = sc.Include, sc.Exclude
+			}
 		}
 	}
+	log.Printf("Reload: applied %d table rules", len(next.Tables))
+}
+
+func main() {
+	// Load .env (absolute path is safest under systemd)
+	env := newDotEnv(".env")
+	_ = env.load()
 
-	// include everything; exclude system schemas
-	inc := getenv("INCLUDE_REGEX", ".*\\..*")
-	exc := getenv("EXCLUDE_REGEX", "^(mysql|performance_schema|information_schema|sys)\\..*")
-	cfg.IncludeTableRegex = []string{inc}
-	cfg.ExcludeTableRegex = []string{exc}
+	configPath := flag.String("config", os.Getenv("SDL_CONFIG"), "TOML config file (env vars override its keys)")
+	retryDead := flag.Bool("retry-dead-letters", false, "write pending dead letters again and exit")
+	flag.Parse()
+	cfg, err := loadConfig(*configPath)
+	if err != nil {
+		log.Fatalf("Invalid configuration:\n%v", err)
+	}
 
-	// No initial dump (start streaming). You can enable dump if you want a snapshot.
-	cfg.Dump.ExecutionPath = "" // no mysqldump
+	// Timezone (server should already be IST; this just ensures conversion)
+	loc, _ := time.LoadLocation(cfg.Timezone)
 
-	c, err := canal.NewCanal(cfg)
+	sink, err := newMongoSink(cfg.Mongo, cfg.Retry, cfg.Tables, loc)
 	if err != nil {
 		log.Fatal(err)
 	}
+	if cfg.Spool.Dir != "" {
+		if sink.spool, err = openSpool(cfg.Spool); err != nil {
+			log.Fatalf("Open spool: %v", err)
+		}
+	}
+	sink.values = cfg.Values
+	sink.stagingBytes = cfg.Staging.MaxBytes
+	if cfg.Values.Mode == "gridfs" {
+		bucket := options.GridFSBucket().SetName(cfg.Mongo.Events + "_values")
+		if sink.valueFiles, err = gridfs.NewBucket(sink.events.Database(), bucket); err != nil {
+			log.Fatalf("Open values bucket: %v", err)
+		}
+	}
 
-	h := &Handler{
-		sink:         sink,
-		source:       "mysql://" + cfg.Addr,
-		loc:          loc,
-		tableSchemas: make(map[string][]string),
+	if *retryDead {
+		report, err := sink.retryDeadLetters(context.Background())
+		log.Printf("Dead letters: %d retried (%d inserted), %d rejected again, %d without event",
+			report.Retried, report.Inserted, report.Failed, report.Skipped)
+		_ = sink.client.Disconnect(context.Background())
+		if err != nil {
+			log.Fatalf("Retry dead letters: %v", err)
+		}
+		return
+	}
+
+	opts := captureOptions{
+		Loc:      loc,
+		Flush:    cfg.Batch,
+		Snapshot: cfg.Snapshot,
+		Staging:  cfg.Staging,
+		Retry:    cfg.Retry,
 	}
-	c.SetEventHandler(h)
 
 	// Setup signal handling for graceful shutdown
 	sigChan := make(chan os.Signal, 1)
-	signal.Notify(sigChan, syscall.SIGTERM, syscall.SIGINT)
+	signal.Notify(sigChan, syscall.SIGTERM, syscall.SIGINT, syscall.SIGHUP)
 
-	// Run canal in goroutine so we can listen for signals
-	errChan := make(chan error, 1)
-	go func() {
-		// Recover any pending batches from previous crash
-		if err := sink.RecoverPendingBatches(context.Background()); err != nil {
-			log.Printf("Warning: Could not recover pending batches: %v", err)
-			// Don't fail startup, continue with replication
-		}
+	// One goroutine per source; a failing source is restarted on its own
+	runCtx, stopRun := context.WithCancel(context.Background())
+	go sink.RunSpoolDrainer(runCtx, cfg.Spool)
+	var wg sync.WaitGroup
+	runs := map[string]*sourceRun{}
+	for _, src := range cfg.Sources {
+		log.Printf("Capturing from %s (server id %d, include %q, exclude %q)", src.ID(), src.ServerID, src.Include, src.Exclude)
+		run := newSourceRun(src)
+		runs[src.ID()] = run
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			runCanalWithRetry(runCtx, run, sink, opts)
+		}()
+	}
 
-		// Run Canal with automatic retry on protocol errors
-		// Max 10 retries with exponential backoff (2s, 4s, 8s, 16s, 32s, 60s...)
-		if err := runCanalWithRetry(c, sink, h.source, 10); err != nil {
-			errChan <- err
-			return
-		}
-	}()
+	sig := <-sigChan
+	for sig == syscall.SIGHUP {
+		log.Println("Received SIGHUP, reloading configuration")
+		reloadConfig(*configPath, env, &cfg, runs, sink)
+		sig = <-sigChan
+	}
+	log.Printf("Received signal: %v", sig)
+	log.Println("Initiating graceful shutdown...")
 
-	// Wait for signal or error
+	// Stop every canal and flush its remaining batch
+	stopRun()
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
 	select {
-	case sig := <-sigChan:
-		log.Printf("Received signal: %v", sig)
-		log.Println("Initiating graceful shutdown...")
-
-		// Stop canal from accepting new events
-		c.Close()
-
-		// Flush remaining batch
-		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
-		if err := h.Flush(ctx); err != nil {
-			log.Printf("Error flushing batch during shutdown: %v", err)
-		}
-		cancel()
-
-		// Close MongoDB client
-		if err := sink.client.Disconnect(context.Background()); err != nil {
-			log.Printf("Error closing MongoDB: %v", err)
+	case <-done:
+	case <-time.After(30 * time.Second):
+		log.Println("Timed out waiting for sources to flush")
+	}
+	if sink.spool != nil {
+		if err := sink.spool.Close(); err != nil {
+			log.Printf("Error closing spool: %v", err)
 		}
+	}
 
-		log.Println("Shutdown complete")
-		os.Exit(0)
-
-	case err := <-errChan:
-		log.Fatalf("Canal error: %v", err)
+	// Close MongoDB client
+	if err := sink.client.Disconnect(context.Background()); err != nil {
+		log.Printf("Error closing MongoDB: %v", err)
 	}
+
+	log.Println("Shutdown complete")
+	os.Exit(0)
 }
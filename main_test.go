@@ -0,0 +1,2318 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf8"
+	"unsafe"
+
+	"github.com/go-mysql-org/go-mysql/canal"
+	"github.com/go-mysql-org/go-mysql/mysql"
+	"github.com/go-mysql-org/go-mysql/replication"
+	"github.com/go-mysql-org/go-mysql/schema"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// newTestHandler returns a handler with no MongoDB behind it, for tests that
+// stay clear of flushes
+func newTestHandler() *Handler {
+	return &Handler{
+		sink:           &MongoSink{},
+		source:         "test",
+		loc:            time.UTC,
+		tableSchemas:   make(map[string][]string),
+		schemaVersions: make(map[string]int),
+		identities:     make(map[string]rowIdentity),
+		txTouched:      make(map[string]struct{}),
+	}
+}
+
+// testSink connects to the MongoDB replica set in SDL_TEST_MONGO_URI, using
+// a database of its own that is dropped afterwards; the test is skipped
+// when the variable is not set
+func testSink(t *testing.T) *MongoSink {
+	t.Helper()
+	uri := os.Getenv("SDL_TEST_MONGO_URI")
+	if uri == "" {
+		t.Skip("SDL_TEST_MONGO_URI not set")
+	}
+	cfg := defaultConfig()
+	cfg.Mongo.URI = uri
+	cfg.Mongo.DB = fmt.Sprintf("sdl_test_%d", time.Now().UnixNano())
+	retry := RetryPolicy{Attempts: 2, InitialDelay: 10 * time.Millisecond, MaxDelay: 50 * time.Millisecond}
+	s, err := newMongoSink(cfg.Mongo, retry, nil, time.UTC)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = s.events.Database().Drop(context.Background())
+		_ = s.client.Disconnect(context.Background())
+	})
+	return s
+}
+
+// testTable returns shop.orders (id BIGINT PRIMARY KEY, status VARCHAR,
+// note TEXT) and registers it with h at schema version 1 when h is set
+func testTable(h *Handler) *schema.Table {
+	t := &schema.Table{
+		Schema: "shop",
+		Name:   "orders",
+		Columns: []schema.TableColumn{
+			{Name: "id", Type: schema.TYPE_NUMBER},
+			{Name: "status", Type: schema.TYPE_STRING, Collation: "utf8mb4_general_ci"},
+			{Name: "note", Type: schema.TYPE_STRING, Collation: "utf8mb4_general_ci"},
+		},
+		PKColumns: []int{0},
+	}
+	if h != nil {
+		h.schemaVersions["shop.orders"] = 1
+		h.identities["shop.orders"] = tableIdentity(t, nil)
+	}
+	return t
+}
+
+// rowsEvent builds a rows event of t ending at pos
+func rowsEvent(t *schema.Table, action string, pos uint32, rows ...[]any) *canal.RowsEvent {
+	return &canal.RowsEvent{
+		Table:  t,
+		Action: action,
+		Rows:   rows,
+		Header: &replication.EventHeader{Timestamp: 1700000000, LogPos: pos, EventSize: 40},
+	}
+}
+
+func TestShouldFlushLocked(t *testing.T) {
+	tests := []struct {
+		name   string
+		policy FlushPolicy
+		events int
+		bytes  int
+		want   bool
+	}{
+		{"no limits", FlushPolicy{}, 1000, 1 << 20, false},
+		{"below event limit", FlushPolicy{MaxEvents: 10}, 9, 0, false},
+		{"at event limit", FlushPolicy{MaxEvents: 10}, 10, 0, true},
+		{"below byte limit", FlushPolicy{MaxBytes: 100}, 1, 99, false},
+		{"at byte limit", FlushPolicy{MaxBytes: 100}, 1, 100, true},
+		{"either limit", FlushPolicy{MaxEvents: 10, MaxBytes: 100}, 2, 150, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := newTestHandler()
+			h.policy = tt.policy
+			h.batch = make([]EventDoc, tt.events)
+			h.batchBytes = tt.bytes
+			if got := h.shouldFlushLocked(); got != tt.want {
+				t.Errorf("shouldFlushLocked() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestOnRotate(t *testing.T) {
+	h := newTestHandler()
+	ev := &replication.RotateEvent{NextLogName: []byte("mysql-bin.000002"), Position: 4}
+	if err := h.OnRotate(&replication.EventHeader{}, ev); err != nil {
+		t.Fatal(err)
+	}
+	if h.lastFile != "mysql-bin.000002" || h.lastPos != 4 {
+		t.Errorf("position = %s:%d, want mysql-bin.000002:4", h.lastFile, h.lastPos)
+	}
+}
+
+// A MyISAM transaction is GTID, QUERY BEGIN, rows, QUERY COMMIT: no XID
+func TestQueryCommitEndsTransaction(t *testing.T) {
+	h := newTestHandler()
+	tbl := testTable(h)
+	query := &replication.EventHeader{EventType: replication.QUERY_EVENT}
+
+	if err := h.OnPosSynced(query, mysql.Position{Name: "mysql-bin.000001", Pos: 200}, nil, false); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.OnRow(rowsEvent(tbl, canal.InsertAction, 300, []any{int64(1), "open", nil})); err != nil {
+		t.Fatal(err)
+	}
+	if len(h.batch) != 0 {
+		t.Fatalf("rows reached the batch before COMMIT")
+	}
+	if err := h.OnPosSynced(query, mysql.Position{Name: "mysql-bin.000001", Pos: 400}, nil, false); err != nil {
+		t.Fatal(err)
+	}
+	if len(h.batch) != 1 || len(h.tx) != 0 {
+		t.Fatalf("batch = %d events, tx = %d events; want 1 and 0", len(h.batch), len(h.tx))
+	}
+	if h.batchFile != "mysql-bin.000001" || h.batchPos != 400 {
+		t.Errorf("batch offset = %s:%d, want mysql-bin.000001:400", h.batchFile, h.batchPos)
+	}
+
+	// A DDL query with nothing buffered commits nothing
+	if err := h.OnPosSynced(query, mysql.Position{Name: "mysql-bin.000001", Pos: 500}, nil, true); err != nil {
+		t.Fatal(err)
+	}
+	if len(h.batch) != 1 || h.batchPos != 400 {
+		t.Errorf("empty COMMIT moved the batch: %d events at %d", len(h.batch), h.batchPos)
+	}
+}
+
+func TestTransactionGTID(t *testing.T) {
+	sid := []byte{0x3e, 0x11, 0xfa, 0x47, 0x71, 0xca, 0x11, 0xe1, 0x9e, 0x33, 0xc8, 0x0a, 0xa9, 0x42, 0x95, 0x62}
+	tests := []struct {
+		name string
+		ev   mysql.BinlogGTIDEvent
+		want string
+	}{
+		{"mysql", &replication.GTIDEvent{SID: sid, GNO: 23}, "3e11fa47-71ca-11e1-9e33-c80aa9429562:23"},
+		{"mysql tagged", &replication.GTIDEvent{SID: sid, GNO: 7, Tag: "batch"}, "3e11fa47-71ca-11e1-9e33-c80aa9429562:batch:7"},
+		{"mariadb", &replication.MariadbGTIDEvent{GTID: mysql.MariadbGTID{DomainID: 0, ServerID: 1, SequenceNumber: 42}}, "0-1-42"},
+		{"short sid", &replication.GTIDEvent{SID: sid[:4], GNO: 1}, ""},
+		{"anonymous", &replication.GTIDEvent{SID: make([]byte, 16), GNO: 0}, ""},
+		{"zero sid", &replication.GTIDEvent{SID: make([]byte, 16), GNO: 5}, ""},
+		{"gno 0", &replication.GTIDEvent{SID: sid, GNO: 0}, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := transactionGTID(tt.ev); got != tt.want {
+				t.Errorf("transactionGTID() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+// Without GTIDs every transaction has an anonymous GTID event; event IDs
+// must then come from the transaction's binlog position
+func TestAnonymousGTIDEventIDs(t *testing.T) {
+	h := newTestHandler()
+	tbl := testTable(h)
+	seen := map[string]bool{}
+	for _, pos := range []uint32{300, 600} {
+		gtid := &replication.EventHeader{LogPos: pos - 50, EventSize: 65}
+		if err := h.OnGTID(gtid, &replication.GTIDEvent{SID: make([]byte, 16)}); err != nil {
+			t.Fatal(err)
+		}
+		if err := h.OnRow(rowsEvent(tbl, canal.InsertAction, pos, []any{int64(1), "open", nil})); err != nil {
+			t.Fatal(err)
+		}
+		id := h.tx[0].ID
+		if seen[id] {
+			t.Errorf("transaction at %d reuses event ID %s", pos, id)
+		}
+		seen[id] = true
+		if err := h.OnXID(&replication.EventHeader{}, mysql.Position{Name: "mysql-bin.000001", Pos: pos + 30}); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestOnTableChangedFilters(t *testing.T) {
+	h := newTestHandler()
+	h.getTable = func(db, table string) (*schema.Table, error) {
+		switch db + "." + table {
+		case "shop.orders":
+			return testTable(nil), nil
+		case "shop.gone":
+			return nil, schema.ErrTableNotExist
+		}
+		return nil, canal.ErrExcludedTable
+	}
+	tests := []struct {
+		db, table string
+		recorded  bool
+	}{
+		{"shop", "orders", true},
+		{"shop", "gone", true}, // dropped tables are still recorded
+		{"shop", "tmp_import", false},
+		{"mysql", "user", false},
+		{"PERFORMANCE_SCHEMA", "threads", false},
+	}
+	for _, tt := range tests {
+		h.pendingDDL = nil
+		if err := h.OnTableChanged(&replication.EventHeader{}, tt.db, tt.table); err != nil {
+			t.Fatal(err)
+		}
+		if got := len(h.pendingDDL) == 1; got != tt.recorded {
+			t.Errorf("%s.%s recorded = %v, want %v", tt.db, tt.table, got, tt.recorded)
+		}
+	}
+}
+
+func TestEventsCarrySchemaVersion(t *testing.T) {
+	h := newTestHandler()
+	tbl := testTable(h)
+	h.schemaVersions["shop.orders"] = 3
+	if err := h.OnRow(rowsEvent(tbl, canal.InsertAction, 300, []any{int64(1), "open", nil})); err != nil {
+		t.Fatal(err)
+	}
+	if got := h.tx[0].SchemaVer; got != 3 {
+		t.Errorf("SchemaVer = %d, want 3", got)
+	}
+}
+
+func TestEventsCarrySource(t *testing.T) {
+	ids := map[string]string{}
+	for _, source := range []string{"mysql://db1:3306", "mysql://db2:3306"} {
+		h := newTestHandler()
+		h.source = source
+		tbl := testTable(h)
+		if err := h.OnRow(rowsEvent(tbl, canal.InsertAction, 300, []any{int64(1), "open", nil})); err != nil {
+			t.Fatal(err)
+		}
+		if got := h.tx[0].Source; got != source {
+			t.Errorf("Source = %q, want %q", got, source)
+		}
+		ids[h.tx[0].ID] = source
+	}
+	if len(ids) != 2 {
+		t.Errorf("the same row change from two sources got one _id: %v", ids)
+	}
+}
+
+func TestRegisterSchemaVersions(t *testing.T) {
+	s := testSink(t)
+	ctx := context.Background()
+	v1 := []SchemaColumn{{Name: "id", Type: "bigint", PK: true}, {Name: "status", Type: "varchar(16)"}}
+	v2 := append(v1, SchemaColumn{Name: "note", Type: "text", Nullable: true})
+
+	steps := []struct {
+		source string
+		cols   []SchemaColumn
+		want   int
+	}{
+		{"a", v1, 1},
+		{"a", v1, 1}, // unchanged definition keeps its version
+		{"a", v2, 2},
+		{"b", v2, 1}, // versions are per source
+	}
+	for i, st := range steps {
+		got, err := s.registerSchema(ctx, st.source, "shop", "orders", st.cols)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != st.want {
+			t.Errorf("step %d: version = %d, want %d", i, got, st.want)
+		}
+	}
+}
+
+func TestChunkQuery(t *testing.T) {
+	keyed := testTable(nil)
+	keyless := testTable(nil)
+	keyless.PKColumns = nil
+	tests := []struct {
+		name   string
+		t      *schema.Table
+		last   []any
+		offset int
+		want   string
+		args   int
+	}{
+		{"first chunk", keyed, nil, 0, "SELECT `id`, `status`, `note` FROM `shop`.`orders` ORDER BY `id` LIMIT 10", 0},
+		{"resume after key", keyed, []any{int64(42)}, 20, "SELECT `id`, `status`, `note` FROM `shop`.`orders` WHERE (`id`) > (?) ORDER BY `id` LIMIT 10", 1},
+		{"keyless pages by offset", keyless, nil, 20, "SELECT `id`, `status`, `note` FROM `shop`.`orders` LIMIT 10 OFFSET 20", 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q, args := chunkQuery(tt.t, 10, tt.last, tt.offset)
+			if q != tt.want || len(args) != tt.args {
+				t.Errorf("chunkQuery() = %q, %v\nwant %q with %d args", q, args, tt.want, tt.args)
+			}
+		})
+	}
+}
+
+func TestResumeTable(t *testing.T) {
+	keyed := testTable(nil)
+	keyless := testTable(nil)
+	keyless.PKColumns = nil
+	other := testTable(nil)
+	other.Name = "lines"
+	tests := []struct {
+		name   string
+		t      *schema.Table
+		resume bool
+	}{
+		{"interrupted table", keyed, true},
+		{"keyless interrupted table starts over", keyless, false},
+		{"next table", other, false},
+	}
+	for _, tt := range tests {
+		snap := &SnapshotProgress{DB: "shop", Tbl: "orders", LastPK: []any{int64(42)}, Rows: 2000}
+		got := resumeTable(snap, tt.t)
+		if got != tt.resume {
+			t.Errorf("%s: resumeTable = %v, want %v", tt.name, got, tt.resume)
+		}
+		if snap.DB != "shop" || snap.Tbl != tt.t.Name || (snap.Rows == 2000) != tt.resume || (snap.LastPK != nil) != tt.resume {
+			t.Errorf("%s: progress %+v", tt.name, snap)
+		}
+	}
+}
+
+// A chunk read again by a resumed snapshot must reproduce the stored IDs
+func TestSnapshotChunkIDsStable(t *testing.T) {
+	ids := func(rows ...[]any) []string {
+		h := newTestHandler()
+		tbl := testTable(h)
+		txID := snapshotTxID("3e11fa47-71ca-11e1-9e33-c80aa9429562:1-23", "shop", "orders", 4)
+		if err := h.emitSnapshotRows(tbl, rows, time.Unix(1700000000, 0), txID); err != nil {
+			t.Fatal(err)
+		}
+		var out []string
+		for _, d := range h.batch {
+			out = append(out, d.ID)
+		}
+		return out
+	}
+	first := ids([]any{int64(1), "open", nil}, []any{int64(2), "paid", nil})
+	// Row 1 changed and row 3 appeared before the chunk was read again
+	again := ids([]any{int64(1), "paid", nil}, []any{int64(2), "paid", nil}, []any{int64(3), "open", nil})
+	if first[0] != again[0] || first[1] != again[1] {
+		t.Errorf("IDs changed on re-read: %v vs %v", first, again[:2])
+	}
+	if again[2] == first[0] || again[2] == first[1] {
+		t.Errorf("new row reused an ID: %v", again)
+	}
+	if snapshotTxID("a:1-5", "shop", "orders", 0) == snapshotTxID("a:1-6", "shop", "orders", 0) {
+		t.Errorf("snapshots at different GTID sets share chunk IDs")
+	}
+}
+
+// Identical rows of a keyless table share their hash key but must each be
+// stored, under IDs a re-read reproduces
+func TestSnapshotIdenticalKeylessRows(t *testing.T) {
+	ids := func(rows ...[]any) []string {
+		h := newTestHandler()
+		tbl := testTable(nil)
+		tbl.PKColumns = nil
+		h.schemaVersions["shop.orders"] = 1
+		h.identities["shop.orders"] = tableIdentity(tbl, nil)
+		txID := snapshotTxID("3e11fa47-71ca-11e1-9e33-c80aa9429562:1-23", "shop", "orders", 0)
+		if err := h.emitSnapshotRows(tbl, rows, time.Unix(1700000000, 0), txID); err != nil {
+			t.Fatal(err)
+		}
+		var out []string
+		for _, d := range h.batch {
+			if d.Meta.Key != "hash" {
+				t.Fatalf("row identified by %q, want hash", d.Meta.Key)
+			}
+			out = append(out, d.ID)
+		}
+		return out
+	}
+	dup := []any{int64(1), "open", nil}
+	first := ids(dup, []any{int64(2), "open", nil}, dup)
+	if len(first) != 3 || first[0] == first[2] || first[0] == first[1] || first[1] == first[2] {
+		t.Fatalf("IDs %v, want 3 distinct", first)
+	}
+	again := ids(dup, dup, []any{int64(2), "open", nil})
+	if again[0] != first[0] || again[1] != first[2] || again[2] != first[1] {
+		t.Errorf("IDs changed on re-read: %v vs %v", again, first)
+	}
+}
+
+func TestSnapshotProgressRoundTrip(t *testing.T) {
+	s := testSink(t)
+	ctx := context.Background()
+	p := &SnapshotProgress{
+		GTID:    "3e11fa47-71ca-11e1-9e33-c80aa9429562:1-23",
+		Started: time.Unix(1700000000, 0).UTC(),
+		Done:    []string{"shop.customers"},
+		DB:      "shop",
+		Tbl:     "orders",
+		LastPK:  []any{int64(42), []byte{0x01, 0x02}},
+		Rows:    2000,
+	}
+	if err := s.saveSnapshotProgress(ctx, "a", p); err != nil {
+		t.Fatal(err)
+	}
+	got, err := s.loadSnapshotProgress(ctx, "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got == nil || got.GTID != p.GTID || got.Rows != 2000 || len(got.Done) != 1 || !got.Started.Equal(p.Started) {
+		t.Fatalf("loaded %+v, want %+v", got, p)
+	}
+	if b, ok := got.LastPK[1].([]byte); !ok || len(b) != 2 {
+		t.Errorf("binary PK came back as %T", got.LastPK[1])
+	}
+	if err := s.saveSnapshotProgress(ctx, "a", nil); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := s.loadSnapshotProgress(ctx, "a"); err != nil || got != nil {
+		t.Errorf("progress after completion = %+v, %v; want nil", got, err)
+	}
+}
+
+// streamInsert commits a one-row insert into tbl that ends at pos
+func streamInsert(t *testing.T, h *Handler, tbl *schema.Table, id int64, pos uint32) {
+	t.Helper()
+	end := mysql.Position{Name: "mysql-bin.000001", Pos: pos}
+	if err := h.OnRow(rowsEvent(tbl, canal.InsertAction, pos-10, []any{id, "open", nil})); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.OnXID(&replication.EventHeader{}, end); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.OnPosSynced(&replication.EventHeader{EventType: replication.XID_EVENT}, end, nil, false); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Changes the stream commits while a chunk is read, before its high
+// watermark is known, must still supersede the chunk's rows
+func TestWindowTracksChangesWhileReading(t *testing.T) {
+	h := newTestHandler()
+	tbl := testTable(h)
+	w, err := h.openWindow(tbl, "snapshot:test:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	streamInsert(t, h, tbl, 3, 50)  // before the low watermark: the chunk already has it
+	streamInsert(t, h, tbl, 2, 150) // between the watermarks: newer than the chunk
+
+	low := mysql.Position{Name: "mysql-bin.000001", Pos: 100}
+	high := mysql.Position{Name: "mysql-bin.000001", Pos: 200}
+	rows := [][]any{{int64(1), "open", nil}, {int64(2), "open", nil}, {int64(3), "open", nil}}
+	if err := h.fillWindow(w, rows, low, high); err != nil {
+		t.Fatal(err)
+	}
+	if w.dropped != 1 || len(w.order) != 2 {
+		t.Fatalf("dropped %d, kept %v; want row 2 dropped", w.dropped, w.order)
+	}
+	if _, ok := w.rows[rowKey("shop", "orders", int64(2))]; ok {
+		t.Errorf("row 2 kept although the stream changed it after the low watermark")
+	}
+	h.cancelWindow(w)
+}
+
+// Schema maps are written on the canal goroutine and read while snapshot
+// chunks are converted; run with -race
+func TestSchemaMapsConcurrentWithChunks(t *testing.T) {
+	h := newTestHandler()
+	tbl := testTable(h)
+	h.getTable = func(db, table string) (*schema.Table, error) { return testTable(nil), nil }
+
+	stop := make(chan struct{})
+	finished := make(chan struct{})
+	go func() {
+		defer close(finished)
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			_ = h.OnTableChanged(&replication.EventHeader{}, "shop", "other")
+			h.mu.Lock()
+			h.pendingDDL = nil
+			h.mu.Unlock()
+		}
+	}()
+	for i := 0; i < 200; i++ {
+		h.mu.Lock()
+		err := h.onRowLocked(rowsEvent(tbl, snapshotAction, 0, []any{int64(i), "open", nil}))
+		h.tx = h.tx[:0]
+		h.mu.Unlock()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	close(stop)
+	<-finished
+}
+
+// testEvents returns n insert events of shop.orders numbered from seq
+func testEvents(seq int64, n int) []EventDoc {
+	docs := make([]EventDoc, n)
+	for i := range docs {
+		s := seq + int64(i)
+		docs[i] = EventDoc{
+			ID:   makeID("a", "3e11fa47-71ca-11e1-9e33-c80aa9429562:7", 0, int(s)),
+			TS:   time.Unix(1700000000, 0).UTC(),
+			OP:   "i",
+			Meta: Meta{DB: "shop", Tbl: "orders", PK: s},
+			Seq:  s,
+			Chg:  map[string]Delta{"status": {T: "open"}},
+		}
+	}
+	return docs
+}
+
+func TestRecoverPendingBatches(t *testing.T) {
+	s := testSink(t)
+	ctx := context.Background()
+	docs := testEvents(1, 3)
+	if _, err := s.insertEvents(ctx, docs[:1]); err != nil {
+		t.Fatal(err)
+	}
+	gtid := "3e11fa47-71ca-11e1-9e33-c80aa9429562:1-7"
+	_, err := s.staging.InsertOne(ctx, bson.M{
+		"_id": "a_1_pending", "events": docs, "source": "a", "gtid": gtid,
+		"file": "mysql-bin.000001", "pos": 400, "seq": 3, "createdAt": time.Now(), "status": "pending",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	report, err := s.RecoverPendingBatches(ctx, "a", mysql.MySQLFlavor)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Batches != 1 || report.Events != 3 || report.Inserted != 2 || report.Offset != gtid {
+		t.Errorf("report = %+v, want 1 batch, 3 events, 2 inserted, offset %s", report, gtid)
+	}
+	if n, _ := s.events.CountDocuments(ctx, bson.M{}); n != 3 {
+		t.Errorf("%d events stored, want 3", n)
+	}
+	var staged stagedBatch
+	if err := s.staging.FindOne(ctx, bson.M{"_id": "a_1_pending", "status": "recovered"}).Decode(&staged); err != nil {
+		t.Errorf("batch not marked recovered: %v", err)
+	}
+	if saved, ok, _ := s.loadGTID(ctx, "a"); !ok || saved != gtid {
+		t.Errorf("offset = %q, want %q", saved, gtid)
+	}
+
+	// A second run finds nothing to do
+	if report, err := s.RecoverPendingBatches(ctx, "a", mysql.MySQLFlavor); err != nil || report.Batches != 0 {
+		t.Errorf("second recovery = %+v, %v", report, err)
+	}
+}
+
+func TestStagingPolicyEnv(t *testing.T) {
+	t.Setenv("STAGING_RETENTION", "48h")
+	t.Setenv("STAGING_ALERT_BYTES", "1048576")
+	p := StagingPolicy{Retention: time.Hour, Interval: time.Minute, AlertAge: 10 * time.Minute}
+	p.applyEnv()
+	want := StagingPolicy{Retention: 48 * time.Hour, Interval: time.Minute, AlertAge: 10 * time.Minute, AlertBytes: 1 << 20}
+	if p != want {
+		t.Errorf("policy = %+v, want %+v", p, want)
+	}
+}
+
+func TestPruneStaging(t *testing.T) {
+	s := testSink(t)
+	ctx := context.Background()
+	now := time.Now().UTC().Truncate(time.Millisecond)
+	batches := []struct {
+		id, source, status string
+		age                time.Duration
+		kept               bool
+	}{
+		{"old-committed", "a", "committed", 72 * time.Hour, false},
+		{"old-recovered", "a", "recovered", 72 * time.Hour, false},
+		{"old-archived", "a", "archived", 72 * time.Hour, false},
+		{"old-pending", "a", "pending", 72 * time.Hour, true},
+		{"new-committed", "a", "committed", time.Hour, true},
+		{"other-source", "b", "committed", 72 * time.Hour, true},
+	}
+	for _, b := range batches {
+		_, err := s.staging.InsertOne(ctx, bson.M{"_id": b.id, "source": b.source, "status": b.status, "createdAt": now.Add(-b.age)})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	n, err := s.pruneStaging(ctx, "a", now.Add(-24*time.Hour))
+	if err != nil || n != 3 {
+		t.Fatalf("pruned %d, %v; want 3", n, err)
+	}
+	for _, b := range batches {
+		if got, _ := s.staging.CountDocuments(ctx, bson.M{"_id": b.id}); (got == 1) != b.kept {
+			t.Errorf("%s kept = %v, want %v", b.id, got == 1, b.kept)
+		}
+	}
+
+	st, err := s.stagingStats(ctx, "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.Pending != 1 || st.Done != 1 || !st.OldestPending.Equal(now.Add(-72*time.Hour)) || !st.OldestDone.Equal(now.Add(-time.Hour)) {
+		t.Errorf("stats = %+v", st)
+	}
+}
+
+func testSpool(t *testing.T, dir string) *spool {
+	t.Helper()
+	sp, err := openSpool(SpoolConfig{Dir: dir, MaxBytes: 1 << 20, SegmentBytes: 1024})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { sp.Close() })
+	return sp
+}
+
+// spoolTestBatch is batch i of source "a", one event with sequence number i
+func spoolTestBatch(i int) spoolBatch {
+	return spoolBatch{
+		Events: testEvents(int64(i), 1),
+		Source: "a",
+		GTID:   fmt.Sprintf("3e11fa47-71ca-11e1-9e33-c80aa9429562:1-%d", i),
+		File:   "mysql-bin.000001",
+		Pos:    uint32(100 * i),
+	}
+}
+
+func TestSpoolAppendPeekAdvance(t *testing.T) {
+	dir := t.TempDir()
+	sp := testSpool(t, dir)
+	for i := 1; i <= 5; i++ {
+		if err := sp.Append(spoolTestBatch(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if segs, _ := filepath.Glob(filepath.Join(dir, "*.seg")); len(segs) < 2 {
+		t.Fatalf("%d segments, want the batches spread over several", len(segs))
+	}
+	if sp.Pending() != 5 || sp.LastGTID("a") != spoolTestBatch(5).GTID || sp.LastSeq("a") != 5 {
+		t.Fatalf("pending %d, last GTID %q, last seq %d", sp.Pending(), sp.LastGTID("a"), sp.LastSeq("a"))
+	}
+
+	for i := 1; i <= 2; i++ {
+		b, n, err := sp.Peek()
+		if err != nil || b.GTID != spoolTestBatch(i).GTID {
+			t.Fatalf("peek %d = %q, %v", i, b.GTID, err)
+		}
+		if err := sp.Advance(b, n); err != nil {
+			t.Fatal(err)
+		}
+	}
+	sp.Close()
+
+	// The cursor survives a restart
+	sp = testSpool(t, dir)
+	if sp.Pending() != 3 {
+		t.Fatalf("%d pending after reopen, want 3", sp.Pending())
+	}
+	for i := 3; i <= 5; i++ {
+		b, n, err := sp.Peek()
+		if err != nil || b.GTID != spoolTestBatch(i).GTID || b.Events[0].Seq != int64(i) {
+			t.Fatalf("peek %d = %+v, %v", i, b, err)
+		}
+		if err := sp.Advance(b, n); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if sp.Pending() != 0 || sp.LastGTID("a") != "" || sp.LastSeq("a") != 0 || sp.size != 0 {
+		t.Errorf("drained spool: pending %d, last GTID %q, last seq %d, size %d", sp.Pending(), sp.LastGTID("a"), sp.LastSeq("a"), sp.size)
+	}
+}
+
+func TestSpoolFull(t *testing.T) {
+	sp, err := openSpool(SpoolConfig{Dir: t.TempDir(), MaxBytes: 600, SegmentBytes: 1024})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sp.Close()
+	var appendErr error
+	for i := 1; i <= 10 && appendErr == nil; i++ {
+		appendErr = sp.Append(spoolTestBatch(i))
+	}
+	if !errors.Is(appendErr, errSpoolFull) {
+		t.Errorf("append to a full spool: %v, want errSpoolFull", appendErr)
+	}
+}
+
+func TestOpenSpoolDamage(t *testing.T) {
+	tests := []struct {
+		name    string
+		seg     int // segment to damage, counting from the oldest
+		damage  func(path string, size int64) error
+		pending int // batches left after a successful open
+		wantErr bool
+	}{
+		{"torn tail", -1, func(path string, _ int64) error {
+			f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			_, err = f.Write([]byte{200, 0, 0, 0, 1, 2})
+			return err
+		}, 5, false},
+		{"truncated last record", -1, func(path string, size int64) error {
+			return os.Truncate(path, size-10)
+		}, 4, false},
+		{"checksum mismatch in last segment", -1, func(path string, size int64) error {
+			return flipByte(path, size-5)
+		}, 4, false},
+		{"checksum mismatch in older segment", 0, func(path string, _ int64) error {
+			return flipByte(path, spoolHeaderLen+20)
+		}, 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			sp := testSpool(t, dir)
+			for i := 1; i <= 5; i++ {
+				if err := sp.Append(spoolTestBatch(i)); err != nil {
+					t.Fatal(err)
+				}
+			}
+			sp.Close()
+			segs, _ := filepath.Glob(filepath.Join(dir, "*.seg"))
+			path := segs[(tt.seg+len(segs))%len(segs)]
+			info, err := os.Stat(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := tt.damage(path, info.Size()); err != nil {
+				t.Fatal(err)
+			}
+
+			sp, err = openSpool(SpoolConfig{Dir: dir, MaxBytes: 1 << 20, SegmentBytes: 1024})
+			if tt.wantErr {
+				if err == nil {
+					sp.Close()
+					t.Fatal("openSpool succeeded on a corrupt segment")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer sp.Close()
+			if sp.Pending() != tt.pending {
+				t.Errorf("%d pending, want %d", sp.Pending(), tt.pending)
+			}
+			// Appends continue after the last good record
+			if err := sp.Append(spoolTestBatch(9)); err != nil {
+				t.Fatal(err)
+			}
+			for i := 0; i <= tt.pending; i++ {
+				b, n, err := sp.Peek()
+				if err != nil {
+					t.Fatalf("peek %d: %v", i, err)
+				}
+				if err := sp.Advance(b, n); err != nil {
+					t.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func flipByte(path string, off int64) error {
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	var b [1]byte
+	if _, err := f.ReadAt(b[:], off); err != nil {
+		return err
+	}
+	b[0] ^= 0xff
+	_, err = f.WriteAt(b[:], off)
+	return err
+}
+
+func TestSpoolDrain(t *testing.T) {
+	refused := mongo.BulkWriteException{WriteErrors: []mongo.BulkWriteError{{WriteError: mongo.WriteError{Code: 13, Message: "not authorized"}}}}
+	tests := []struct {
+		name     string
+		err      error // returned for batch 1; later batches succeed
+		drains   int
+		drained  int
+		givenUp  int
+		pending  int
+		errAfter bool // the last drain reports an error
+	}{
+		{"written", nil, 1, 3, 0, 0, false},
+		{"unreachable", context.DeadlineExceeded, 5, 0, 0, 3, true},
+		{"refused below the limit", refused, 2, 0, 0, 3, true},
+		{"refused up to the limit", refused, 3, 3, 1, 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sp := testSpool(t, t.TempDir())
+			for i := 1; i <= 3; i++ {
+				if err := sp.Append(spoolTestBatch(i)); err != nil {
+					t.Fatal(err)
+				}
+			}
+			var written []string
+			write := func(b spoolBatch) error {
+				if b.GTID == spoolTestBatch(1).GTID && tt.err != nil {
+					return tt.err
+				}
+				written = append(written, b.GTID)
+				return nil
+			}
+			givenUp := 0
+			giveUp := func(b spoolBatch, cause error) error {
+				if b.GTID != spoolTestBatch(1).GTID || cause.Error() != tt.err.Error() {
+					t.Errorf("gave up on %s: %v", b.GTID, cause)
+				}
+				givenUp++
+				return nil
+			}
+
+			drained := 0
+			var err error
+			for i := 0; i < tt.drains; i++ {
+				var n int
+				n, err = sp.drain(context.Background(), 3, write, giveUp)
+				drained += n
+			}
+			if drained != tt.drained || givenUp != tt.givenUp || sp.Pending() != tt.pending || (err != nil) != tt.errAfter {
+				t.Errorf("drained %d, gave up %d, pending %d, err %v", drained, givenUp, sp.Pending(), err)
+			}
+			if tt.drained > 0 && written[len(written)-1] != spoolTestBatch(3).GTID {
+				t.Errorf("written %v, want in order", written)
+			}
+		})
+	}
+}
+
+func TestIsMongoUnavailable(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"deadline", context.DeadlineExceeded, true},
+		{"server selection", errors.New("server selection error: context deadline exceeded"), true},
+		{"retryable", mongo.CommandError{Code: 91, Labels: []string{"RetryableWriteError"}}, true},
+		{"transient transaction", mongo.CommandError{Code: 112, Labels: []string{"TransientTransactionError"}}, true},
+		{"aborted transaction", fmt.Errorf("update offsets: %w", mongo.CommandError{Code: noSuchTransaction, Labels: []string{"TransientTransactionError"}}), false},
+		{"write error", mongo.BulkWriteException{WriteErrors: []mongo.BulkWriteError{{WriteError: mongo.WriteError{Code: 13}}}}, false},
+		{"write error in transaction", mongo.WriteException{WriteErrors: mongo.WriteErrors{{Code: 13}}, Labels: []string{"TransientTransactionError"}}, false},
+		{"rejected", &rejectedEvents{docs: testEvents(1, 1), reasons: []string{"too large"}}, false},
+		{"other", errors.New("unauthorized"), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := isMongoUnavailable(tt.err); got != tt.want {
+				t.Errorf("isMongoUnavailable(%v) = %v, want %v", tt.err, got, tt.want)
+			}
+		})
+	}
+}
+
+// clearConfigEnv unsets the variables loadConfig reads for the rest of the test
+func clearConfigEnv(t *testing.T) {
+	t.Helper()
+	prefixes := []string{"MYSQL_", "MONGO_", "BATCH_", "RETRY_", "SNAPSHOT_", "STAGING_", "SPOOL_", "LARGE_VALUE_",
+		"MASK_HMAC_KEY", "INCLUDE_REGEX", "EXCLUDE_REGEX", "TZ"}
+	for _, kv := range os.Environ() {
+		k, v, _ := strings.Cut(kv, "=")
+		for _, p := range prefixes {
+			if strings.HasPrefix(k, p) {
+				t.Setenv(k, v) // restored after the test
+				os.Unsetenv(k)
+			}
+		}
+	}
+}
+
+func writeConfig(t *testing.T, text string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "sdl.toml")
+	if err := os.WriteFile(path, []byte(text), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadConfig(t *testing.T) {
+	const file = `
+timezone = "UTC"
+
+[mongo]
+db = "audit_file"
+
+[batch]
+max_events = 500
+max_age = "2s"
+
+[[sources]]
+name = "orders"
+addr = "10.0.0.1:3306"
+server_id = 101
+include = ["shop\\..*"]
+
+[[sources]]
+name = "billing"
+addr = "10.0.0.2:3306"
+server_id = 102
+
+[[tables]]
+match = "shop\\.users"
+mask = { email = "redact" }
+`
+	tests := []struct {
+		name  string
+		file  string
+		env   map[string]string
+		check func(t *testing.T, cfg Config)
+	}{
+		{"defaults", "", nil, func(t *testing.T, cfg Config) {
+			want := defaultConfig()
+			if cfg.Mongo != want.Mongo || cfg.Batch != want.Batch || cfg.Spool != want.Spool || cfg.Timezone != want.Timezone {
+				t.Errorf("got %+v", cfg)
+			}
+			if len(cfg.Sources) != 1 || cfg.Sources[0].Addr != "127.0.0.1:3306" || cfg.Sources[0].ServerID != 2222 || cfg.Sources[0].Flavor != "mysql" {
+				t.Errorf("sources = %+v", cfg.Sources)
+			}
+		}},
+		{"file", file, nil, func(t *testing.T, cfg Config) {
+			if cfg.Timezone != "UTC" || cfg.Mongo.DB != "audit_file" || cfg.Mongo.Events != "row_changes" {
+				t.Errorf("mongo = %+v, timezone %q", cfg.Mongo, cfg.Timezone)
+			}
+			if cfg.Batch.MaxEvents != 500 || cfg.Batch.MaxAge != 2*time.Second || cfg.Batch.MaxBytes != 4<<20 {
+				t.Errorf("batch = %+v", cfg.Batch)
+			}
+			if len(cfg.Sources) != 2 || cfg.Sources[0].Include[0] != `shop\..*` || cfg.Sources[1].Include[0] != `.*\..*` {
+				t.Errorf("sources = %+v", cfg.Sources)
+			}
+			if len(cfg.Tables) != 1 || cfg.Tables[0].re == nil || cfg.Tables[0].masks["email"].action != "redact" {
+				t.Errorf("tables = %+v", cfg.Tables)
+			}
+		}},
+		{"environment overrides the file", file, map[string]string{
+			"MONGO_DB":                "audit_env",
+			"BATCH_MAX_EVENTS":        "50",
+			"TZ":                      "Asia/Tokyo",
+			"SPOOL_DIR":               "",
+			"MYSQL_ORDERS_ADDR":       "10.0.0.9:3306",
+			"MYSQL_USER":              "capture",
+			"MYSQL_BILLING_USER":      "billing",
+			"MYSQL_ORDERS_FLAVOR":     "mariadb",
+			"INCLUDE_REGEX":           `other\..*`,
+			"MYSQL_BILLING_SERVER_ID": "202",
+		}, func(t *testing.T, cfg Config) {
+			if cfg.Mongo.DB != "audit_env" || cfg.Batch.MaxEvents != 50 || cfg.Batch.MaxAge != 2*time.Second || cfg.Timezone != "Asia/Tokyo" || cfg.Spool.Dir != "" {
+				t.Errorf("got mongo %+v, batch %+v, timezone %q, spool %q", cfg.Mongo, cfg.Batch, cfg.Timezone, cfg.Spool.Dir)
+			}
+			orders, billing := cfg.Sources[0], cfg.Sources[1]
+			// Unprefixed variables only fill what the file left unset
+			if orders.Addr != "10.0.0.9:3306" || orders.User != "capture" || orders.Flavor != "mariadb" || orders.Include[0] != `shop\..*` {
+				t.Errorf("orders = %+v", orders)
+			}
+			if billing.User != "billing" || billing.ServerID != 202 || billing.Include[0] != `other\..*` {
+				t.Errorf("billing = %+v", billing)
+			}
+		}},
+		{"MYSQL_SOURCES selects and adds sources", file, map[string]string{
+			"MYSQL_SOURCES":       "billing, crm",
+			"MYSQL_CRM_ADDR":      "10.0.0.3:3306",
+			"MYSQL_CRM_SERVER_ID": "103",
+		}, func(t *testing.T, cfg Config) {
+			if len(cfg.Sources) != 2 || cfg.Sources[0].Addr != "10.0.0.2:3306" || cfg.Sources[1].Name != "crm" || cfg.Sources[1].Addr != "10.0.0.3:3306" {
+				t.Errorf("sources = %+v", cfg.Sources)
+			}
+		}},
+		{"unnamed source from the environment", "", map[string]string{
+			"MYSQL_ADDR":      "db:3307",
+			"MYSQL_SERVER_ID": "7",
+		}, func(t *testing.T, cfg Config) {
+			if sc := cfg.Sources[0]; sc.Addr != "db:3307" || sc.ServerID != 7 || sc.ID() != "mysql://db:3307" {
+				t.Errorf("source = %+v", sc)
+			}
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clearConfigEnv(t)
+			for k, v := range tt.env {
+				t.Setenv(k, v)
+			}
+			path := ""
+			if tt.file != "" {
+				path = writeConfig(t, tt.file)
+			}
+			cfg, err := loadConfig(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			tt.check(t, cfg)
+		})
+	}
+}
+
+func TestLoadConfigErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		file string
+		env  map[string]string
+		want []string // substrings of the error
+	}{
+		{"unknown key", "[mongo]\ndatabase = \"x\"\n", nil, []string{"unknown keys: mongo.database"}},
+		{"bad server id", "", map[string]string{"MYSQL_SERVER_ID": "x"}, []string{"invalid server id"}},
+		{"every problem at once", `
+timezone = "Mars/Olympus"
+[batch]
+max_events = 0
+[snapshot]
+mode = "always"
+[spool]
+max_attempts = 0
+[large_values]
+mode = "s3"
+`, nil, []string{"timezone:", "batch.max_events", "snapshot.mode", "spool:", "large_values.mode"}},
+		{"duplicate sources", `
+[[sources]]
+name = "a"
+addr = "db:3306"
+[[sources]]
+name = "a"
+addr = "db:3306"
+`, nil, []string{"unique name", "both capture from db:3306", "both use server id 2222"}},
+		{"unnamed source among several", "[[sources]]\naddr = \"a:1\"\nserver_id = 1\n[[sources]]\nname = \"b\"\naddr = \"b:1\"\nserver_id = 2\n", nil, []string{"unique name"}},
+		{"bad flavor and regexp", "", map[string]string{"MYSQL_FLAVOR": "postgres", "EXCLUDE_REGEX": "("}, []string{"flavor must be", "bad table regexp"}},
+		{"bad table rules", `
+[[tables]]
+match = "("
+collection = "x"
+[[tables]]
+match = "shop\\..*"
+[[tables]]
+match = "shop\\.users"
+mask = { email = "scramble" }
+ignored_update = "drop"
+`, nil, []string{"tables[0]: bad match", "tables[1] (shop\\..*): sets nothing", "mask email", "ignored_update"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clearConfigEnv(t)
+			for k, v := range tt.env {
+				t.Setenv(k, v)
+			}
+			path := ""
+			if tt.file != "" {
+				path = writeConfig(t, tt.file)
+			}
+			_, err := loadConfig(path)
+			if err == nil {
+				t.Fatal("no error")
+			}
+			for _, w := range tt.want {
+				if !strings.Contains(err.Error(), w) {
+					t.Errorf("error %q does not mention %q", err, w)
+				}
+			}
+		})
+	}
+}
+
+func TestSourceRunSetFilters(t *testing.T) {
+	run := newSourceRun(SourceConfig{Addr: "db:3306", Include: []string{`shop\..*`}, Exclude: []string{`shop\.tmp`}})
+	_, restart := run.current()
+
+	if run.setFilters([]string{`shop\..*`}, []string{`shop\.tmp`}) {
+		t.Error("unchanged filters restart the source")
+	}
+	select {
+	case <-restart:
+		t.Fatal("restart closed for unchanged filters")
+	default:
+	}
+
+	if !run.setFilters([]string{`shop\..*`, `crm\..*`}, []string{`shop\.tmp`}) {
+		t.Error("changed filters do not restart the source")
+	}
+	select {
+	case <-restart:
+	default:
+		t.Fatal("restart not closed after a filter change")
+	}
+	sc, next := run.current()
+	if len(sc.Include) != 2 || sc.Addr != "db:3306" || next == restart {
+		t.Errorf("current = %+v", sc)
+	}
+}
+
+func TestDotEnvReload(t *testing.T) {
+	clearConfigEnv(t)
+	t.Setenv("MONGO_DB", "from_process")
+	path := filepath.Join(t.TempDir(), ".env")
+	if err := os.WriteFile(path, []byte("MONGO_DB=from_file\nMASK_HMAC_KEY=k1\nSTAGING_RETENTION=1h\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	env := newDotEnv(path)
+	if err := env.load(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		for k := range env.loaded {
+			os.Unsetenv(k)
+		}
+	})
+	if os.Getenv("MONGO_DB") != "from_process" || os.Getenv("MASK_HMAC_KEY") != "k1" || os.Getenv("STAGING_RETENTION") != "1h" {
+		t.Fatalf("after load: MONGO_DB=%q MASK_HMAC_KEY=%q STAGING_RETENTION=%q",
+			os.Getenv("MONGO_DB"), os.Getenv("MASK_HMAC_KEY"), os.Getenv("STAGING_RETENTION"))
+	}
+
+	if err := os.WriteFile(path, []byte("MASK_HMAC_KEY=k2\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := env.load(); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := os.LookupEnv("STAGING_RETENTION"); ok || os.Getenv("MASK_HMAC_KEY") != "k2" || os.Getenv("MONGO_DB") != "from_process" {
+		t.Errorf("after reload: MONGO_DB=%q MASK_HMAC_KEY=%q STAGING_RETENTION set %v", os.Getenv("MONGO_DB"), os.Getenv("MASK_HMAC_KEY"), ok)
+	}
+}
+
+func TestReloadConfig(t *testing.T) {
+	const base = `
+[[sources]]
+name = "orders"
+addr = "db1:3306"
+server_id = 1
+include = ["shop\\..*"]
+
+[[sources]]
+name = "billing"
+addr = "db2:3306"
+server_id = 2
+`
+	tests := []struct {
+		name        string
+		next        string
+		rules       int  // table rules after the reload
+		ordersMoved bool // the orders source restarts
+	}{
+		{"rules only", base + "[[tables]]\nmatch = \"shop\\\\.users\"\nmask = { email = \"redact\" }\n", 1, false},
+		{"filters", strings.Replace(base, `include = ["shop\\..*"]`, `include = ["shop\\..*", "crm\\..*"]`, 1), 0, true},
+		{"restart-only change is not applied", strings.Replace(base, "[[sources]]", "[batch]\nmax_events = 7\n\n[[sources]]", 1), 0, false},
+		{"invalid config keeps the current one", base + "[[tables]]\nmatch = \"(\"\ncollection = \"x\"\n", 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clearConfigEnv(t)
+			path := writeConfig(t, base)
+			cur, err := loadConfig(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			runs := map[string]*sourceRun{}
+			for _, sc := range cur.Sources {
+				runs[sc.ID()] = newSourceRun(sc)
+			}
+			_, ordersRestart := runs["mysql://db1:3306"].current()
+			_, billingRestart := runs["mysql://db2:3306"].current()
+			sink := &MongoSink{}
+
+			if err := os.WriteFile(path, []byte(tt.next), 0o600); err != nil {
+				t.Fatal(err)
+			}
+			reloadConfig(path, newDotEnv(filepath.Join(t.TempDir(), ".env")), &cur, runs, sink)
+
+			if len(sink.tableRules()) != tt.rules || len(cur.Tables) != tt.rules {
+				t.Errorf("%d rules in the sink, %d in the config, want %d", len(sink.tableRules()), len(cur.Tables), tt.rules)
+			}
+			if cur.Batch.MaxEvents != defaultConfig().Batch.MaxEvents {
+				t.Errorf("batch.max_events changed to %d without a restart", cur.Batch.MaxEvents)
+			}
+			select {
+			case <-ordersRestart:
+				if !tt.ordersMoved {
+					t.Error("orders restarted")
+				}
+				if len(cur.Sources[0].Include) != 2 {
+					t.Errorf("current config keeps include %v", cur.Sources[0].Include)
+				}
+			default:
+				if tt.ordersMoved {
+					t.Error("orders not restarted")
+				}
+			}
+			select {
+			case <-billingRestart:
+				t.Error("billing restarted")
+			default:
+			}
+		})
+	}
+}
+
+// compileRules prepares rules the way Config.validate does
+func compileRules(t *testing.T, key string, rules ...TableRule) []TableRule {
+	t.Helper()
+	for i := range rules {
+		rules[i].re = regexp.MustCompile(rules[i].Match)
+		rules[i].masks = map[string]columnMask{}
+		for col, spec := range rules[i].Mask {
+			m, err := parseMask(spec, []byte(key))
+			if err != nil {
+				t.Fatal(err)
+			}
+			rules[i].masks[strings.ToLower(col)] = m
+		}
+	}
+	return rules
+}
+
+func TestParseMask(t *testing.T) {
+	tests := []struct {
+		spec    string
+		key     string
+		want    columnMask
+		wantErr string
+	}{
+		{"drop", "", columnMask{action: "drop"}, ""},
+		{"redact", "", columnMask{action: "redact"}, ""},
+		{"hash", "k", columnMask{action: "hash", key: []byte("k")}, ""},
+		{"hash", "", columnMask{}, "needs mask_key"},
+		{"truncate:4", "", columnMask{action: "truncate", n: 4}, ""},
+		{"truncate", "", columnMask{}, "want truncate:N"},
+		{"truncate:0", "", columnMask{}, "want truncate:N"},
+		{"truncate:x", "", columnMask{}, "want truncate:N"},
+		{"scramble", "", columnMask{}, "unknown mask"},
+		{"", "", columnMask{}, "unknown mask"},
+	}
+	for _, tt := range tests {
+		got, err := parseMask(tt.spec, []byte(tt.key))
+		if tt.wantErr != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("parseMask(%q) error = %v, want %q", tt.spec, err, tt.wantErr)
+			}
+			continue
+		}
+		if err != nil || !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("parseMask(%q) = %+v, %v; want %+v", tt.spec, got, err, tt.want)
+		}
+	}
+}
+
+func TestMaskApply(t *testing.T) {
+	hash := func(key string, v any) any { return columnMask{action: "hash", key: []byte(key)}.apply(v) }
+	tests := []struct {
+		name string
+		mask columnMask
+		in   any
+		want any
+	}{
+		{"redact", columnMask{action: "redact"}, "secret", "[redacted]"},
+		{"redact keeps NULL", columnMask{action: "redact"}, nil, nil},
+		{"hash keeps NULL", columnMask{action: "hash", key: []byte("k")}, nil, nil},
+		{"truncate string by runes", columnMask{action: "truncate", n: 3}, "héllo", "hél"},
+		{"truncate short string", columnMask{action: "truncate", n: 8}, "hi", "hi"},
+		{"truncate bytes", columnMask{action: "truncate", n: 2}, []byte{1, 2, 3}, []byte{1, 2}},
+		{"truncate leaves numbers", columnMask{action: "truncate", n: 1}, int64(12345), int64(12345)},
+		{"hash of text and its bytes agree", columnMask{action: "hash", key: []byte("k")}, []byte("a@b.c"), hash("k", "a@b.c")},
+	}
+	for _, tt := range tests {
+		if got := tt.mask.apply(tt.in); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: apply(%v) = %v, want %v", tt.name, tt.in, got, tt.want)
+		}
+	}
+
+	h := hash("k", "a@b.c").(string)
+	if len(h) != 64 || h == "a@b.c" {
+		t.Errorf("hash = %q, want 64 hex digits", h)
+	}
+	if hash("k", "a@b.c") == hash("k", "x@b.c") || hash("k", "a@b.c") == hash("other", "a@b.c") {
+		t.Error("hash does not depend on value and key")
+	}
+	if hash("k", int64(7)) != hash("k", "7") {
+		t.Error("numbers and their text hash differently")
+	}
+}
+
+func TestMaskChanges(t *testing.T) {
+	rules := compileRules(t, "k",
+		TableRule{Match: `shop\.users`, Mask: map[string]string{"Email": "redact", "card": "drop"}},
+		TableRule{Match: `shop\..*`, Mask: map[string]string{"email": "hash", "phone": "truncate:3"}},
+	)
+	chg := map[string]Delta{
+		"email": {F: "a@b.c", T: "x@y.z"},
+		"card":  {F: "4111", T: "4242"},
+		"phone": {F: nil, T: "5551234"},
+		"name":  {F: "Ann", T: "Anna"},
+		"prefs": {P: []PathDelta{{Path: "$.phone", Op: "c", F: "5551234", T: "5559876"}}},
+	}
+	maskChanges(rules, "shop", "users", chg)
+	want := map[string]Delta{
+		"email": {F: "[redacted]", T: "[redacted]", M: "redact"}, // first matching rule wins
+		"card":  {M: "drop"},
+		"phone": {F: nil, T: "555", M: "truncate"},
+		"name":  {F: "Ann", T: "Anna"},
+		"prefs": {P: []PathDelta{{Path: "$.phone", Op: "c", F: "5551234", T: "5559876"}}},
+	}
+	if !reflect.DeepEqual(chg, want) {
+		t.Errorf("users: got %+v, want %+v", chg, want)
+	}
+
+	chg = map[string]Delta{"email": {T: "a@b.c"}}
+	maskChanges(rules, "shop", "orders", chg)
+	if d := chg["email"]; d.M != "hash" || d.T != hash64(t, rules[1].masks["email"], "a@b.c") {
+		t.Errorf("orders: got %+v", d)
+	}
+	chg = map[string]Delta{"email": {T: "a@b.c"}}
+	maskChanges(rules, "crm", "users", chg)
+	if d := chg["email"]; d.M != "" || d.T != "a@b.c" {
+		t.Errorf("crm: got %+v", d)
+	}
+}
+
+func hash64(t *testing.T, m columnMask, v any) any {
+	t.Helper()
+	h := m.apply(v)
+	if s, ok := h.(string); !ok || len(s) != 64 {
+		t.Fatalf("hash = %v", h)
+	}
+	return h
+}
+
+func TestColumnFilterFor(t *testing.T) {
+	rules := compileRules(t, "",
+		TableRule{Match: `shop\.users`, IgnoreColumns: []string{"Updated_At"}, IgnoredUpdate: "skip"},
+		TableRule{Match: `shop\..*`, Columns: []string{"id", "status", "updated_at"}, IgnoredUpdate: "touch"},
+		TableRule{Match: `shop\..*`, IgnoreColumns: []string{"note"}},
+	)
+	tests := []struct {
+		db, tbl string
+		audited []string
+		ignored []string
+		touch   bool
+	}{
+		// Each setting comes from the first matching rule that sets it
+		{"shop", "users", []string{"id", "STATUS"}, []string{"updated_at", "note", "email"}, false},
+		{"shop", "orders", []string{"id", "status", "updated_at"}, []string{"note", "total"}, true},
+		{"crm", "users", []string{"id", "note", "updated_at"}, nil, false},
+	}
+	for _, tt := range tests {
+		f := columnFilterFor(rules, tt.db, tt.tbl)
+		for _, col := range tt.audited {
+			if !f.audited(col) {
+				t.Errorf("%s.%s: %s not audited", tt.db, tt.tbl, col)
+			}
+		}
+		for _, col := range tt.ignored {
+			if f.audited(col) {
+				t.Errorf("%s.%s: %s audited", tt.db, tt.tbl, col)
+			}
+		}
+		if f.touch != tt.touch {
+			t.Errorf("%s.%s: touch = %v, want %v", tt.db, tt.tbl, f.touch, tt.touch)
+		}
+	}
+}
+
+func TestIgnoredColumnUpdates(t *testing.T) {
+	tests := []struct {
+		name   string
+		policy string
+		before []any
+		after  []any
+		op     string // "" for no event
+		chg    []string
+	}{
+		{"audited column", "skip", []any{int64(1), "open", "a"}, []any{int64(1), "paid", "b"}, "u", []string{"status"}},
+		{"ignored only, skip", "skip", []any{int64(1), "open", "a"}, []any{int64(1), "open", "b"}, "", nil},
+		{"ignored only, touch", "touch", []any{int64(1), "open", "a"}, []any{int64(1), "open", "b"}, "t", nil},
+		{"key change is kept", "skip", []any{int64(1), "open", "a"}, []any{int64(2), "open", "b"}, "u", []string{"id"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := newTestHandler()
+			tbl := testTable(h)
+			h.rules = compileRules(t, "", TableRule{Match: `shop\.orders`, IgnoreColumns: []string{"note"}, IgnoredUpdate: tt.policy})
+			if err := h.OnRow(rowsEvent(tbl, canal.UpdateAction, 300, tt.before, tt.after)); err != nil {
+				t.Fatal(err)
+			}
+			if tt.op == "" {
+				if len(h.tx) != 0 {
+					t.Errorf("got %+v, want no event", h.tx)
+				}
+				return
+			}
+			if len(h.tx) != 1 || h.tx[0].OP != tt.op {
+				t.Fatalf("got %+v, want one %q event", h.tx, tt.op)
+			}
+			var cols []string
+			for col := range h.tx[0].Chg {
+				cols = append(cols, col)
+			}
+			if !reflect.DeepEqual(cols, tt.chg) {
+				t.Errorf("chg columns = %v, want %v", cols, tt.chg)
+			}
+		})
+	}
+}
+
+func TestKeyValue(t *testing.T) {
+	tbl := &schema.Table{Columns: []schema.TableColumn{{Name: "order_id"}, {Name: "line"}, {Name: "qty"}}}
+	tests := []struct {
+		name    string
+		cols    []int
+		row     []any
+		want    any
+		wantErr bool
+	}{
+		{"single column", []int{0}, []any{int64(7), int64(2), int64(1)}, int64(7), false},
+		{"composite in key order", []int{1, 0}, []any{int64(7), int64(2), int64(1)},
+			bson.D{{Key: "line", Value: int64(2)}, {Key: "order_id", Value: int64(7)}}, false},
+		{"large unsigned", []int{0}, []any{uint64(1) << 63}, encodeUint(uint64(1) << 63), false},
+		{"NULL component", []int{0, 1}, []any{int64(7), nil}, bson.D{{Key: "order_id", Value: int64(7)}, {Key: "line", Value: nil}}, false},
+		{"column beyond the row", []int{0, 1}, []any{int64(7)}, nil, true},
+		{"single column beyond the row", []int{2}, []any{int64(7)}, nil, true},
+		{"column not logged", []int{0, 1}, []any{int64(7), absentColumn{}}, nil, true},
+		{"no key columns", nil, []any{int64(7)}, nil, true},
+	}
+	for _, tt := range tests {
+		got, err := keyValue(tbl, tt.cols, tt.row)
+		if (err != nil) != tt.wantErr || !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: keyValue = %v, %v; want %v (error %v)", tt.name, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+func TestRowIdentityKey(t *testing.T) {
+	tbl := testTable(nil)
+	pk := rowIdentity{kind: "pk", cols: tbl.PKColumns, table: tbl}
+	uk := rowIdentity{kind: "uk", index: "uniq_status", cols: []int{1}, table: tbl}
+	row := []any{int64(1), "open", nil}
+
+	tests := []struct {
+		name string
+		id   rowIdentity
+		row  []any
+		want any
+		flag string
+	}{
+		{"primary key", pk, row, int64(1), ""},
+		{"unique key", uk, row, "open", "uk:uniq_status"},
+		{"full-row hash", rowIdentity{kind: "hash"}, row, rowHash(row), "hash"},
+		{"key column not logged", pk, []any{absentColumn{}, "open", nil}, rowHash([]any{absentColumn{}, "open", nil}), "hash"},
+		{"unique key column beyond the row", uk, []any{int64(1)}, rowHash([]any{int64(1)}), "hash"},
+	}
+	for _, tt := range tests {
+		got, used := tt.id.key(tt.row)
+		if !reflect.DeepEqual(got, tt.want) || used.flag() != tt.flag {
+			t.Errorf("%s: key = %v (%q), want %v (%q)", tt.name, got, used.flag(), tt.want, tt.flag)
+		}
+	}
+	if rowHash([]any{"a", nil}) == rowHash([]any{"a", ""}) || rowHash([]any{"ab", "c"}) == rowHash([]any{"a", "bc"}) {
+		t.Error("rowHash collides on NULL or value boundaries")
+	}
+}
+
+func TestEventKeyFallback(t *testing.T) {
+	h := newTestHandler()
+	tbl := testTable(h)
+	h.identities["shop.orders"] = rowIdentity{kind: "pk", cols: tbl.PKColumns, table: tbl}
+	row := []any{absentColumn{}, "open", nil}
+	if err := h.OnRow(rowsEvent(tbl, canal.DeleteAction, 300, row)); err != nil {
+		t.Fatal(err)
+	}
+	if m := h.tx[0].Meta; m.Key != "hash" || m.PK != rowHash(row) {
+		t.Errorf("meta = %+v, want the full-row hash identity", m)
+	}
+}
+
+func TestPKString(t *testing.T) {
+	tests := []struct {
+		pk   any
+		want string
+	}{
+		{int64(42), "42"},
+		{"abc", "abc"},
+		{bson.D{{Key: "order_id", Value: int64(7)}, {Key: "line", Value: int64(2)}}, "7|2"},
+		{bson.D{{Key: "a", Value: "x|y"}, {Key: "b", Value: `c\`}}, `x\|y|c\\`},
+		{bson.D{{Key: "a", Value: int64(1)}}, "1"},
+	}
+	for _, tt := range tests {
+		if got := pkString(tt.pk); got != tt.want {
+			t.Errorf("pkString(%v) = %q, want %q", tt.pk, got, tt.want)
+		}
+	}
+	// Escaping keeps distinct composite keys distinct
+	a := bson.D{{Key: "a", Value: "x|"}, {Key: "b", Value: "y"}}
+	b := bson.D{{Key: "a", Value: "x"}, {Key: "b", Value: "|y"}}
+	if pkString(a) == pkString(b) {
+		t.Errorf("pkString(%v) == pkString(%v) == %q", a, b, pkString(a))
+	}
+}
+
+func TestCompositeKeyEvents(t *testing.T) {
+	h := newTestHandler()
+	tbl := testTable(h)
+	tbl.PKColumns = []int{0, 1}
+	h.identities["shop.orders"] = rowIdentity{kind: "pk", cols: tbl.PKColumns, table: tbl}
+	if err := h.OnRow(rowsEvent(tbl, canal.InsertAction, 300, []any{int64(7), "a|b", nil})); err != nil {
+		t.Fatal(err)
+	}
+	m := h.tx[0].Meta
+	want := bson.D{{Key: "id", Value: int64(7)}, {Key: "status", Value: "a|b"}}
+	if !reflect.DeepEqual(m.PK, want) || m.PKStr != `7|a\|b` || m.Key != "" {
+		t.Errorf("meta = %+v, want pk %v with pk_str 7|a\\|b", m, want)
+	}
+}
+
+func TestKeyChangeRecordsPrevPK(t *testing.T) {
+	composite := func(id int64, status string) bson.D {
+		return bson.D{{Key: "id", Value: id}, {Key: "status", Value: status}}
+	}
+	tests := []struct {
+		name      string
+		pkCols    []int
+		before    []any
+		after     []any
+		wantPK    any
+		wantPrev  any
+		wantPrevS string
+	}{
+		{"key unchanged", []int{0}, []any{int64(1), "open", nil}, []any{int64(1), "paid", nil}, int64(1), nil, ""},
+		{"key changed", []int{0}, []any{int64(1), "open", nil}, []any{int64(2), "open", nil}, int64(2), int64(1), ""},
+		{"composite key changed", []int{0, 1}, []any{int64(1), "open", nil}, []any{int64(1), "paid", nil},
+			composite(1, "paid"), composite(1, "open"), "1|open"},
+		{"composite key unchanged", []int{0, 1}, []any{int64(1), "open", "a"}, []any{int64(1), "open", "b"},
+			composite(1, "open"), nil, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := newTestHandler()
+			tbl := testTable(h)
+			tbl.PKColumns = tt.pkCols
+			h.identities["shop.orders"] = rowIdentity{kind: "pk", cols: tbl.PKColumns, table: tbl}
+			if err := h.OnRow(rowsEvent(tbl, canal.UpdateAction, 300, tt.before, tt.after)); err != nil {
+				t.Fatal(err)
+			}
+			m := h.tx[0].Meta
+			if !reflect.DeepEqual(m.PK, tt.wantPK) || !reflect.DeepEqual(m.PrevPK, tt.wantPrev) || m.PrevStr != tt.wantPrevS {
+				t.Errorf("meta = %+v, want pk %v, prev_pk %v (%q)", m, tt.wantPK, tt.wantPrev, tt.wantPrevS)
+			}
+		})
+	}
+}
+
+func TestKeyChangeOfIgnoredColumn(t *testing.T) {
+	// A key change is kept even when the key column is not audited
+	h := newTestHandler()
+	tbl := testTable(h)
+	h.rules = compileRules(t, "", TableRule{Match: `shop\.orders`, IgnoreColumns: []string{"id"}, IgnoredUpdate: "skip"})
+	if err := h.OnRow(rowsEvent(tbl, canal.UpdateAction, 300, []any{int64(1), "open", nil}, []any{int64(2), "open", nil})); err != nil {
+		t.Fatal(err)
+	}
+	if len(h.tx) != 1 || h.tx[0].OP != "u" || h.tx[0].Meta.PrevPK != int64(1) || len(h.tx[0].Chg) != 0 {
+		t.Errorf("got %+v, want an update linking key 1 to 2", h.tx)
+	}
+}
+
+func TestEncodeValue(t *testing.T) {
+	dec := func(s string) primitive.Decimal128 {
+		d, err := primitive.ParseDecimal128(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return d
+	}
+	enum := schema.TableColumn{Type: schema.TYPE_ENUM, EnumValues: []string{"new", "paid"}}
+	set := schema.TableColumn{Type: schema.TYPE_SET, SetValues: []string{"a", "b", "c"}}
+	utf8mb4 := schema.TableColumn{Type: schema.TYPE_STRING, Collation: "utf8mb4_general_ci"}
+	latin1 := schema.TableColumn{Type: schema.TYPE_STRING, Collation: "latin1_swedish_ci"}
+	tests := []struct {
+		name string
+		col  schema.TableColumn
+		in   any
+		want any
+	}{
+		{"NULL", utf8mb4, nil, nil},
+		{"decimal", schema.TableColumn{Type: schema.TYPE_DECIMAL}, "12.50", dec("12.50")},
+		{"decimal as bytes", schema.TableColumn{Type: schema.TYPE_DECIMAL}, []byte("-0.001"), dec("-0.001")},
+		{"decimal beyond Decimal128", schema.TableColumn{Type: schema.TYPE_DECIMAL}, "1234567890123456789012345678901234567.8", "1234567890123456789012345678901234567.8"},
+		{"enum index from the binlog", enum, int64(2), "paid"},
+		{"enum name from SELECT", enum, []byte("new"), "new"},
+		{"invalid enum index", enum, int64(0), ""},
+		{"set bits from the binlog", set, int64(5), []string{"a", "c"}},
+		{"set names from SELECT", set, "a,c", []string{"a", "c"}},
+		{"empty set", set, int64(0), []string{}},
+		{"bit(1)", schema.TableColumn{Type: schema.TYPE_BIT, RawType: "bit(1)"}, int64(1), true},
+		{"bit(16) from SELECT", schema.TableColumn{Type: schema.TYPE_BIT, RawType: "bit(16)"}, []byte{1, 2}, int64(258)},
+		{"bit(64) high bit", schema.TableColumn{Type: schema.TYPE_BIT, RawType: "bit(64)"}, int64(-1), dec("18446744073709551615")},
+		{"json object keeps key order", schema.TableColumn{Type: schema.TYPE_JSON}, []byte(`{"b":1,"a":[true,null,"x"],"c":1.5}`),
+			bson.D{{Key: "b", Value: int64(1)}, {Key: "a", Value: bson.A{true, nil, "x"}}, {Key: "c", Value: 1.5}}},
+		{"json scalar", schema.TableColumn{Type: schema.TYPE_JSON}, "42", int64(42)},
+		{"empty json", schema.TableColumn{Type: schema.TYPE_JSON}, []byte{}, nil},
+		{"invalid json kept as text", schema.TableColumn{Type: schema.TYPE_JSON}, []byte("{"), "{"},
+		{"signed int", schema.TableColumn{Type: schema.TYPE_NUMBER}, int32(-5), int64(-5)},
+		{"unsigned int missed by the decoder", schema.TableColumn{Type: schema.TYPE_NUMBER, IsUnsigned: true}, int32(-1), int64(4294967295)},
+		{"unsigned tinyint", schema.TableColumn{Type: schema.TYPE_NUMBER, IsUnsigned: true}, int8(-1), int64(255)},
+		{"bigint unsigned above int64", schema.TableColumn{Type: schema.TYPE_NUMBER, IsUnsigned: true}, uint64(1) << 63, dec("9223372036854775808")},
+		{"mediumint unsigned", schema.TableColumn{Type: schema.TYPE_MEDIUM_INT, IsUnsigned: true}, int32(16777215), int64(16777215)},
+		{"binary as string", schema.TableColumn{Type: schema.TYPE_BINARY}, "\x00\x01", []byte{0, 1}},
+		{"utf8 text", utf8mb4, []byte("héllo"), "héllo"},
+		{"latin1 text", latin1, []byte{'c', 'a', 'f', 0xe9}, "café"},
+		{"invalid utf8 kept as bytes", utf8mb4, []byte{0xff, 0xfe}, []byte{0xff, 0xfe}},
+		{"blob keeps bytes", schema.TableColumn{Type: schema.TYPE_STRING, Collation: "binary"}, []byte{0xff}, []byte{0xff}},
+		{"float untouched", schema.TableColumn{Type: schema.TYPE_FLOAT}, 1.25, 1.25},
+	}
+	for _, tt := range tests {
+		if got := encodeValue(&tt.col, tt.in); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: encodeValue(%#v) = %#v, want %#v", tt.name, tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestEncodeRowSkipsAbsent(t *testing.T) {
+	tbl := testTable(nil)
+	got := encodeRow(tbl, []any{int32(1), absentColumn{}, []byte("x"), "extra"})
+	want := []any{int64(1), absentColumn{}, "x", "extra"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("encodeRow = %#v, want %#v", got, want)
+	}
+}
+
+func TestCheckRowImage(t *testing.T) {
+	hookErr := errors.New("binlog syncer has no parser")
+	tests := []struct {
+		image   string
+		hookErr error
+		fatal   bool
+	}{
+		{"MINIMAL", nil, false},
+		{"FULL", hookErr, false},
+		{"full", hookErr, false},
+		{"", hookErr, false},
+		{"MINIMAL", hookErr, true},
+		{"NOBLOB", hookErr, true},
+	}
+	for _, tt := range tests {
+		err := checkRowImage(tt.image, tt.hookErr)
+		if got := errors.Is(err, errRowImage); got != tt.fatal || (err != nil) != tt.fatal {
+			t.Errorf("checkRowImage(%q, %v) = %v, want fatal %v", tt.image, tt.hookErr, err, tt.fatal)
+		}
+	}
+}
+
+func TestGoMySQLVersionPinned(t *testing.T) {
+	mod, err := os.ReadFile("go.mod")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !regexp.MustCompile(`(?m)^\s*github\.com/go-mysql-org/go-mysql ` + regexp.QuoteMeta(goMySQLVersion) + `$`).Match(mod) {
+		t.Errorf("go.mod does not pin go-mysql %s, which markAbsentColumns is written against", goMySQLVersion)
+	}
+}
+
+// setUnexported sets the unexported field name of the struct v points to
+func setUnexported(t *testing.T, v any, name string, x any) {
+	t.Helper()
+	f := reflect.ValueOf(v).Elem().FieldByName(name)
+	if !f.IsValid() {
+		t.Fatalf("%T has no field %s", v, name)
+	}
+	reflect.NewAt(f.Type(), unsafe.Pointer(f.UnsafeAddr())).Elem().Set(reflect.ValueOf(x))
+}
+
+func TestMarkAbsentColumns(t *testing.T) {
+	if err := markAbsentColumns(new(canal.Canal)); err == nil {
+		t.Error("canal without a syncer: no error")
+	}
+
+	c := new(canal.Canal)
+	syncer := replication.NewBinlogSyncer(replication.BinlogSyncerConfig{ServerID: 1, Flavor: mysql.MySQLFlavor})
+	setUnexported(t, c, "syncer", syncer)
+	parser, err := unexportedField[*replication.BinlogParser](reflect.ValueOf(syncer).Elem(), "parser")
+	if err != nil {
+		t.Fatal(err)
+	}
+	parser.SetRowsEventDecodeFunc(func(e *replication.RowsEvent, _ []byte) error {
+		e.Rows = [][]any{{int64(1), nil, nil}, {int64(1), "paid", nil}}
+		e.SkippedColumns = [][]int{{1, 2}, {2}}
+		return nil
+	})
+	if err := markAbsentColumns(c); err != nil {
+		t.Fatalf("go-mysql %s: %v", goMySQLVersion, err)
+	}
+	decode, err := unexportedField[func(*replication.RowsEvent, []byte) error](reflect.ValueOf(parser).Elem(), "rowsEventDecodeFunc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	e := &replication.RowsEvent{}
+	if err := decode(e, nil); err != nil {
+		t.Fatal(err)
+	}
+	want := [][]any{{int64(1), absentColumn{}, absentColumn{}}, {int64(1), "paid", absentColumn{}}}
+	if !reflect.DeepEqual(e.Rows, want) {
+		t.Errorf("rows = %#v, want %#v", e.Rows, want)
+	}
+}
+
+func TestRowImage(t *testing.T) {
+	tbl := testTable(nil)
+	tbl.Columns[2].RawType = "text"
+	tests := []struct {
+		name string
+		rows [][]any
+		want string
+	}{
+		{"full", [][]any{{int64(1), "open", "x"}}, ""},
+		{"blob missing", [][]any{{int64(1), "open", absentColumn{}}}, "noblob"},
+		{"other column missing", [][]any{{int64(1), "open", absentColumn{}}, {int64(1), absentColumn{}, "x"}}, "minimal"},
+		{"beyond the table", [][]any{{int64(1), "open", "x", absentColumn{}}}, "minimal"},
+	}
+	for _, tt := range tests {
+		if got := rowImage(tbl, tt.rows); got != tt.want {
+			t.Errorf("%s: rowImage = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+// mustJSON decodes a JSON document the way JSON columns are stored
+func mustJSON(t *testing.T, s string) any {
+	t.Helper()
+	v, err := decodeJSON([]byte(s))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return v
+}
+
+func TestDiffJSON(t *testing.T) {
+	tests := []struct {
+		name string
+		a, b string
+		want []PathDelta
+	}{
+		{"equal", `{"a":1,"b":[1,2]}`, `{"b":[1,2],"a":1}`, nil},
+		{"member changed", `{"address":{"city":"Pune"}}`, `{"address":{"city":"Mumbai"}}`,
+			[]PathDelta{{Path: "$.address.city", Op: "c", F: "Pune", T: "Mumbai"}}},
+		{"members added and removed", `{"a":1,"old key":true}`, `{"a":1,"b":2}`,
+			[]PathDelta{{Path: `$."old key"`, Op: "r", F: true}, {Path: "$.b", Op: "a", T: int64(2)}}},
+		{"array grown", `{"tags":["a","b"]}`, `{"tags":["a","b","vip"]}`,
+			[]PathDelta{{Path: "$.tags[2]", Op: "a", T: "vip"}}},
+		{"array shrunk", `[1,2,3]`, `[1,3]`,
+			[]PathDelta{{Path: "$[1]", Op: "c", F: int64(2), T: int64(3)}, {Path: "$[2]", Op: "r", F: int64(3)}}},
+		{"type changed", `{"a":{"x":1}}`, `{"a":[1]}`,
+			[]PathDelta{{Path: "$.a", Op: "c", F: bson.D{{Key: "x", Value: int64(1)}}, T: bson.A{int64(1)}}}},
+		{"number kinds", `{"n":1}`, `{"n":1.5}`,
+			[]PathDelta{{Path: "$.n", Op: "c", F: int64(1), T: 1.5}}},
+	}
+	for _, tt := range tests {
+		got := diffJSON("$", mustJSON(t, tt.a), mustJSON(t, tt.b), nil)
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: diffJSON = %#v, want %#v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestJSONDelta(t *testing.T) {
+	tests := []struct {
+		name  string
+		f, to any
+		paths int // 0 for the whole-value delta
+	}{
+		{"documents", mustJSON(t, `{"a":1,"b":2}`), mustJSON(t, `{"a":2,"b":3}`), 2},
+		{"arrays", mustJSON(t, `[1]`), mustJSON(t, `[1,2]`), 1},
+		{"old value not logged", nil, mustJSON(t, `{"a":1}`), 0},
+		{"scalar to document", "x", mustJSON(t, `{"a":1}`), 0},
+		{"scalars", int64(1), int64(2), 0},
+		{"equal after decoding", mustJSON(t, `{"a":1}`), mustJSON(t, `{"a":1}`), 0},
+	}
+	for _, tt := range tests {
+		d := Delta{F: tt.f, T: tt.to}
+		got := jsonDelta(d)
+		switch {
+		case tt.paths == 0 && !reflect.DeepEqual(got, d):
+			t.Errorf("%s: jsonDelta = %#v, want the whole values", tt.name, got)
+		case tt.paths > 0 && (len(got.P) != tt.paths || got.F != nil || got.T != nil):
+			t.Errorf("%s: jsonDelta = %#v, want %d paths only", tt.name, got, tt.paths)
+		}
+	}
+}
+
+func TestJSONPathKey(t *testing.T) {
+	tests := map[string]string{
+		"city":    ".city",
+		"_x$1":    "._x$1",
+		"old key": `."old key"`,
+		"1st":     `."1st"`,
+		`a"b`:     `."a\"b"`,
+	}
+	for key, want := range tests {
+		if got := jsonPathKey(key); got != want {
+			t.Errorf("jsonPathKey(%q) = %s, want %s", key, got, want)
+		}
+	}
+}
+
+func TestSplitBatch(t *testing.T) {
+	docs := testEvents(1, 5)
+	raw, err := bson.Marshal(docs[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	one := len(raw)
+	big := testEvents(10, 1)[0]
+	big.Chg = map[string]Delta{"note": {T: strings.Repeat("x", 4*one)}}
+	bad := testEvents(20, 1)[0]
+	bad.Chg = map[string]Delta{"note": {T: make(chan int)}} // does not encode
+
+	tests := []struct {
+		name     string
+		docs     []EventDoc
+		maxBytes int
+		want     []int // events per part
+	}{
+		{"all fit", docs, 5 * one, []int{5}},
+		{"exact fit", docs, 2 * one, []int{2, 2, 1}},
+		{"one each", docs, one, []int{1, 1, 1, 1, 1}},
+		{"under one", docs, one - 1, []int{1, 1, 1, 1, 1}},
+		{"oversized event alone", []EventDoc{docs[0], big, docs[1]}, 2 * one, []int{1, 1, 1}},
+		{"unencodable event alone", []EventDoc{docs[0], bad, docs[1]}, 3 * one, []int{1, 1, 1}},
+		{"single", docs[:1], one, []int{1}},
+	}
+	for _, tt := range tests {
+		parts := splitBatch(tt.docs, tt.maxBytes)
+		var got []int
+		var ids []string
+		for _, p := range parts {
+			got = append(got, len(p))
+			for _, d := range p {
+				ids = append(ids, d.ID)
+			}
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: parts of %v events, want %v", tt.name, got, tt.want)
+		}
+		for i, d := range tt.docs {
+			if i >= len(ids) || ids[i] != d.ID {
+				t.Errorf("%s: events reordered or lost: %v", tt.name, ids)
+				break
+			}
+		}
+	}
+}
+
+func TestValueSize(t *testing.T) {
+	tests := []struct {
+		name string
+		v    any
+		want int
+	}{
+		{"string", "héllo", 6},
+		{"binary", []byte{1, 2, 3}, 3},
+		{"document", bson.D{{Key: "a", Value: "b"}}, 22},
+		{"array", bson.A{int64(1)}, 24},
+		{"number", int64(1 << 40), 0},
+		{"nil", nil, 0},
+	}
+	for _, tt := range tests {
+		if got := valueSize(tt.v); got != tt.want {
+			t.Errorf("%s: valueSize = %d, want %d", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestOffloadValues(t *testing.T) {
+	long := strings.Repeat("é", 10) // 20 bytes
+	huge := strings.Repeat("x", maxEventBytes)
+	tests := []struct {
+		name      string
+		threshold int
+		chg       Delta
+		fRef      bool
+		tRef      bool
+	}{
+		{"under threshold", 64, Delta{F: "a", T: long}, false, false},
+		{"new value above", 16, Delta{F: "a", T: long}, false, true},
+		{"both above", 16, Delta{F: long, T: long + "!"}, true, true},
+		{"json document above", 16, Delta{T: bson.D{{Key: "k", Value: long}}}, false, true},
+		{"no threshold", 0, Delta{F: long, T: long}, false, false},
+		{"too big for an event", 0, Delta{F: "a", T: huge}, false, true},
+	}
+	for _, tt := range tests {
+		s := &MongoSink{values: LargeValuePolicy{Threshold: tt.threshold, Mode: "summary", Preview: 5}}
+		docs := testEvents(1, 1)
+		docs[0].Chg = map[string]Delta{"note": tt.chg}
+		if err := s.offloadValues(context.Background(), docs); err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		d := docs[0].Chg["note"]
+		if (d.FRef != nil) != tt.fRef || (d.TRef != nil) != tt.tRef {
+			t.Errorf("%s: f_ref %+v, t_ref %+v, want %v, %v", tt.name, d.FRef, d.TRef, tt.fRef, tt.tRef)
+		}
+		if (d.FRef != nil && d.F != nil) || (d.TRef != nil && d.T != nil) {
+			t.Errorf("%s: offloaded value kept: %+v", tt.name, d)
+		}
+	}
+}
+
+func TestValueRef(t *testing.T) {
+	s := &MongoSink{values: LargeValuePolicy{Mode: "summary", Preview: 5}}
+	tests := []struct {
+		name    string
+		v       any
+		kind    string
+		len     int
+		preview string
+	}{
+		{"string", "abcdefgh", "string", 8, "abcde"},
+		{"cut at rune", "abcdéf", "string", 7, "abcd"},
+		{"short", "ab", "string", 2, "ab"},
+		{"binary", []byte{0xff, 0xfe, 0}, "binary", 3, ""},
+		{"text binary", []byte("hello world"), "binary", 11, "hello"},
+		{"json", bson.D{{Key: "a", Value: int64(1)}}, "json", 7, `{"a":`},
+	}
+	for _, tt := range tests {
+		ref, err := s.valueRef(context.Background(), tt.v)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if ref.Kind != tt.kind || ref.Len != tt.len || ref.Preview != tt.preview || len(ref.SHA256) != 64 || ref.File != "" {
+			t.Errorf("%s: valueRef = %+v, want %s of %d bytes, preview %q", tt.name, ref, tt.kind, tt.len, tt.preview)
+		}
+	}
+}
+
+func TestScreenEvents(t *testing.T) {
+	docs := testEvents(1, 4)
+	docs[1].Chg = map[string]Delta{"note": {T: make(chan int)}}
+	docs[3].Chg = map[string]Delta{"note": {T: strings.Repeat("x", maxEventBytes)}}
+
+	tests := []struct {
+		name     string
+		docs     []EventDoc
+		kept     []int64
+		rejected []string // reason prefixes
+	}{
+		{"all fine", []EventDoc{docs[0], docs[2]}, []int64{1, 3}, nil},
+		{"unencodable", docs[:3], []int64{1, 3}, []string{"encode: "}},
+		{"too large and unencodable", docs, []int64{1, 3}, []string{"encode: ", "document too large: "}},
+		{"none", nil, nil, nil},
+	}
+	for _, tt := range tests {
+		kept, rej := screenEvents(tt.docs)
+		var seqs []int64
+		for _, d := range kept {
+			seqs = append(seqs, d.Seq)
+		}
+		if !reflect.DeepEqual(seqs, tt.kept) {
+			t.Errorf("%s: kept %v, want %v", tt.name, seqs, tt.kept)
+		}
+		if (rej != nil) != (tt.rejected != nil) {
+			t.Fatalf("%s: rejected %v, want %v", tt.name, rej, tt.rejected)
+		}
+		if rej == nil {
+			continue
+		}
+		if len(rej.reasons) != len(tt.rejected) {
+			t.Fatalf("%s: reasons %q, want %q", tt.name, rej.reasons, tt.rejected)
+		}
+		for i, want := range tt.rejected {
+			if !strings.HasPrefix(rej.reasons[i], want) {
+				t.Errorf("%s: reason %q, want %q...", tt.name, rej.reasons[i], want)
+			}
+		}
+	}
+}
+
+func TestRejectedEventsWithout(t *testing.T) {
+	docs := testEvents(1, 4)
+	tests := []struct {
+		name     string
+		rejected []EventDoc
+		want     []int64
+	}{
+		{"none", nil, []int64{1, 2, 3, 4}},
+		{"some", []EventDoc{docs[3], docs[1]}, []int64{1, 3}},
+		{"all", docs, []int64{}},
+		{"unknown", testEvents(9, 1), []int64{1, 2, 3, 4}},
+	}
+	for _, tt := range tests {
+		rej := &rejectedEvents{}
+		for _, d := range tt.rejected {
+			rej.add(d, "bad")
+		}
+		got := []int64{}
+		for _, d := range rej.without(docs) {
+			got = append(got, d.Seq)
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: without = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestDeadValueText(t *testing.T) {
+	long := strings.Repeat("é", 600)
+	tests := []struct {
+		name string
+		v    any
+		want string
+	}{
+		{"nil", nil, ""},
+		{"string", "open", `"open"`},
+		{"empty string", "", `""`},
+		{"invalid utf-8", "a\xffb", `"a\xffb"`},
+		{"bytes", []byte{0, 'a'}, `"\x00a"`},
+		{"number", int64(42), "42"},
+		{"document", bson.D{{Key: "a", Value: int64(1)}}, "[{a 1}]"},
+		{"invalid utf-8 inside", bson.A{"\xff"}, `"[\xff]"`},
+		{"clipped", long, strings.ToValidUTF8(strconv.Quote(long)[:1021], "") + "..."},
+	}
+	for _, tt := range tests {
+		got := deadValueText(tt.v)
+		if got != tt.want {
+			t.Errorf("%s: deadValueText = %q, want %q", tt.name, got, tt.want)
+		}
+		if !utf8.ValidString(got) || len(got) > 1024 {
+			t.Errorf("%s: %q is not valid UTF-8 of at most 1KB", tt.name, got)
+		}
+	}
+}
+
+func TestDropRejected(t *testing.T) {
+	s := testSink(t)
+	ctx := context.Background()
+	docs := testEvents(1, 5)
+	writeErr := errors.New("connection reset")
+
+	tests := []struct {
+		name    string
+		rejects [][]int // seqs rejected by each call, until write succeeds
+		err     error   // returned by the call after the rejects
+		writes  [][]int64
+		dead    int
+		wantErr error
+	}{
+		{"clean", nil, nil, [][]int64{{1, 2, 3, 4, 5}}, 0, nil},
+		{"one rejected", [][]int{{2}}, nil, [][]int64{{1, 2, 3, 4, 5}, {1, 3, 4, 5}}, 1, nil},
+		{"rejected twice", [][]int{{1, 5}, {3}}, nil, [][]int64{{1, 2, 3, 4, 5}, {2, 3, 4}, {2, 4}}, 3, nil},
+		{"other failure", [][]int{{4}}, writeErr, [][]int64{{1, 2, 3, 4, 5}, {1, 2, 3, 5}}, 1, writeErr},
+	}
+	for _, tt := range tests {
+		if _, err := s.deadLetters.DeleteMany(ctx, bson.M{}); err != nil {
+			t.Fatal(err)
+		}
+		var writes [][]int64
+		err := s.dropRejected(ctx, "test", docs, func(batch []EventDoc) error {
+			call := len(writes)
+			var seqs []int64
+			for _, d := range batch {
+				seqs = append(seqs, d.Seq)
+			}
+			writes = append(writes, seqs)
+			if call >= len(tt.rejects) {
+				return tt.err
+			}
+			rej := &rejectedEvents{}
+			for _, seq := range tt.rejects[call] {
+				rej.add(docs[seq-1], "bad value")
+			}
+			return rej
+		})
+		if err != tt.wantErr {
+			t.Errorf("%s: err %v, want %v", tt.name, err, tt.wantErr)
+		}
+		if !reflect.DeepEqual(writes, tt.writes) {
+			t.Errorf("%s: writes %v, want %v", tt.name, writes, tt.writes)
+		}
+		if n, err := s.deadLetters.CountDocuments(ctx, bson.M{"source": "test", "status": "pending"}); err != nil {
+			t.Fatal(err)
+		} else if int(n) != tt.dead {
+			t.Errorf("%s: %d dead letters, want %d", tt.name, n, tt.dead)
+		}
+	}
+}
+
+func TestReplayBatchInTransaction(t *testing.T) {
+	s := testSink(t)
+	ctx := context.Background()
+	docs := testEvents(1, 3)
+	const file = "mysql-bin.000001"
+
+	tests := []struct {
+		name string
+		docs []EventDoc
+		gtid string
+		seq  int64
+	}{
+		{"first write", docs[:2], "3e11fa47-71ca-11e1-9e33-c80aa9429562:1-7", 2},
+		{"same batch again", docs[:2], "3e11fa47-71ca-11e1-9e33-c80aa9429562:1-7", 2},
+		{"overlapping batch", docs, "3e11fa47-71ca-11e1-9e33-c80aa9429562:1-8", 3},
+		{"all stored", docs, "3e11fa47-71ca-11e1-9e33-c80aa9429562:1-8", 3},
+	}
+	for _, tt := range tests {
+		if err := s.writeBatchWithTransaction(ctx, tt.docs, "a", tt.gtid, file, 400, tt.seq); err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if n, err := s.events.CountDocuments(ctx, bson.M{}); err != nil || n != int64(len(tt.docs)) {
+			t.Errorf("%s: %d events stored (%v), want %d", tt.name, n, err, len(tt.docs))
+		}
+		if saved, ok, err := s.loadGTID(ctx, "a"); err != nil || !ok || saved != tt.gtid {
+			t.Errorf("%s: offset %q (%v), want %q", tt.name, saved, err, tt.gtid)
+		}
+	}
+}
+
+func TestInsertEventsSkipsStored(t *testing.T) {
+	s := testSink(t)
+	ctx := context.Background()
+	docs := testEvents(1, 4)
+	tests := []struct {
+		docs []EventDoc
+		want int
+	}{
+		{docs[:2], 2},
+		{docs[:2], 0},
+		{docs, 2},
+		{docs[1:3], 0},
+	}
+	for i, tt := range tests {
+		if n, err := s.insertEvents(ctx, tt.docs); err != nil || n != tt.want {
+			t.Errorf("write %d: %d inserted (%v), want %d", i, n, err, tt.want)
+		}
+	}
+}
+
+func TestMakeID(t *testing.T) {
+	const gtid = "3e11fa47-71ca-11e1-9e33-c80aa9429562:7"
+	ids := []struct {
+		source, tx string
+		event, row int
+	}{
+		{"mysql://db1:3306", gtid, 0, 0},
+		{"mysql://db2:3306", gtid, 0, 0},
+		{"mysql://db1:3306", "3e11fa47-71ca-11e1-9e33-c80aa9429562:8", 0, 0},
+		{"mysql://db1:3306", gtid, 1, 0},
+		{"mysql://db1:3306", gtid, 0, 1},
+		{"mysql://db1:3306", gtid, 10, 1},
+		{"mysql://db1:3306", gtid, 1, 10},
+		{"a|b", "c", 0, 0},
+		{"a", "b|c", 0, 0},
+		{"", "", 0, 0},
+	}
+	seen := map[string]int{}
+	for i, in := range ids {
+		id := makeID(in.source, in.tx, in.event, in.row)
+		if !regexp.MustCompile(`^[0-9a-f]{40}$`).MatchString(id) {
+			t.Errorf("makeID(%+v) = %q, want 40 hex digits", in, id)
+		}
+		if j, ok := seen[id]; ok {
+			t.Errorf("makeID(%+v) = makeID(%+v) = %s", in, ids[j], id)
+		}
+		seen[id] = i
+		if again := makeID(in.source, in.tx, in.event, in.row); again != id {
+			t.Errorf("makeID(%+v) not stable: %s, then %s", in, id, again)
+		}
+	}
+	// IDs are stored, so they must not change between releases
+	if got, want := makeID("mysql://db1:3306", gtid, 0, 0), "762f8c74952694678e2556313765d540dcc86a27"; got != want {
+		t.Errorf("makeID = %s, want %s", got, want)
+	}
+}
+
+// A transaction goes to the collection the rules in force when it committed
+// route it to, whenever its batch is written
+func TestRoutingAtCommit(t *testing.T) {
+	h := newTestHandler()
+	tbl := testTable(h)
+	h.sink.setRules(compileRules(t, "", TableRule{Match: `^shop\.orders$`, Collection: "orders_audit"}))
+	h.rules = h.sink.tableRules()
+
+	commit := func(pos uint32, reload []TableRule) {
+		t.Helper()
+		if err := h.OnRow(rowsEvent(tbl, canal.InsertAction, pos, []any{int64(pos), "open", nil})); err != nil {
+			t.Fatal(err)
+		}
+		if reload != nil {
+			h.sink.setRules(reload) // SIGHUP while the transaction is open
+		}
+		end := mysql.Position{Name: "mysql-bin.000001", Pos: pos + 30}
+		if err := h.OnXID(&replication.EventHeader{}, end); err != nil {
+			t.Fatal(err)
+		}
+		if err := h.OnPosSynced(&replication.EventHeader{EventType: replication.XID_EVENT}, end, nil, false); err != nil {
+			t.Fatal(err)
+		}
+	}
+	commit(300, compileRules(t, "", TableRule{Match: `^shop\.`, Collection: "shop_audit"}))
+	commit(400, compileRules(t, "", TableRule{Match: `^other\.`, Collection: "other_audit"}))
+	commit(500, nil)
+
+	want := []string{"orders_audit", "shop_audit", ""}
+	if len(h.batch) != len(want) {
+		t.Fatalf("%d events, want %d", len(h.batch), len(want))
+	}
+	for i, d := range h.batch {
+		if d.Coll != want[i] {
+			t.Errorf("event %d routed to %q, want %q", i, d.Coll, want[i])
+		}
+	}
+
+	// The routing survives the spool and staging
+	raw, err := bson.Marshal(stagedBatch{ID: "b", Events: h.batch})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var staged stagedBatch
+	if err := bson.Unmarshal(raw, &staged); err != nil {
+		t.Fatal(err)
+	}
+	sp := testSpool(t, t.TempDir())
+	if err := sp.Append(spoolBatch{Events: h.batch, Source: "a", GTID: "g"}); err != nil {
+		t.Fatal(err)
+	}
+	spooled, _, err := sp.Peek()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range want {
+		if staged.Events[i].Coll != want[i] || spooled.Events[i].Coll != want[i] {
+			t.Errorf("event %d: staged in %q, spooled in %q, want %q", i, staged.Events[i].Coll, spooled.Events[i].Coll, want[i])
+		}
+	}
+}
+
+func TestInsertEventsRoutes(t *testing.T) {
+	s := testSink(t)
+	ctx := context.Background()
+	docs := testEvents(1, 2)
+	docs[1].Coll = "orders_audit"
+	if n, err := s.insertEvents(ctx, docs); err != nil || n != 2 {
+		t.Fatalf("insertEvents = %d, %v", n, err)
+	}
+	for i, coll := range []*mongo.Collection{s.events, s.events.Database().Collection("orders_audit")} {
+		var got bson.M
+		if err := coll.FindOne(ctx, bson.M{"_id": docs[i].ID}).Decode(&got); err != nil {
+			t.Fatalf("event %d not in %s: %v", i, coll.Name(), err)
+		}
+		if _, ok := got["coll"]; ok {
+			t.Errorf("event %d stored with its routing: %v", i, got)
+		}
+	}
+}
+
+// A duplicate the lookup cannot see (here: twice in one batch) has aborted
+// a transaction, so it must fail the write there rather than be skipped
+func TestInsertEventsDuplicateInTransaction(t *testing.T) {
+	s := testSink(t)
+	ctx := context.Background()
+	docs := testEvents(1, 1)
+	docs = append(docs, docs[0])
+
+	if n, err := s.insertEvents(ctx, docs); err != nil || n != 1 {
+		t.Errorf("outside a transaction: %d inserted, %v; want 1, nil", n, err)
+	}
+
+	docs = testEvents(5, 1)
+	docs = append(docs, docs[0])
+	session, err := s.client.StartSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer session.EndSession(ctx)
+	_, err = session.WithTransaction(ctx, func(sessCtx mongo.SessionContext) (any, error) {
+		return s.insertEvents(sessCtx, docs)
+	})
+	if !mongo.IsDuplicateKeyError(err) {
+		t.Errorf("inside a transaction: %v, want the duplicate key error", err)
+	}
+	if n, _ := s.events.CountDocuments(ctx, bson.M{"_id": docs[0].ID}); n != 0 {
+		t.Errorf("aborted transaction stored the event")
+	}
+}
@@ -22,35 +22,124 @@ import (
 )
 
 type Delta struct {
-	F any `bson:"f,omitempty" json:"f,omitempty"`
-	T any `bson:"t,omitempty" json:"t,omitempty"`
+	F    any         `bson:"f,omitempty" json:"f,omitempty"`
+	T    any         `bson:"t,omitempty" json:"t,omitempty"`
+	FRef *ValueRef   `bson:"f_ref,omitempty" json:"f_ref,omitempty"` // replaces a large F
+	TRef *ValueRef   `bson:"t_ref,omitempty" json:"t_ref,omitempty"`
+	P    []PathDelta `bson:"p,omitempty" json:"p,omitempty"` // JSON column paths changed by an update
+	M    string      `bson:"m,omitempty" json:"m,omitempty"` // mask applied by the logger
+}
+
+// ValueRef stands in for a column value the logger kept out of the event
+// for its size; File is set when the value is in the <events>_values
+// GridFS bucket
+type ValueRef struct {
+	Kind    string `bson:"kind" json:"kind"`
+	Len     int    `bson:"len" json:"len"`
+	SHA256  string `bson:"sha256" json:"sha256"`
+	Preview string `bson:"preview,omitempty" json:"preview,omitempty"`
+	File    string `bson:"file,omitempty" json:"file,omitempty"`
+}
+
+// deltaValue formats one side of a delta, describing offloaded values
+func deltaValue(v any, ref *ValueRef) string {
+	if ref == nil {
+		return formatValue(v)
+	}
+	where := "not stored"
+	if ref.File != "" {
+		where = "GridFS " + ref.File[:12]
+	}
+	s := fmt.Sprintf("[%s, %d bytes, %s]", ref.Kind, ref.Len, where)
+	if ref.Preview != "" {
+		s += " " + ref.Preview + "..."
+	}
+	return s
+}
+
+// PathDelta is one changed path of a JSON column
+type PathDelta struct {
+	Path string `bson:"path" json:"path"`
+	Op   string `bson:"op" json:"op"` // "a" added, "r" removed, "c" changed
+	F    any    `bson:"f,omitempty" json:"f,omitempty"`
+	T    any    `bson:"t,omitempty" json:"t,omitempty"`
+}
+
+// pathValues lists the old (from) or new values of JSON path deltas as
+// "path=value" pairs, for the CSV export
+func pathValues(paths []PathDelta, from bool) string {
+	parts := make([]string, 0, len(paths))
+	for _, p := range paths {
+		switch {
+		case from && p.Op != "a":
+			parts = append(parts, p.Path+"="+formatValue(p.F))
+		case !from && p.Op != "r":
+			parts = append(parts, p.Path+"="+formatValue(p.T))
+		}
+	}
+	return strings.Join(parts, "; ")
 }
 
 type Meta struct {
-	DB  string `bson:"db" json:"db"`
-	Tbl string `bson:"tbl" json:"tbl"`
-	PK  any    `bson:"pk" json:"pk"`
+	DB    string `bson:"db" json:"db"`
+	Tbl   string `bson:"tbl" json:"tbl"`
+	PK    any    `bson:"pk" json:"pk"`                             // scalar, or column -> value document for composite keys
+	PKStr string `bson:"pk_str,omitempty" json:"pk_str,omitempty"` // canonical "a|b" form of a composite PK
+	Key   string `bson:"key,omitempty" json:"key,omitempty"`       // "uk:<index>" or "hash" for tables without primary key
+
+	PrevPK  any    `bson:"prev_pk,omitempty" json:"prev_pk,omitempty"` // key before an update that changed it
+	PrevStr string `bson:"prev_pk_str,omitempty" json:"prev_pk_str,omitempty"`
 }
 
 type EventDoc struct {
-	ID    string           `bson:"_id" json:"_id"`
-	TS    time.Time        `bson:"ts" json:"ts"`
-	OP    string           `bson:"op" json:"op"`
-	Meta  Meta             `bson:"meta" json:"meta"`
-	Seq   int64            `bson:"seq,omitempty" json:"seq,omitempty"`
-	Chg   map[string]Delta `bson:"chg,omitempty" json:"chg,omitempty"`
-	Src   map[string]any   `bson:"src,omitempty" json:"src,omitempty"`
-	TSIST string           `bson:"ts_ist,omitempty" json:"ts_ist,omitempty"`
+	ID        string           `bson:"_id" json:"_id"`
+	Source    string           `bson:"source,omitempty" json:"source,omitempty"` // MySQL primary, as mysql://host:port
+	TS        time.Time        `bson:"ts" json:"ts"`
+	OP        string           `bson:"op" json:"op"`
+	Meta      Meta             `bson:"meta" json:"meta"`
+	Seq       int64            `bson:"seq,omitempty" json:"seq,omitempty"`
+	Img       string           `bson:"img,omitempty" json:"img,omitempty"` // "minimal" or "noblob" row image
+	TxID      string           `bson:"txid,omitempty" json:"txid,omitempty"`
+	TxSeq     int              `bson:"txseq" json:"txseq"`
+	SchemaVer int              `bson:"schema_ver,omitempty" json:"schema_ver,omitempty"`
+	Chg       map[string]Delta `bson:"chg,omitempty" json:"chg,omitempty"`
+	Src       map[string]any   `bson:"src,omitempty" json:"src,omitempty"`
+	TSIST     string           `bson:"ts_ist,omitempty" json:"ts_ist,omitempty"`
+}
+
+// SchemaColumn and SchemaVersion mirror the schema_history documents written by the logger
+type SchemaColumn struct {
+	Name     string `bson:"name" json:"name"`
+	Type     string `bson:"type" json:"type"`
+	Nullable bool   `bson:"nullable" json:"nullable"`
+	PK       bool   `bson:"pk" json:"pk"`
+}
+
+type SchemaVersion struct {
+	Source  string         `bson:"source" json:"source"`
+	DB      string         `bson:"db" json:"db"`
+	Tbl     string         `bson:"tbl" json:"tbl"`
+	Version int            `bson:"version" json:"version"`
+	Columns []SchemaColumn `bson:"columns" json:"columns"`
+}
+
+// schemaKey identifies a table version of one source; events written before
+// events carried their source use an empty one
+func schemaKey(source, db, tbl string, version int) string {
+	return fmt.Sprintf("%s/%s.%s#%d", source, db, tbl, version)
 }
 
 type QueryParams struct {
+	Source    string // mysql://host:port, or empty for all sources
 	Database  string
 	Table     string
-	PK        any
-	Operation string // "i", "u", "d" or empty for all
+	PK        string // see pkFilter
+	FollowPK  bool   // also match the keys the row had before or after a key change
+	Operation string // "i", "u", "d", "r", "t" or empty for all
 	StartTime time.Time
 	EndTime   time.Time
 	Limit     int64
+	Before    *EventDoc // only events listed after it, older in (ts, seq, source, _id) order: the next page
 }
 
 type Stats struct {
@@ -68,7 +157,7 @@ func getenv(k, def string) string {
 	return def
 }
 
-func connectMongo() (*mongo.Collection, error) {
+func connectMongo() (*mongo.Collection, *mongo.Collection, error) {
 	if err := godotenv.Load(".env"); err != nil {
 		// Silent: .env file optional
 	}
@@ -89,14 +178,191 @@ func connectMongo() (*mongo.Collection, error) {
 		SetServerSelectionTimeout(connectTimeout).
 		SetConnectTimeout(connectTimeout))
 	if err != nil {
-		return nil, fmt.Errorf("MongoDB connection failed: %v", err)
+		return nil, nil, fmt.Errorf("MongoDB connection failed: %v", err)
 	}
 
 	if err := client.Ping(ctx, nil); err != nil {
-		return nil, fmt.Errorf("MongoDB ping failed: %v", err)
+		return nil, nil, fmt.Errorf("MongoDB ping failed: %v", err)
 	}
 
-	return client.Database(mongoDB).Collection(mongoColl), nil
+	historyColl := getenv("MONGO_SCHEMA_HISTORY_COLL", "schema_history")
+	return client.Database(mongoDB).Collection(mongoColl), client.Database(mongoDB).Collection(historyColl), nil
+}
+
+// pkFilter matches meta.pk: "v" matches a scalar key or the canonical
+// string of a composite one, "col=v[,col=v...]" matches components of a
+// composite key
+func pkFilter(pk string) bson.M {
+	return keyFilter("meta.pk", "meta.pk_str", pk)
+}
+
+// keyFilter is pkFilter for the key field and its canonical string field
+func keyFilter(field, strField, pk string) bson.M {
+	if !isPKFields(pk) {
+		return bson.M{"$or": bson.A{bson.M{field: pkValue(pk)}, bson.M{strField: pk}}}
+	}
+	and := bson.A{}
+	for _, part := range strings.Split(pk, ",") {
+		col, v, _ := strings.Cut(part, "=")
+		and = append(and, bson.M{field + "." + strings.TrimSpace(col): pkValue(strings.TrimSpace(v))})
+	}
+	return bson.M{"$and": and}
+}
+
+// keyLink is another key the row had, and while: from the key change that
+// gave the row the key to the one that took it away (zero: open-ended)
+type keyLink struct {
+	Key      any
+	From, To time.Time
+}
+
+// filter matches the events of the row under l.Key
+func (l keyLink) filter() bson.M {
+	f := bson.M{"meta.pk": l.Key}
+	ts := bson.M{}
+	if !l.From.IsZero() {
+		ts["$gte"] = l.From
+	}
+	if !l.To.IsZero() {
+		ts["$lte"] = l.To
+	}
+	if len(ts) > 0 {
+		f["ts"] = ts
+	}
+	return f
+}
+
+// maxKeyLinks bounds how many links linkedKeys follows
+const maxKeyLinks = 20
+
+// linkedKeys follows key changes (meta.prev_pk) from the key in params.PK,
+// backwards and forwards, and returns the other keys the row had with the
+// time each was held, so a key freed by a change and reused by another row
+// later (or held by one earlier) does not pull in that row's events
+func linkedKeys(ctx context.Context, coll *mongo.Collection, params QueryParams) ([]keyLink, error) {
+	base := bson.M{"meta.prev_pk": bson.M{"$exists": true}}
+	if params.Source != "" {
+		base["source"] = params.Source
+	}
+	if params.Database != "" {
+		base["meta.db"] = params.Database
+	}
+	if params.Table != "" {
+		base["meta.tbl"] = params.Table
+	}
+	// changes returns the key changes matching cond, oldest first (order 1)
+	// or newest first (-1)
+	changes := func(cond bson.M, order int, limit int64) ([]EventDoc, error) {
+		f := bson.M{}
+		for k, v := range base {
+			f[k] = v
+		}
+		for k, v := range cond {
+			f[k] = v
+		}
+		opts := options.Find().
+			SetProjection(bson.M{"ts": 1, "meta": 1}).
+			SetSort(bson.D{{Key: "ts", Value: order}, {Key: "seq", Value: order}}).
+			SetLimit(limit)
+		cur, err := coll.Find(ctx, f, opts)
+		if err != nil {
+			return nil, err
+		}
+		var out []EventDoc
+		err = cur.All(ctx, &out)
+		return out, err
+	}
+
+	// A link followed forwards ends at the next change away from its key;
+	// one followed backwards starts at the change to its key
+	type step struct {
+		link    keyLink
+		forward bool
+	}
+	var todo []step
+	away, err := changes(keyFilter("meta.prev_pk", "meta.prev_pk_str", params.PK), 1, 1000)
+	if err != nil {
+		return nil, err
+	}
+	for _, c := range away {
+		todo = append(todo, step{keyLink{Key: c.Meta.PK, From: c.TS}, true})
+	}
+	to, err := changes(pkFilter(params.PK), -1, 1000)
+	if err != nil {
+		return nil, err
+	}
+	for _, c := range to {
+		todo = append(todo, step{keyLink{Key: c.Meta.PrevPK, To: c.TS}, false})
+	}
+
+	seen := map[string]bool{}
+	var links []keyLink
+	for hop := 0; len(todo) > 0 && hop < maxKeyLinks; hop++ {
+		st := todo[0]
+		todo = todo[1:]
+		l := st.link
+		if st.forward {
+			next, err := changes(bson.M{"meta.prev_pk": l.Key, "ts": bson.M{"$gte": l.From}}, 1, 1)
+			if err != nil {
+				return nil, err
+			}
+			if len(next) > 0 {
+				l.To = next[0].TS
+				todo = append(todo, step{keyLink{Key: next[0].Meta.PK, From: l.To}, true})
+			}
+		} else {
+			prev, err := changes(bson.M{"meta.pk": l.Key, "ts": bson.M{"$lte": l.To}}, -1, 1)
+			if err != nil {
+				return nil, err
+			}
+			if len(prev) > 0 {
+				l.From = prev[0].TS
+				todo = append(todo, step{keyLink{Key: prev[0].Meta.PrevPK, To: l.From}, false})
+			}
+		}
+		id := fmt.Sprintf("%v|%v|%v", l.Key, l.From, l.To)
+		if !seen[id] {
+			seen[id] = true
+			links = append(links, l)
+		}
+	}
+	return links, nil
+}
+
+// isPKFields reports whether pk uses the col=v form
+func isPKFields(pk string) bool {
+	col, _, ok := strings.Cut(pk, "=")
+	if !ok || col == "" {
+		return false
+	}
+	for _, r := range strings.TrimSpace(col) {
+		if !(r == '_' || r == '$' || r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9') {
+			return false
+		}
+	}
+	return true
+}
+
+// pkValue matches a typed key value: numeric text matches numbers too
+func pkValue(v string) any {
+	if n, err := strconv.ParseInt(v, 10, 64); err == nil {
+		return bson.M{"$in": bson.A{n, v}}
+	}
+	return v
+}
+
+// pkDisplay renders meta.pk, composite keys as col=v pairs that pkFilter
+// accepts back
+func pkDisplay(m Meta) string {
+	d, ok := m.PK.(bson.D)
+	if !ok {
+		return fmt.Sprintf("%v", m.PK)
+	}
+	parts := make([]string, len(d))
+	for i, e := range d {
+		parts[i] = fmt.Sprintf("%s=%v", e.Key, e.Value)
+	}
+	return strings.Join(parts, ",")
 }
 
 func fetchEvents(coll *mongo.Collection, params QueryParams) ([]EventDoc, error) {
@@ -107,6 +373,10 @@ func fetchEvents(coll *mongo.Collection, params QueryParams) ([]EventDoc, error)
 	// Build filter
 	filter := bson.M{}
 
+	if params.Source != "" {
+		filter["source"] = params.Source
+	}
+
 	if params.Database != "" {
 		filter["meta.db"] = params.Database
 	}
@@ -115,8 +385,24 @@ func fetchEvents(coll *mongo.Collection, params QueryParams) ([]EventDoc, error)
 		filter["meta.tbl"] = params.Table
 	}
 
-	if params.PK != nil {
-		filter["meta.pk"] = params.PK
+	if params.PK != "" {
+		pkf := pkFilter(params.PK)
+		if params.FollowPK {
+			links, err := linkedKeys(ctx, coll, params)
+			if err != nil {
+				return nil, fmt.Errorf("follow key changes: %v", err)
+			}
+			if len(links) > 0 {
+				or := bson.A{pkf}
+				for _, l := range links {
+					or = append(or, l.filter())
+				}
+				pkf = bson.M{"$or": or}
+			}
+		}
+		for k, v := range pkf {
+			filter[k] = v
+		}
 	}
 
 	if params.Operation != "" {
@@ -135,11 +421,14 @@ func fetchEvents(coll *mongo.Collection, params QueryParams) ([]EventDoc, error)
 		filter["ts"] = timeFilter
 	}
 
+	if params.Before != nil {
+		filter = olderThan(filter, *params.Before)
+	}
+
 	// Query options with performance optimizations
 	opts := options.Find().
-		SetSort(bson.D{{Key: "ts", Value: -1}}). // Use compound index: ts + meta.db + meta.tbl
-		SetHint(bson.D{{Key: "ts", Value: -1}}). // Hint to use index
-		SetBatchSize(1000)                       // Optimize batch size
+		SetSort(listOrder).
+		SetBatchSize(1000) // Optimize batch size
 
 	if params.Limit > 0 {
 		opts.SetLimit(params.Limit)
@@ -150,7 +439,9 @@ func fetchEvents(coll *mongo.Collection, params QueryParams) ([]EventDoc, error)
 	// Only fetch necessary fields for list view (optimization)
 	opts.SetProjection(bson.M{
 		"_id":    1,
+		"source": 1,
 		"ts":     1,
+		"seq":    1,
 		"op":     1,
 		"meta":   1,
 		"ts_ist": 1,
@@ -173,8 +464,168 @@ func fetchEvents(coll *mongo.Collection, params QueryParams) ([]EventDoc, error)
 	return events, nil
 }
 
+// listOrder lists events newest first. seq orders the events of a second
+// but is numbered per source, and events written before it existed have
+// none, so source and _id break the remaining ties: the order is total and
+// a page cursor cannot skip or repeat events (index {ts: -1, seq: -1,
+// source: -1, _id: -1}).
+var listOrder = bson.D{{Key: "ts", Value: -1}, {Key: "seq", Value: -1}, {Key: "source", Value: -1}, {Key: "_id", Value: -1}}
+
+// olderThan restricts filter to the events after last in listOrder, the
+// keyset cursor of a newest-first listing. filter may hold an $or of its
+// own, hence the $and.
+func olderThan(filter bson.M, last EventDoc) bson.M {
+	same := bson.M{"ts": last.TS}
+	page := bson.A{bson.M{"ts": bson.M{"$lt": last.TS}}}
+	for _, f := range []struct {
+		key string
+		val any
+		set bool
+	}{
+		{"seq", last.Seq, last.Seq != 0},
+		{"source", last.Source, last.Source != ""},
+	} {
+		// A missing seq or source (legacy events) sorts below any value,
+		// and nothing sorts below it
+		if !f.set {
+			same[f.key] = nil
+			continue
+		}
+		below := bson.M{f.key: bson.M{"$not": bson.M{"$gte": f.val}}}
+		for k, v := range same {
+			below[k] = v
+		}
+		page = append(page, below)
+		same[f.key] = f.val
+	}
+	same["_id"] = bson.M{"$lt": last.ID}
+	page = append(page, same)
+	if len(filter) == 0 {
+		return bson.M{"$or": page}
+	}
+	return bson.M{"$and": bson.A{filter, bson.M{"$or": page}}}
+}
+
+// fetchAllEvents reads the events matching params, up to params.Limit if
+// set, newest first in pages of pageSize: each page continues after the
+// last event of the one before, so deep pages cost no more than the first
+func fetchAllEvents(coll *mongo.Collection, params QueryParams, pageSize int64) ([]EventDoc, error) {
+	limit := params.Limit
+	var events []EventDoc
+	for {
+		params.Limit = pageSize
+		if left := limit - int64(len(events)); limit > 0 && left < pageSize {
+			params.Limit = left
+		}
+		page, err := fetchEvents(coll, params)
+		if err != nil {
+			return events, err
+		}
+		events = append(events, page...)
+		if int64(len(page)) < params.Limit || (limit > 0 && int64(len(events)) >= limit) {
+			return events, nil
+		}
+		params.Before = &page[len(page)-1]
+	}
+}
+
+// fetchSchemaVersions loads the schema_history versions referenced by events
+// that are not already in cache, and returns the updated cache
+func fetchSchemaVersions(coll *mongo.Collection, events []EventDoc, cache map[string]*SchemaVersion) (map[string]*SchemaVersion, error) {
+	if cache == nil {
+		cache = make(map[string]*SchemaVersion)
+	}
+	var or bson.A
+	seen := make(map[string]bool)
+	for _, e := range events {
+		if e.SchemaVer == 0 {
+			continue
+		}
+		key := schemaKey(e.Source, e.Meta.DB, e.Meta.Tbl, e.SchemaVer)
+		if cache[key] != nil || seen[key] {
+			continue
+		}
+		seen[key] = true
+		// Versions are numbered per source; only events that predate the
+		// source field are matched against any source's
+		q := bson.M{"db": e.Meta.DB, "tbl": e.Meta.Tbl, "version": e.SchemaVer}
+		if e.Source != "" {
+			q["source"] = e.Source
+		}
+		or = append(or, q)
+	}
+	if len(or) == 0 {
+		return cache, nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	cursor, err := coll.Find(ctx, bson.M{"$or": or})
+	if err != nil {
+		return cache, err
+	}
+	defer cursor.Close(ctx)
+
+	var versions []SchemaVersion
+	if err := cursor.All(ctx, &versions); err != nil {
+		return cache, err
+	}
+	for i := range versions {
+		v := &versions[i]
+		for _, key := range []string{schemaKey(v.Source, v.DB, v.Tbl, v.Version), schemaKey("", v.DB, v.Tbl, v.Version)} {
+			if seen[key] && cache[key] == nil {
+				cache[key] = v
+			}
+		}
+	}
+	return cache, nil
+}
+
+// orderedColumns returns the changed columns of an event in the column order
+// of its schema version; columns unknown to that version follow alphabetically
+func orderedColumns(event EventDoc, sv *SchemaVersion) []string {
+	cols := make([]string, 0, len(event.Chg))
+	used := make(map[string]bool, len(event.Chg))
+	if sv != nil {
+		for _, c := range sv.Columns {
+			if _, ok := event.Chg[c.Name]; ok {
+				cols = append(cols, c.Name)
+				used[c.Name] = true
+			}
+		}
+	}
+	rest := make([]string, 0, len(event.Chg)-len(cols))
+	for col := range event.Chg {
+		if !used[col] {
+			rest = append(rest, col)
+		}
+	}
+	sort.Strings(rest)
+	return append(cols, rest...)
+}
+
+// chronological returns events oldest first, the reverse of listOrder; the
+// list view shows them newest first
+func chronological(events []EventDoc) []EventDoc {
+	sorted := append([]EventDoc(nil), events...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		if !sorted[i].TS.Equal(sorted[j].TS) {
+			return sorted[i].TS.Before(sorted[j].TS)
+		}
+		if sorted[i].Seq != sorted[j].Seq {
+			return sorted[i].Seq < sorted[j].Seq
+		}
+		if sorted[i].Source != sorted[j].Source {
+			return sorted[i].Source < sorted[j].Source
+		}
+		return sorted[i].ID < sorted[j].ID
+	})
+	return sorted
+}
+
 func exportToJSON(events []EventDoc, filename string) error {
-	data, err := json.MarshalIndent(events, "", "  ")
+	data, err := json.MarshalIndent(chronological(events), "", "  ")
 	if err != nil {
 		return err
 	}
@@ -182,11 +633,13 @@ func exportToJSON(events []EventDoc, filename string) error {
 	return os.WriteFile(filename, data, 0644)
 }
 
-func exportToCSV(events []EventDoc, filename string) error {
+func exportToCSV(events []EventDoc, schemas map[string]*SchemaVersion, filename string) error {
 	if len(events) == 0 {
 		return fmt.Errorf("no events to export")
 	}
 
+	events = chronological(events)
+
 	file, err := os.Create(filename)
 	if err != nil {
 		return err
@@ -196,21 +649,19 @@ func exportToCSV(events []EventDoc, filename string) error {
 	writer := csv.NewWriter(file)
 	defer writer.Flush()
 
-	// Collect all unique column names from all events
+	// Collect all unique column names from all events, in schema order
+	// where the event's schema version is known
 	columnSet := make(map[string]bool)
+	columns := make([]string, 0)
 	for _, event := range events {
-		for col := range event.Chg {
-			columnSet[col] = true
+		for _, col := range orderedColumns(event, schemas[schemaKey(event.Source, event.Meta.DB, event.Meta.Tbl, event.SchemaVer)]) {
+			if !columnSet[col] {
+				columnSet[col] = true
+				columns = append(columns, col)
+			}
 		}
 	}
 
-	// Convert to sorted slice for consistent column order
-	columns := make([]string, 0, len(columnSet))
-	for col := range columnSet {
-		columns = append(columns, col)
-	}
-	sort.Strings(columns)
-
 	// Build CSV header
 	header := []string{
 		"Event_ID",
@@ -222,6 +673,9 @@ func exportToCSV(events []EventDoc, filename string) error {
 		"Primary_Key",
 		"Binlog_File",
 		"Binlog_Position",
+		"Schema_Version",
+		"Sequence",
+		"Source",
 	}
 
 	// Add columns for "from" and "to" values
@@ -242,7 +696,7 @@ func exportToCSV(events []EventDoc, filename string) error {
 		row[1] = event.TS.Format(time.RFC3339)
 		row[2] = event.TSIST
 
-		opName := map[string]string{"i": "INSERT", "u": "UPDATE", "d": "DELETE"}
+		opName := map[string]string{"i": "INSERT", "u": "UPDATE", "d": "DELETE", "r": "READ", "t": "TOUCH"}
 		if name, ok := opName[event.OP]; ok {
 			row[3] = name
 		} else {
@@ -251,7 +705,7 @@ func exportToCSV(events []EventDoc, filename string) error {
 
 		row[4] = event.Meta.DB
 		row[5] = event.Meta.Tbl
-		row[6] = fmt.Sprintf("%v", event.Meta.PK)
+		row[6] = pkDisplay(event.Meta)
 
 		// Binlog info
 		if event.Src != nil {
@@ -265,12 +719,26 @@ func exportToCSV(events []EventDoc, filename string) error {
 			}
 		}
 
+		if event.SchemaVer > 0 {
+			row[9] = strconv.Itoa(event.SchemaVer)
+		}
+		if event.Seq > 0 {
+			row[10] = strconv.FormatInt(event.Seq, 10)
+		}
+		row[11] = event.Source
+
 		// Change data
-		idx := 9
+		idx := 12
 		for _, col := range columns {
-			if delta, exists := event.Chg[col]; exists {
-				row[idx] = formatValue(delta.F)
-				row[idx+1] = formatValue(delta.T)
+			if delta, exists := event.Chg[col]; exists && delta.M == "drop" {
+				row[idx] = "[masked]"
+				row[idx+1] = "[masked]"
+			} else if exists && len(delta.P) > 0 {
+				row[idx] = pathValues(delta.P, true)
+				row[idx+1] = pathValues(delta.P, false)
+			} else if exists {
+				row[idx] = deltaValue(delta.F, delta.FRef)
+				row[idx+1] = deltaValue(delta.T, delta.TRef)
 			} else {
 				row[idx] = ""
 				row[idx+1] = ""
@@ -301,6 +769,14 @@ func formatValue(v any) string {
 		return t.Format("2006-01-02 15:04:05")
 	}
 
+	// JSON columns are stored as embedded documents and arrays
+	switch v.(type) {
+	case bson.D, bson.A:
+		if b, err := bson.MarshalExtJSON(bson.D{{Key: "v", Value: v}}, false, false); err == nil {
+			v = strings.TrimSuffix(strings.TrimPrefix(string(b), `{"v":`), "}")
+		}
+	}
+
 	// Convert to string, handle quotes for CSV
 	s := fmt.Sprintf("%v", v)
 
@@ -314,6 +790,8 @@ func formatValue(v any) string {
 type AppState struct {
 	app           *tview.Application
 	coll          *mongo.Collection
+	schemaColl    *mongo.Collection
+	schemas       map[string]*SchemaVersion // db.tbl#version -> definition
 	events        []EventDoc
 	selectedEvent *EventDoc
 	status        string
@@ -321,9 +799,10 @@ type AppState struct {
 	stats         Stats
 	lastUpdated   time.Time
 	filters       struct {
+		source    string
 		database  string
 		table     string
-		pk        any
+		pk        string
 		startTime time.Time
 		endTime   time.Time
 		limit     int64
@@ -352,22 +831,58 @@ func (s *AppState) loadEvents() error {
 		return fmt.Errorf("not connected to MongoDB")
 	}
 
-	params := QueryParams{
+	events, err := fetchEvents(s.coll, s.queryParams())
+	if err != nil {
+		return err
+	}
+	s.events = events
+	s.lastUpdated = time.Now()
+
+	// Schema versions are only used for rendering; a failure is not fatal
+	if s.schemaColl != nil {
+		if schemas, err := fetchSchemaVersions(s.schemaColl, events, s.schemas); err != nil {
+			s.status = fmt.Sprintf("[yellow]Schema versions unavailable: %v[-]", err)
+		} else {
+			s.schemas = schemas
+		}
+	}
+	return nil
+}
+
+// queryParams returns the query of the current filters
+func (s *AppState) queryParams() QueryParams {
+	return QueryParams{
+		Source:    s.filters.source,
 		Database:  s.filters.database,
 		Table:     s.filters.table,
 		PK:        s.filters.pk,
+		FollowPK:  true,
 		StartTime: s.filters.startTime,
 		EndTime:   s.filters.endTime,
 		Limit:     s.filters.limit,
 	}
+}
+
+// exportPageSize is how many events the CSV export reads per query
+const exportPageSize = 1000
 
-	events, err := fetchEvents(s.coll, params)
+// exportCSV writes the events of the current filters to filename, read
+// afresh a page at a time rather than taken from the list; returns how many
+func (s *AppState) exportCSV(filename string) (int, error) {
+	if s.coll == nil {
+		return 0, fmt.Errorf("not connected to MongoDB")
+	}
+	events, err := fetchAllEvents(s.coll, s.queryParams(), exportPageSize)
 	if err != nil {
-		return err
+		return 0, err
 	}
-	s.events = events
-	s.lastUpdated = time.Now()
-	return nil
+	var schemas map[string]*SchemaVersion // not the list's cache, which refreshes update meanwhile
+	if s.schemaColl != nil {
+		if schemas, err = fetchSchemaVersions(s.schemaColl, events, nil); err != nil {
+			return 0, fmt.Errorf("schema versions: %v", err)
+		}
+	}
+	return len(events), exportToCSV(events, schemas, filename)
 }
 
 func computeStats(events []EventDoc) Stats {
@@ -675,11 +1190,13 @@ func createMainUI(state *AppState) *tview.Pages {
 		}
 
 		// Add events (optimized with pre-allocated strings)
-		opNameMap := map[string]string{"i": "INS", "u": "UPD", "d": "DEL"}
+		opNameMap := map[string]string{"i": "INS", "u": "UPD", "d": "DEL", "r": "SNP", "t": "TCH"}
 		opColorMap := map[string]tcell.Color{
 			"i": tcell.ColorGreen,
 			"u": tcell.ColorYellow,
 			"d": tcell.ColorRed,
+			"r": tcell.ColorDarkCyan,
+			"t": tcell.ColorGray,
 		}
 
 		for i, event := range state.events {
@@ -694,7 +1211,7 @@ func createMainUI(state *AppState) *tview.Pages {
 				tsIST = event.TS.Format("2006-01-02 15:04:05")
 			}
 
-			pk := fmt.Sprintf("%v", event.Meta.PK)
+			pk := pkDisplay(event.Meta)
 			if len(pk) > 20 {
 				pk = pk[:17] + "..."
 			}
@@ -751,14 +1268,17 @@ func createMainUI(state *AppState) *tview.Pages {
 
 		// Update filter display
 		filterDisplay := "[cyan]Filters:[-] "
+		if state.filters.source != "" {
+			filterDisplay += fmt.Sprintf("Source=%s ", state.filters.source)
+		}
 		if state.filters.database != "" {
 			filterDisplay += fmt.Sprintf("DB=%s ", state.filters.database)
 		}
 		if state.filters.table != "" {
 			filterDisplay += fmt.Sprintf("Table=%s ", state.filters.table)
 		}
-		if state.filters.pk != nil {
-			filterDisplay += fmt.Sprintf("PK=%v ", state.filters.pk)
+		if state.filters.pk != "" {
+			filterDisplay += fmt.Sprintf("PK=%s ", state.filters.pk)
 		}
 		if !state.filters.startTime.IsZero() {
 			filterDisplay += fmt.Sprintf("From=%s ", state.filters.startTime.Format("2006-01-02"))
@@ -766,7 +1286,7 @@ func createMainUI(state *AppState) *tview.Pages {
 		if !state.filters.endTime.IsZero() {
 			filterDisplay += fmt.Sprintf("To=%s ", state.filters.endTime.Format("2006-01-02"))
 		}
-		if state.filters.database == "" && state.filters.table == "" && state.filters.pk == nil {
+		if state.filters.source == "" && state.filters.database == "" && state.filters.table == "" && state.filters.pk == "" {
 			filterDisplay += "None "
 		}
 		filterDisplay += "| [yellow]F1[-] Set | [yellow]F5[-] Refresh | [yellow]F9[-] Export"
@@ -781,7 +1301,7 @@ func createMainUI(state *AppState) *tview.Pages {
 			state.selectedEvent = &event
 
 			// Show detail view
-			detailText := formatEventDetail(event)
+			detailText := formatEventDetail(event, state.schemas[schemaKey(event.Source, event.Meta.DB, event.Meta.Tbl, event.SchemaVer)])
 			detailView.SetText(detailText)
 			pages.ShowPage("detail")
 		}
@@ -861,7 +1381,7 @@ func createMainUI(state *AppState) *tview.Pages {
 	return pages
 }
 
-func formatEventDetail(event EventDoc) string {
+func formatEventDetail(event EventDoc, sv *SchemaVersion) string {
 	var sb strings.Builder
 
 	sb.WriteString(fmt.Sprintf("[yellow]Event ID:[-] %s\n\n", event.ID))
@@ -872,11 +1392,21 @@ func formatEventDetail(event EventDoc) string {
 	}
 	sb.WriteString(fmt.Sprintf("[cyan]Timestamp:[-] %s (UTC: %s)\n", tsIST, event.TS.Format(time.RFC3339)))
 
-	opName := map[string]string{"i": "INSERT", "u": "UPDATE", "d": "DELETE"}[event.OP]
+	opName := map[string]string{"i": "INSERT", "u": "UPDATE", "d": "DELETE", "r": "READ", "t": "TOUCH"}[event.OP]
 	sb.WriteString(fmt.Sprintf("[cyan]Operation:[-] [green]%s[-]\n", opName))
+	if event.Source != "" {
+		sb.WriteString(fmt.Sprintf("[cyan]Source:[-] %s\n", event.Source))
+	}
 	sb.WriteString(fmt.Sprintf("[cyan]Database:[-] %s\n", event.Meta.DB))
 	sb.WriteString(fmt.Sprintf("[cyan]Table:[-] %s\n", event.Meta.Tbl))
-	sb.WriteString(fmt.Sprintf("[cyan]Primary Key:[-] %v\n\n", event.Meta.PK))
+	if event.Meta.PrevPK != nil {
+		sb.WriteString(fmt.Sprintf("[cyan]Key Changed:[-] [yellow]%s[-] → %s\n", pkDisplay(Meta{PK: event.Meta.PrevPK}), pkDisplay(event.Meta)))
+	}
+	if event.Meta.Key != "" {
+		sb.WriteString(fmt.Sprintf("[cyan]Row Identity:[-] %s %s\n\n", event.Meta.Key, pkDisplay(event.Meta)))
+	} else {
+		sb.WriteString(fmt.Sprintf("[cyan]Primary Key:[-] %s\n\n", pkDisplay(event.Meta)))
+	}
 
 	if event.Src != nil {
 		if binlog, ok := event.Src["binlog"].(map[string]interface{}); ok {
@@ -886,19 +1416,58 @@ func formatEventDetail(event EventDoc) string {
 			sb.WriteString(fmt.Sprintf("[cyan]GTID:[-] %s\n", gtid))
 		}
 	}
+	if event.TxID != "" {
+		sb.WriteString(fmt.Sprintf("[cyan]Transaction:[-] %s (row #%d)\n", event.TxID, event.TxSeq))
+	}
+	if event.Seq > 0 {
+		sb.WriteString(fmt.Sprintf("[cyan]Sequence:[-] %d\n", event.Seq))
+	}
+	if event.Img != "" {
+		sb.WriteString(fmt.Sprintf("[cyan]Row Image:[-] %s (only logged columns shown)\n", event.Img))
+	}
+	if sv != nil {
+		names := make([]string, len(sv.Columns))
+		for i, c := range sv.Columns {
+			names[i] = c.Name
+		}
+		sb.WriteString(fmt.Sprintf("[cyan]Schema Version:[-] v%d (%s)\n", sv.Version, strings.Join(names, ", ")))
+	} else if event.SchemaVer > 0 {
+		sb.WriteString(fmt.Sprintf("[cyan]Schema Version:[-] v%d\n", event.SchemaVer))
+	}
 
 	if len(event.Chg) > 0 {
 		sb.WriteString("\n[yellow]Changes:[-]\n")
-		cols := make([]string, 0, len(event.Chg))
-		for col := range event.Chg {
-			cols = append(cols, col)
-		}
-		sort.Strings(cols)
+		cols := orderedColumns(event, sv)
 
 		for _, col := range cols {
 			delta := event.Chg[col]
-			fromVal := formatValue(delta.F)
-			toVal := formatValue(delta.T)
+			if len(delta.P) > 0 {
+				sb.WriteString(fmt.Sprintf("  [green]%s:[-] (%d JSON paths)\n", col, len(delta.P)))
+				for _, p := range delta.P {
+					fromVal, toVal := formatValue(p.F), formatValue(p.T)
+					if len(fromVal) > 60 {
+						fromVal = fromVal[:57] + "..."
+					}
+					if len(toVal) > 60 {
+						toVal = toVal[:57] + "..."
+					}
+					switch p.Op {
+					case "a":
+						sb.WriteString(fmt.Sprintf("    [green]+[-] %s: %s\n", p.Path, toVal))
+					case "r":
+						sb.WriteString(fmt.Sprintf("    [red]-[-] %s: %s\n", p.Path, fromVal))
+					default:
+						sb.WriteString(fmt.Sprintf("    [yellow]~[-] %s: %s → %s\n", p.Path, fromVal, toVal))
+					}
+				}
+				sb.WriteString("\n")
+				continue
+			}
+			fromVal := deltaValue(delta.F, delta.FRef)
+			toVal := deltaValue(delta.T, delta.TRef)
+			if delta.M == "drop" {
+				fromVal, toVal = "[masked]", "[masked]"
+			}
 
 			if len(fromVal) > 100 {
 				fromVal = fromVal[:97] + "..."
@@ -907,7 +1476,11 @@ func formatEventDetail(event EventDoc) string {
 				toVal = toVal[:97] + "..."
 			}
 
-			sb.WriteString(fmt.Sprintf("  [green]%s:[-]\n", col))
+			if delta.M != "" {
+				sb.WriteString(fmt.Sprintf("  [green]%s:[-] (%s)\n", col, delta.M))
+			} else {
+				sb.WriteString(fmt.Sprintf("  [green]%s:[-]\n", col))
+			}
 			sb.WriteString(fmt.Sprintf("    From: %s\n", fromVal))
 			sb.WriteString(fmt.Sprintf("    To:   %s\n\n", toVal))
 		}
@@ -942,12 +1515,10 @@ func showFilterDialog(state *AppState, pages *tview.Pages, updateCallback func()
 	form.SetBorder(true).SetTitle(" Set Filters (Right-click or Shift+Insert to paste) ").SetTitleAlign(tview.AlignCenter)
 
 	// Pre-fill with current values
+	sourceValue := state.filters.source
 	dbValue := state.filters.database
 	tableValue := state.filters.table
-	pkValue := ""
-	if state.filters.pk != nil {
-		pkValue = fmt.Sprintf("%v", state.filters.pk)
-	}
+	pkValue := state.filters.pk
 	startDateValue := ""
 	if !state.filters.startTime.IsZero() {
 		startDateValue = state.filters.startTime.Format("2006-01-02")
@@ -962,6 +1533,7 @@ func showFilterDialog(state *AppState, pages *tview.Pages, updateCallback func()
 	}
 
 	// Create input fields with paste-friendly settings
+	sourceField := tview.NewInputField().SetLabel("Source (mysql://host:port): ").SetText(sourceValue).SetFieldWidth(30)
 	dbField := tview.NewInputField().SetLabel("Database: ").SetText(dbValue).SetFieldWidth(30)
 	tableField := tview.NewInputField().SetLabel("Table: ").SetText(tableValue).SetFieldWidth(30)
 	pkField := tview.NewInputField().SetLabel("Primary Key: ").SetText(pkValue).SetFieldWidth(30)
@@ -995,6 +1567,7 @@ func showFilterDialog(state *AppState, pages *tview.Pages, updateCallback func()
 		})
 	}
 
+	enablePaste(sourceField)
 	enablePaste(dbField)
 	enablePaste(tableField)
 	enablePaste(pkField)
@@ -1003,6 +1576,7 @@ func showFilterDialog(state *AppState, pages *tview.Pages, updateCallback func()
 	enablePaste(limitField)
 
 	// Add all fields to form
+	form.AddFormItem(sourceField)
 	form.AddFormItem(dbField)
 	form.AddFormItem(tableField)
 	form.AddFormItem(pkField)
@@ -1012,20 +1586,12 @@ func showFilterDialog(state *AppState, pages *tview.Pages, updateCallback func()
 
 	form.AddButton("Apply", func() {
 		// Get values from fields
+		state.filters.source = strings.TrimSpace(sourceField.GetText())
 		state.filters.database = dbField.GetText()
 		state.filters.table = tableField.GetText()
 
-		pkStr := pkField.GetText()
-		if pkStr != "" {
-			var pkInt int64
-			if _, err := fmt.Sscanf(pkStr, "%d", &pkInt); err == nil {
-				state.filters.pk = pkInt
-			} else {
-				state.filters.pk = pkStr
-			}
-		} else {
-			state.filters.pk = nil
-		}
+		// Value, or col=value,... for components of a composite key
+		state.filters.pk = strings.TrimSpace(pkField.GetText())
 
 		startDateStr := startDateField.GetText()
 		if startDateStr != "" {
@@ -1074,7 +1640,7 @@ func showFilterDialog(state *AppState, pages *tview.Pages, updateCallback func()
 		AddItem(nil, 0, 1, false).
 		AddItem(tview.NewFlex().SetDirection(tview.FlexRow).
 			AddItem(nil, 0, 1, false).
-			AddItem(form, 18, 1, true).
+			AddItem(form, 20, 1, true).
 			AddItem(nil, 0, 1, false), 60, 1, true).
 		AddItem(nil, 0, 1, false), true, true)
 }
@@ -1095,10 +1661,10 @@ func showExportDialog(state *AppState, pages *tview.Pages) {
 	form.AddButton("Export to CSV", func() {
 		pages.HidePage("export")
 		go func() {
-			if err := exportToCSV(state.events, csvFilename); err != nil {
+			if n, err := state.exportCSV(csvFilename); err != nil {
 				showMessageDialog(pages, fmt.Sprintf("Error: %v", err))
 			} else {
-				showMessageDialog(pages, fmt.Sprintf("Exported %d events to %s", len(state.events), csvFilename))
+				showMessageDialog(pages, fmt.Sprintf("Exported %d events to %s", n, csvFilename))
 			}
 		}()
 	})
@@ -1225,7 +1791,7 @@ func main() {
 	// Connect to MongoDB in the background so the UI always appears.
 	state.status = "Connecting to MongoDB..."
 	go func() {
-		coll, err := connectMongo()
+		coll, schemaColl, err := connectMongo()
 		if err != nil {
 			state.app.QueueUpdateDraw(func() {
 				state.status = fmt.Sprintf("[red]MongoDB connect failed: %v[-]", err)
@@ -1238,6 +1804,7 @@ func main() {
 		}
 
 		state.coll = coll
+		state.schemaColl = schemaColl
 		state.status = "Connected. Loading events..."
 		state.app.QueueUpdateDraw(func() {
 			if state.refreshUI != nil {
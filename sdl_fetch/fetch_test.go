@@ -0,0 +1,346 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// testDB returns an empty database on SDL_TEST_MONGO_URI, dropped when the
+// test ends; tests using it are skipped without one
+func testDB(t *testing.T) *mongo.Database {
+	t.Helper()
+	uri := os.Getenv("SDL_TEST_MONGO_URI")
+	if uri == "" {
+		t.Skip("SDL_TEST_MONGO_URI not set")
+	}
+	ctx := context.Background()
+	client, err := mongo.Connect(ctx, options.Client().ApplyURI(uri))
+	if err != nil {
+		t.Fatal(err)
+	}
+	db := client.Database(fmt.Sprintf("sdl_fetch_test_%d", time.Now().UnixNano()))
+	t.Cleanup(func() {
+		_ = db.Drop(ctx)
+		_ = client.Disconnect(ctx)
+	})
+	return db
+}
+
+func insertAll(t *testing.T, coll *mongo.Collection, docs ...any) {
+	t.Helper()
+	if _, err := coll.InsertMany(context.Background(), docs); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFetchEventsBySource(t *testing.T) {
+	coll := testDB(t).Collection("row_changes")
+	ts := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+	insertAll(t, coll,
+		EventDoc{ID: "a1", Source: "mysql://db1:3306", TS: ts, OP: "i", Meta: Meta{DB: "shop", Tbl: "orders", PK: int64(1)}, Seq: 1},
+		EventDoc{ID: "b1", Source: "mysql://db2:3306", TS: ts, OP: "i", Meta: Meta{DB: "shop", Tbl: "orders", PK: int64(1)}, Seq: 1},
+	)
+
+	tests := []struct {
+		source string
+		want   []string
+	}{
+		{"", []string{"a1", "b1"}},
+		{"mysql://db1:3306", []string{"a1"}},
+		{"mysql://db2:3306", []string{"b1"}},
+		{"mysql://db3:3306", nil},
+	}
+	for _, tt := range tests {
+		events, err := fetchEvents(coll, QueryParams{Source: tt.source, Database: "shop", PK: "1"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := map[string]bool{}
+		for _, e := range events {
+			got[e.ID] = true
+		}
+		if len(got) != len(tt.want) {
+			t.Errorf("source %q: got %v, want %v", tt.source, got, tt.want)
+		}
+		for _, id := range tt.want {
+			if !got[id] {
+				t.Errorf("source %q: missing %s", tt.source, id)
+			}
+		}
+	}
+}
+
+func TestFetchSchemaVersionsBySource(t *testing.T) {
+	coll := testDB(t).Collection("schema_history")
+	insertAll(t, coll,
+		bson.M{"source": "mysql://db1:3306", "db": "shop", "tbl": "orders", "version": 1, "columns": bson.A{bson.M{"name": "id"}, bson.M{"name": "status"}}},
+		bson.M{"source": "mysql://db2:3306", "db": "shop", "tbl": "orders", "version": 1, "columns": bson.A{bson.M{"name": "id"}, bson.M{"name": "total"}}},
+	)
+	events := []EventDoc{
+		{Source: "mysql://db1:3306", Meta: Meta{DB: "shop", Tbl: "orders"}, SchemaVer: 1},
+		{Source: "mysql://db2:3306", Meta: Meta{DB: "shop", Tbl: "orders"}, SchemaVer: 1},
+		{Meta: Meta{DB: "shop", Tbl: "orders"}, SchemaVer: 1}, // written before events carried their source
+		{Source: "mysql://db1:3306", Meta: Meta{DB: "shop", Tbl: "orders"}, SchemaVer: 2},
+	}
+	schemas, err := fetchSchemaVersions(coll, events, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		source  string
+		version int
+		want    string // second column, or "" for no version
+	}{
+		{"mysql://db1:3306", 1, "status"},
+		{"mysql://db2:3306", 1, "total"},
+		{"mysql://db1:3306", 2, ""},
+	}
+	for _, tt := range tests {
+		sv := schemas[schemaKey(tt.source, "shop", "orders", tt.version)]
+		switch {
+		case tt.want == "" && sv != nil:
+			t.Errorf("%s v%d: got %+v, want none", tt.source, tt.version, sv)
+		case tt.want != "" && (sv == nil || sv.Source != tt.source || sv.Columns[1].Name != tt.want):
+			t.Errorf("%s v%d: got %+v, want columns id, %s", tt.source, tt.version, sv, tt.want)
+		}
+	}
+	if schemas[schemaKey("", "shop", "orders", 1)] == nil {
+		t.Error("event without source found no schema version")
+	}
+}
+
+func TestExportToCSVSource(t *testing.T) {
+	ts := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+	events := []EventDoc{
+		{ID: "b", Source: "mysql://db2:3306", TS: ts, OP: "u", Meta: Meta{DB: "shop", Tbl: "orders", PK: int64(1)}, Seq: 2,
+			Chg: map[string]Delta{"status": {F: "open", T: "paid"}}},
+		{ID: "a", Source: "mysql://db1:3306", TS: ts, OP: "i", Meta: Meta{DB: "shop", Tbl: "orders", PK: int64(1)}, Seq: 1,
+			Chg: map[string]Delta{"status": {T: "open"}}},
+	}
+	path := filepath.Join(t.TempDir(), "events.csv")
+	if err := exportToCSV(events, nil, path); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	rows, err := csv.NewReader(f).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := [][]string{
+		{"Event_ID", "Sequence", "Source", "status_FROM", "status_TO"},
+		{"a", "1", "mysql://db1:3306", "NULL", "open"},
+		{"b", "2", "mysql://db2:3306", "open", "paid"},
+	}
+	if len(rows) != len(want) {
+		t.Fatalf("%d rows, want %d", len(rows), len(want))
+	}
+	for i, row := range rows {
+		got := []string{row[0], row[10], row[11], row[12], row[13]}
+		for j := range got {
+			if got[j] != want[i][j] {
+				t.Errorf("row %d: got %q, want %q", i, got, want[i])
+				break
+			}
+		}
+	}
+}
+
+func TestFetchFollowsKeyChanges(t *testing.T) {
+	coll := testDB(t).Collection("row_changes")
+	ts := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+	ev := func(id string, sec int, pk, prev any) EventDoc {
+		return EventDoc{ID: id, TS: ts.Add(time.Duration(sec) * time.Second), Seq: int64(sec + 10), OP: "u",
+			Meta: Meta{DB: "shop", Tbl: "orders", PK: pk, PrevPK: prev}}
+	}
+	insertAll(t, coll,
+		ev("e0", 0, int64(2), nil), // another row held key 2 before
+		ev("e1", 1, int64(1), nil),
+		ev("e2", 2, int64(2), int64(1)), // key 1 -> 2
+		ev("e3", 3, int64(2), nil),
+		ev("e4", 4, int64(3), int64(2)), // key 2 -> 3
+		ev("e5", 5, int64(3), nil),
+		ev("e6", 6, int64(1), nil), // key 1 reused by another row
+		ev("e7", 7, int64(2), nil), // key 2 reused by another row
+		ev("e8", 8, int64(9), nil), // unrelated row
+	)
+
+	tests := []struct {
+		pk     string
+		follow bool
+		want   []string
+	}{
+		{"3", false, []string{"e5", "e4"}},
+		{"3", true, []string{"e5", "e4", "e3", "e2", "e1"}},
+		{"1", true, []string{"e6", "e5", "e4", "e3", "e2", "e1"}},
+		{"2", true, []string{"e7", "e5", "e4", "e3", "e2", "e1", "e0"}},
+		{"9", true, []string{"e8"}},
+	}
+	for _, tt := range tests {
+		events, err := fetchEvents(coll, QueryParams{Database: "shop", Table: "orders", PK: tt.pk, FollowPK: tt.follow})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []string
+		for _, e := range events {
+			got = append(got, e.ID)
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("pk %s, follow %v: got %v, want %v", tt.pk, tt.follow, got, tt.want)
+		}
+	}
+}
+
+func TestKeyLinkFilter(t *testing.T) {
+	from := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+	to := from.Add(time.Hour)
+	tests := []struct {
+		name string
+		link keyLink
+		want bson.M
+	}{
+		{"open-ended", keyLink{Key: int64(1)}, bson.M{"meta.pk": int64(1)}},
+		{"new key", keyLink{Key: int64(2), From: from}, bson.M{"meta.pk": int64(2), "ts": bson.M{"$gte": from}}},
+		{"old key", keyLink{Key: int64(1), To: to}, bson.M{"meta.pk": int64(1), "ts": bson.M{"$lte": to}}},
+		{"between changes", keyLink{Key: int64(2), From: from, To: to}, bson.M{"meta.pk": int64(2), "ts": bson.M{"$gte": from, "$lte": to}}},
+	}
+	for _, tt := range tests {
+		if got := tt.link.filter(); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: filter = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestOlderThan(t *testing.T) {
+	ts := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+	last := EventDoc{ID: "e7", Source: "mysql://db1:3306", TS: ts, Seq: 7}
+	page := bson.M{"$or": bson.A{
+		bson.M{"ts": bson.M{"$lt": ts}},
+		bson.M{"ts": ts, "seq": bson.M{"$not": bson.M{"$gte": int64(7)}}},
+		bson.M{"ts": ts, "seq": int64(7), "source": bson.M{"$not": bson.M{"$gte": "mysql://db1:3306"}}},
+		bson.M{"ts": ts, "seq": int64(7), "source": "mysql://db1:3306", "_id": bson.M{"$lt": "e7"}},
+	}}
+	legacy := bson.M{"$or": bson.A{
+		bson.M{"ts": bson.M{"$lt": ts}},
+		bson.M{"ts": ts, "seq": nil, "source": nil, "_id": bson.M{"$lt": "e0"}},
+	}}
+	tests := []struct {
+		name   string
+		filter bson.M
+		last   EventDoc
+		want   bson.M
+	}{
+		{"no filter", bson.M{}, last, page},
+		{"filter", bson.M{"meta.db": "shop"}, last, bson.M{"$and": bson.A{bson.M{"meta.db": "shop"}, page}}},
+		{"filter with $or", pkFilter("7"), last, bson.M{"$and": bson.A{pkFilter("7"), page}}},
+		{"legacy event", bson.M{}, EventDoc{ID: "e0", TS: ts}, legacy},
+	}
+	for _, tt := range tests {
+		if got := olderThan(tt.filter, tt.last); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: olderThan = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestFetchAllEventsPages(t *testing.T) {
+	db := testDB(t)
+	coll := db.Collection("row_changes")
+	ts := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+	var docs []any
+	var newestFirst []string
+	for i := 0; i < 7; i++ {
+		// Three events per second, so page boundaries fall inside seconds
+		e := EventDoc{ID: fmt.Sprintf("e%d", i), TS: ts.Add(time.Duration(i/3) * time.Second), Seq: int64(i + 1),
+			OP: "u", Meta: Meta{DB: "shop", Tbl: "orders", PK: int64(i % 2)}, Chg: map[string]Delta{"status": {F: "a", T: "b"}}}
+		docs = append(docs, e)
+		newestFirst = append([]string{e.ID}, newestFirst...)
+	}
+	insertAll(t, coll, docs...)
+
+	tests := []struct {
+		name     string
+		params   QueryParams
+		pageSize int64
+		want     []string
+	}{
+		{"one page", QueryParams{}, 10, newestFirst},
+		{"pages", QueryParams{}, 2, newestFirst},
+		{"exact pages", QueryParams{}, 7, newestFirst},
+		{"limit", QueryParams{Limit: 5}, 2, newestFirst[:5]},
+		{"pk filter", QueryParams{PK: "1", FollowPK: true}, 1, []string{"e5", "e3", "e1"}},
+		{"after a cursor", QueryParams{Before: &EventDoc{ID: "e4", TS: ts.Add(time.Second), Seq: 5}}, 2, []string{"e3", "e2", "e1", "e0"}},
+	}
+	for _, tt := range tests {
+		events, err := fetchAllEvents(coll, tt.params, tt.pageSize)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []string
+		for _, e := range events {
+			got = append(got, e.ID)
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: got %v, want %v", tt.name, got, tt.want)
+		}
+	}
+
+	state := newAppState(coll)
+	state.schemaColl = db.Collection("schema_history")
+	state.filters.limit = 6
+	path := filepath.Join(t.TempDir(), "events.csv")
+	if n, err := state.exportCSV(path); err != nil || n != 6 {
+		t.Errorf("exportCSV = %d, %v, want 6 events", n, err)
+	}
+}
+
+// seq is numbered per source and legacy events have none, so events of
+// one second share (ts, seq); paging must still return each exactly once
+func TestFetchAllEventsPagesAcrossSources(t *testing.T) {
+	coll := testDB(t).Collection("row_changes")
+	ts := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+	var docs []any
+	var want []string
+	for i, src := range []string{"mysql://db1:3306", "mysql://db2:3306", "", ""} {
+		for seq := int64(3); seq >= 0; seq-- {
+			if src == "" && seq > 0 {
+				continue // legacy events have neither source nor seq
+			}
+			e := EventDoc{ID: fmt.Sprintf("s%d-%d", i, seq), Source: src, TS: ts, Seq: seq,
+				OP: "u", Meta: Meta{DB: "shop", Tbl: "orders", PK: int64(1)}}
+			docs = append(docs, e)
+		}
+	}
+	older := EventDoc{ID: "old", Source: "mysql://db1:3306", TS: ts.Add(-time.Second), Seq: 9,
+		OP: "u", Meta: Meta{DB: "shop", Tbl: "orders", PK: int64(1)}}
+	insertAll(t, coll, append(docs, older)...)
+	want = []string{"s1-3", "s0-3", "s1-2", "s0-2", "s1-1", "s0-1", "s1-0", "s0-0", "s3-0", "s2-0", "old"}
+
+	for _, pageSize := range []int64{1, 2, 3, 100} {
+		events, err := fetchAllEvents(coll, QueryParams{}, pageSize)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []string
+		for _, e := range events {
+			got = append(got, e.ID)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("page size %d: got %v, want %v", pageSize, got, want)
+		}
+	}
+}
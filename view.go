@@ -7,6 +7,7 @@ import (
 	"log"
 	"os/signal"
 	"sort"
+	"strconv"
 	"strings"
 	"syscall"
 	"time"
@@ -17,22 +18,35 @@ import (
 )
 
 type Delta struct {
-	F any `bson:"f,omitempty"`
-	T any `bson:"t,omitempty"`
+	F any    `bson:"f,omitempty"`
+	T any    `bson:"t,omitempty"`
+	FRef *ValueRef `bson:"f_ref,omitempty"` // large values kept out of the event
+	TRef *ValueRef `bson:"t_ref,omitempty"`
+	P []struct {
+		Path string `bson:"path"`
+	} `bson:"p,omitempty"` // changed paths of a JSON column
+	M string `bson:"m,omitempty"` // mask applied by the logger
+}
+type ValueRef struct {
+	Kind string `bson:"kind"`
+	Len  int    `bson:"len"`
 }
 type Meta struct {
-	DB  string `bson:"db"`
-	Tbl string `bson:"tbl"`
-	PK  any    `bson:"pk"`
+	DB    string `bson:"db"`
+	Tbl   string `bson:"tbl"`
+	PK    any    `bson:"pk"`
+	PKStr string `bson:"pk_str,omitempty"` // canonical form of a composite PK
 }
 type EventDoc struct {
-	ID    string           `bson:"_id"`
-	TS    time.Time        `bson:"ts"`
-	OP    string           `bson:"op"`
-	Meta  Meta             `bson:"meta"`
-	Chg   map[string]Delta `bson:"chg,omitempty"`
-	Src   map[string]any   `bson:"src,omitempty"`
-	TSIST string           `bson:"ts_ist,omitempty"`
+	ID     string           `bson:"_id"`
+	Source string           `bson:"source"` // MySQL primary, as mysql://host:port
+	TS     time.Time        `bson:"ts"`
+	OP     string           `bson:"op"`
+	Meta   Meta             `bson:"meta"`
+	Seq    int64            `bson:"seq"` // orders events of the same second
+	Chg    map[string]Delta `bson:"chg,omitempty"`
+	Src    map[string]any   `bson:"src,omitempty"`
+	TSIST  string           `bson:"ts_ist,omitempty"`
 }
 
 func main() {
@@ -43,8 +57,10 @@ func main() {
 		limit  = flag.Int("history", 20, "Print this many recent docs before live tail (0 to skip)")
 		desc   = flag.Bool("desc", true, "Show history newest first")
 		since  = flag.String("since", "", "Only show docs with ts >= RFC3339 (history and live)")
-		op     = flag.String("op", "", "Filter by op: i|u|d")
+		op     = flag.String("op", "", "Filter by op: i|u|d|r|t")
 		table  = flag.String("table", "", "Filter by table as db.table")
+		pk     = flag.String("pk", "", "Filter by primary key: value, a|b for composite keys, or col=value,...")
+		source = flag.String("source", "", "Filter by source as mysql://host:port")
 		wide   = flag.Bool("wide", false, "Wider CHANGES column")
 		poll   = flag.Duration("poll", 0, "Polling fallback interval (e.g. 2s). Set if change streams not available")
 	)
@@ -60,12 +76,12 @@ func main() {
 	c := client.Database(*db).Collection(*coll)
 
 	// Optional history
-	filter := buildFilter(*op, *table, *since)
+	filter := buildFilter(*source, *op, *table, *pk, *since)
 	if *limit > 0 {
 		opts := options.Find().SetLimit(int64(*limit))
 		order := -1
 		if !*desc { order = 1 }
-		opts.SetSort(bson.D{{Key: "ts", Value: order}})
+		opts.SetSort(bson.D{{Key: "ts", Value: order}, {Key: "seq", Value: order}, {Key: "source", Value: order}, {Key: "_id", Value: order}})
 		cur, err := c.Find(ctx, filter, opts)
 		if err != nil { log.Fatalf("find history: %v", err) }
 		var rows []EventDoc
@@ -86,7 +102,7 @@ func main() {
 		return
 	}
 
-	csFilter := changeStreamPipeline(*op, *table, *since)
+	csFilter := changeStreamPipeline(*source, *op, *table, *pk, *since)
 	opts := options.ChangeStream().
 		SetFullDocument(options.UpdateLookup)
 	stream, err := c.Watch(ctx, csFilter, opts)
@@ -113,7 +129,7 @@ func main() {
 		if ev.OperationType != "insert" {
 			continue
 		}
-		if !matchFilter(ev.FullDocument, *op, *table, *since) {
+		if !matchFilter(ev.FullDocument, *source, *op, *table, *pk, *since) {
 			continue
 		}
 		printRow(ev.FullDocument, *wide)
@@ -124,9 +140,10 @@ func main() {
 	log.Println("bye")
 }
 
-func buildFilter(op, table, since string) bson.M {
+func buildFilter(source, op, table, pk, since string) bson.M {
 	f := bson.M{}
-	if op == "i" || op == "u" || op == "d" {
+	if source != "" { f["source"] = source }
+	if op == "i" || op == "u" || op == "d" || op == "r" || op == "t" {
 		f["op"] = op
 	}
 	if table != "" {
@@ -134,6 +151,7 @@ func buildFilter(op, table, since string) bson.M {
 		if db != "" { f["meta.db"] = db }
 		if tb != "" { f["meta.tbl"] = tb }
 	}
+	if pk != "" { f["$and"] = pkConds("", pk) }
 	if since != "" {
 		if t, err := time.Parse(time.RFC3339, since); err == nil {
 			f["ts"] = bson.M{"$gte": t}
@@ -142,13 +160,14 @@ func buildFilter(op, table, since string) bson.M {
 	return f
 }
 
-func changeStreamPipeline(op, table, since string) mongo.Pipeline {
+func changeStreamPipeline(source, op, table, pk, since string) mongo.Pipeline {
 	// Match only inserts into this collection, then optional field matches.
 	match := bson.D{{Key: "operationType", Value: "insert"}}
 	and := bson.A{bson.D(match)}
+	if source != "" { and = append(and, bson.D{{Key: "fullDocument.source", Value: source}}) }
 
 	// Field-level matches
-	if op == "i" || op == "u" || op == "d" {
+	if op == "i" || op == "u" || op == "d" || op == "r" || op == "t" {
 		and = append(and, bson.D{{Key: "fullDocument.op", Value: op}})
 	}
 	if table != "" {
@@ -156,6 +175,7 @@ func changeStreamPipeline(op, table, since string) mongo.Pipeline {
 		if db != "" { and = append(and, bson.D{{Key: "fullDocument.meta.db", Value: db}}) }
 		if tb != "" { and = append(and, bson.D{{Key: "fullDocument.meta.tbl", Value: tb}}) }
 	}
+	if pk != "" { and = append(and, pkConds("fullDocument.", pk)...) }
 	if since != "" {
 		if t, err := time.Parse(time.RFC3339, since); err == nil {
 			and = append(and, bson.D{{Key: "fullDocument.ts", Value: bson.M{"$gte": t}}})
@@ -167,8 +187,9 @@ func changeStreamPipeline(op, table, since string) mongo.Pipeline {
 	}
 }
 
-func matchFilter(e EventDoc, op, table, since string) bool {
-	if op == "i" || op == "u" || op == "d" {
+func matchFilter(e EventDoc, source, op, table, pk, since string) bool {
+	if source != "" && e.Source != source { return false }
+	if op == "i" || op == "u" || op == "d" || op == "r" || op == "t" {
 		if e.OP != op { return false }
 	}
 	if table != "" {
@@ -176,6 +197,7 @@ func matchFilter(e EventDoc, op, table, since string) bool {
 		if db != "" && e.Meta.DB != db { return false }
 		if tb != "" && e.Meta.Tbl != tb { return false }
 	}
+	if pk != "" && !pkMatch(e.Meta, pk) { return false }
 	if since != "" {
 		if t, err := time.Parse(time.RFC3339, since); err == nil {
 			if e.TS.Before(t) { return false }
@@ -184,9 +206,57 @@ func matchFilter(e EventDoc, op, table, since string) bool {
 	return true
 }
 
+// pkFields splits a "col=value,..." key filter; ok is false for a plain value
+func pkFields(pk string) (fields [][2]string, ok bool) {
+	for _, part := range strings.Split(pk, ",") {
+		col, v, found := strings.Cut(part, "=")
+		col = strings.TrimSpace(col)
+		if !found || col == "" || strings.ContainsAny(col, " .|") { return nil, false }
+		fields = append(fields, [2]string{col, strings.TrimSpace(v)})
+	}
+	return fields, true
+}
+
+// pkConds matches meta.pk under prefix: a plain value matches a scalar key
+// or the canonical string of a composite one, col=value pairs match key
+// components. Numeric text matches numbers too.
+func pkConds(prefix, pk string) bson.A {
+	val := func(v string) any {
+		if n, err := strconv.ParseInt(v, 10, 64); err == nil { return bson.M{"$in": bson.A{n, v}} }
+		return v
+	}
+	fields, ok := pkFields(pk)
+	if !ok {
+		return bson.A{bson.M{"$or": bson.A{bson.M{prefix + "meta.pk": val(pk)}, bson.M{prefix + "meta.pk_str": pk}}}}
+	}
+	conds := bson.A{}
+	for _, f := range fields {
+		conds = append(conds, bson.M{prefix + "meta.pk." + f[0]: val(f[1])})
+	}
+	return conds
+}
+
+// pkMatch is pkConds for a decoded event
+func pkMatch(m Meta, pk string) bool {
+	fields, ok := pkFields(pk)
+	if !ok { return toS(m.PK) == pk || m.PKStr == pk }
+	d, _ := m.PK.(bson.D)
+	for _, f := range fields {
+		found := false
+		for _, e := range d {
+			if e.Key == f[0] && toS(e.Value) == f[1] { found = true }
+		}
+		if !found { return false }
+	}
+	return true
+}
+
 func pollLoop(ctx context.Context, c *mongo.Collection, baseFilter bson.M, every time.Duration, wide bool) {
-	// Naive tail by ts with polling
+	// Naive tail by ts with polling. Events of the second already shown can
+	// still arrive (other sources, late commits), so that second is read
+	// again, minus the _ids printed from it
 	var last time.Time
+	seen := map[string]bool{}
 	if v, ok := baseFilter["ts"].(bson.M); ok {
 		if gte, ok2 := v["$gte"].(time.Time); ok2 {
 			last = gte
@@ -205,9 +275,12 @@ func pollLoop(ctx context.Context, c *mongo.Collection, baseFilter bson.M, every
 			f := bson.M{}
 			for k, v := range baseFilter { f[k] = v }
 			if !last.IsZero() {
-				f["ts"] = bson.M{"$gt": last}
+				f["ts"] = bson.M{"$gte": last}
+				ids := make(bson.A, 0, len(seen))
+				for id := range seen { ids = append(ids, id) }
+				f["_id"] = bson.M{"$nin": ids}
 			}
-			opts := options.Find().SetSort(bson.D{{Key: "ts", Value: 1}})
+			opts := options.Find().SetSort(bson.D{{Key: "ts", Value: 1}, {Key: "seq", Value: 1}, {Key: "source", Value: 1}, {Key: "_id", Value: 1}})
 			cur, err := c.Find(ctx, f, opts)
 			if err != nil {
 				log.Printf("poll find: %v", err)
@@ -220,7 +293,8 @@ func pollLoop(ctx context.Context, c *mongo.Collection, baseFilter bson.M, every
 			}
 			for _, r := range rows {
 				printRow(r, wide)
-				if r.TS.After(last) { last = r.TS }
+				if r.TS.After(last) { last, seen = r.TS, map[string]bool{} }
+				if r.TS.Equal(last) { seen[r.ID] = true }
 			}
 		}
 	}
@@ -267,7 +341,7 @@ func printRow(e EventDoc, wide bool) {
 		clip(strings.ToLower(e.OP), 2),
 		clip(e.Meta.DB, 16),
 		clip(e.Meta.Tbl, 18),
-		clip(toS(e.Meta.PK), 18),
+		clip(pkText(e.Meta), 18),
 		clip(changesSummary(e.Chg), maxCH),
 		clip(gtid, 28),
 		clip(filepos, 22),
@@ -282,6 +356,12 @@ func printRow(e EventDoc, wide bool) {
 	fmt.Println(line)
 }
 
+// pkText shows composite keys in their canonical a|b form
+func pkText(m Meta) string {
+	if m.PKStr != "" { return m.PKStr }
+	return toS(m.PK)
+}
+
 func toS(v any) string {
 	switch x := v.(type) {
 	case nil:
@@ -314,8 +394,19 @@ func changesSummary(ch map[string]Delta) string {
 	parts := make([]string, 0, len(keys))
 	for _, k := range keys {
 		d := ch[k]
+		if d.M == "drop" {
+			parts = append(parts, k+":[masked]")
+			continue
+		}
+		if len(d.P) > 0 {
+			parts = append(parts, fmt.Sprintf("%s:%s", k, d.P[0].Path))
+			if len(d.P) > 1 { parts[len(parts)-1] += fmt.Sprintf("(+%d)", len(d.P)-1) }
+			continue
+		}
 		f := summarizeVal(d.F)
 		t := summarizeVal(d.T)
+		if d.FRef != nil { f = fmt.Sprintf("<%s %dB>", d.FRef.Kind, d.FRef.Len) }
+		if d.TRef != nil { t = fmt.Sprintf("<%s %dB>", d.TRef.Kind, d.TRef.Len) }
 		parts = append(parts, fmt.Sprintf("%s:%s→%s", k, f, t))
 	}
 	return strings.Join(parts, " | ")
@@ -333,6 +424,10 @@ func summarizeVal(v any) string {
 		return fmt.Sprintf("0x%x", x)
 	case time.Time:
 		return x.UTC().Format("2006-01-02 15:04:05Z")
+	case bson.D, bson.A:
+		s := jsonText(x)
+		if len(s) > 40 { return s[:37] + "…" }
+		return s
 	default:
 		s := fmt.Sprint(x)
 		if len(s) > 40 { return s[:37] + "…" }
@@ -340,6 +435,14 @@ func summarizeVal(v any) string {
 	}
 }
 
+// jsonText renders a JSON column value (stored as an embedded document or
+// array) back as JSON
+func jsonText(v any) string {
+	b, err := bson.MarshalExtJSON(bson.D{{Key: "v", Value: v}}, false, false)
+	if err != nil { return fmt.Sprint(v) }
+	return strings.TrimSuffix(strings.TrimPrefix(string(b), `{"v":`), "}")
+}
+
 func gtidAndFilePos(src map[string]any) (gtid string, filepos string) {
 	if src == nil { return "", "" }
 	if g, ok := src["gtid"]; ok && g != nil {